@@ -0,0 +1,206 @@
+package main
+
+import (
+	"time"
+
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+const (
+	// An auction is started again if it has not finished within
+	// auctionTimeout, and given up after auctionTries tries.
+	auctionTimeout = 2 * time.Second
+	auctionTries   = 3
+
+	// No more requests are put up for auction while maxAuctions are in
+	// flight.
+	maxAuctions = 16
+
+	// The auctions are checked for timeouts this often.
+	auctionPollInterval = 100 * time.Millisecond
+)
+
+// auction is a request put up for auction on the ring. It is in flight
+// from the COST round until the winner has acknowledged the ASSIGN.
+type auction struct {
+	req      Request
+	tries    int
+	deadline time.Time
+	cost     float64 // the bid of this elevator
+
+	// The request is a hall call the elevator already has, and is
+	// only given up for a bid better by more than margin.
+	rebalance bool
+	margin    float64
+}
+
+// Auctions is the table of the auctions this elevator has in flight,
+// by ID. Several auctions can run at once, so a burst of hall calls
+// does not wait for one round trip of the ring per call.
+//
+// Since the bids of a burst are made before any of the requests are
+// assigned, the elevator also remembers the requests it has the lowest
+// bid on, and counts them in its next bids. Otherwise the first idle
+// elevator on the ring would win them all.
+type Auctions struct {
+	nextID   uint32
+	inFlight map[uint32]*auction
+	leading  map[Request]time.Time // until the auction is over
+	traffic  *Traffic
+}
+
+// NewAuctions returns an empty table of auctions, which bids the costs
+// of the given traffic mode.
+func NewAuctions(traffic *Traffic) *Auctions {
+	return &Auctions{
+		// Start from the clock, so a restarted elevator does not take
+		// the messages of its earlier auctions for its own.
+		nextID:   uint32(time.Now().UnixNano()),
+		inFlight: make(map[uint32]*auction),
+		leading:  make(map[Request]time.Time),
+		traffic:  traffic,
+	}
+}
+
+// Start adds an auction for req and returns its ID. tries is the number
+// of times req has been put up for auction before.
+func (as *Auctions) Start(req Request, tries int) uint32 {
+	as.nextID++
+	if as.nextID == 0 { // zero is no ID
+		as.nextID++
+	}
+	as.inFlight[as.nextID] = &auction{
+		req:      req,
+		tries:    tries,
+		deadline: time.Now().Add(auctionTimeout),
+	}
+	return as.nextID
+}
+
+// Get returns the auction with the given ID, if it is in flight.
+func (as *Auctions) Get(id uint32) (*auction, bool) {
+	a, ok := as.inFlight[id]
+	return a, ok
+}
+
+// Finish removes the auction with the given ID.
+func (as *Auctions) Finish(id uint32) {
+	delete(as.inFlight, id)
+}
+
+// Has returns true if req is up for auction.
+func (as *Auctions) Has(req Request) bool {
+	for _, a := range as.inFlight {
+		if a.req == req {
+			return true
+		}
+	}
+	return false
+}
+
+// Full returns true if no more auctions should be started.
+func (as *Auctions) Full() bool {
+	return len(as.inFlight) >= maxAuctions
+}
+
+// Lead records that this elevator has the lowest bid on req.
+func (as *Auctions) Lead(req Request) {
+	as.leading[req] = time.Now().Add(auctionTimeout)
+}
+
+// Leading returns the requests this elevator has the lowest bid on.
+func (as *Auctions) Leading() []Request {
+	var reqs []Request
+	for req := range as.leading {
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// Expired removes the auctions that have timed out and returns them.
+func (as *Auctions) Expired(now time.Time) []*auction {
+	for req, until := range as.leading {
+		if now.After(until) {
+			delete(as.leading, req)
+		}
+	}
+
+	var expired []*auction
+	for id, a := range as.inFlight {
+		if now.After(a.deadline) {
+			expired = append(expired, a)
+			delete(as.inFlight, id)
+		}
+	}
+	return expired
+}
+
+// TakeAll removes all the auctions and returns their requests.
+func (as *Auctions) TakeAll() []Request {
+	var reqs []Request
+	for id, a := range as.inFlight {
+		reqs = append(reqs, a.req)
+		delete(as.inFlight, id)
+	}
+	return reqs
+}
+
+// Bid puts req up for auction, and starts the COST round with the bid
+// of this elevator. An elevator that is stopped, or does not serve the
+// floor, bids the cost of being unavailable. tries is the number of
+// times req has been put up for auction before. Bid returns the ID of
+// the auction.
+func (as *Auctions) Bid(node *network.Node, e *Elevator, mode ServiceMode, req Request, tries int) uint32 {
+	id := as.Start(req, tries)
+	var cd = msgdata.CostData{
+		ID:       id,
+		Elevator: node.Addr(),
+		Req:      req,
+		Cost:     e.costFn.Unavailable(),
+	}
+	if mode == Online && serves(node, node.Addr(), req.Floor) {
+		cd.Cost = as.Cost(e, req)
+		as.Lead(req)
+	}
+	as.inFlight[id].cost = cd.Cost
+	sendData(node, msgdata.COST, &cd)
+	debug.Printf("Sent cost message: \n\t%v\n", cd)
+	return id
+}
+
+// Cost returns the bid of the elevator for req, counting the requests
+// it is leading the auctions of.
+func (as *Auctions) Cost(e *Elevator, req Request) float64 {
+	return as.traffic.Cost(e, req, as.Leading()...)
+}
+
+// Rebalance puts the hall calls the elevator has had for longer than
+// settings.RebalanceAge up for auction again, so they can move to a car
+// that has become better placed.
+func (as *Auctions) Rebalance(node *network.Node, e *Elevator, mode ServiceMode) {
+	for _, req := range e.OldHallRequests(settings.RebalanceAge) {
+		if as.Full() {
+			return
+		}
+		if !as.Has(req) {
+			// Moving a call is only worth it if it saves more than
+			// a stop.
+			as.giveUp(node, e, mode, req, e.costFn.DoorCycle(req.Floor))
+		}
+	}
+}
+
+// Escalate puts a hall call the elevator has had for too long up for
+// auction again. It is given up for any better bid.
+func (as *Auctions) Escalate(node *network.Node, e *Elevator, mode ServiceMode, req Request) {
+	if !as.Has(req) && !as.Full() {
+		as.giveUp(node, e, mode, req, 0)
+	}
+}
+
+func (as *Auctions) giveUp(node *network.Node, e *Elevator, mode ServiceMode, req Request, margin float64) {
+	id := as.Bid(node, e, mode, req, 0)
+	as.inFlight[id].rebalance = true
+	as.inFlight[id].margin = margin
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/hallcall"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+const (
+	modePollInterval = 10 * time.Millisecond
+
+	// The table of hall calls is sent around the ring this often, so
+	// elevators that missed a change, or were cut off, catch up.
+	hallCallGossipInterval = time.Second
+)
+
+// Car is one elevator car with its own driver and its own node on the
+// ring. A process runs one car, or several cars on a loopback ring.
+type Car struct {
+	name     string
+	drv      elev.Driver
+	scanner  *elev.Scanner
+	node     *network.Node
+	watchdog *WatchdogHandler
+	backup   *msgdata.BackupData // from the watchdog process
+	metrics  string              // address to serve node statistics on
+}
+
+// run starts the panel, the controller and the node of the car, and
+// handles the requests of the car. It never returns.
+func (c *Car) run() {
+	drv, node, watchdog := c.drv, c.node, c.watchdog
+	var mode ServiceMode
+
+	panel := NewPanel(drv, c.scanner)
+	node.SetMeta(network.Meta{
+		Name:    c.name,
+		Floors:  drv.Floors(),
+		Version: version,
+		Caps:    capDirect,
+	})
+
+	// Serve node statistics and the floor keypads if a metrics
+	// address is configured.
+	elevator := NewElevator(drv, c.scanner, panel)
+	keypads := NewKeypads()
+	if c.metrics != "" {
+		go serveMetrics(c.metrics, node, elevator, keypads)
+	}
+
+	// Load the backup from the watchdog process. This does nothing if
+	// the backup has only nil-values.
+	elevator.LoadBackup(c.backup)
+	panel.LoadBackup(c.backup)
+
+	// Setup channels.
+	msgsFromOther := make(chan *network.Message)
+	msgsFromThis := make(chan *network.Message)
+	deadNode := make(chan network.Addr)
+	undelivered := make(chan *network.Message)
+
+	// Start all threads. NOTE!! The order matters.
+	node.Start()
+	panel.Start()
+	elevator.Start()
+
+	// Start Goroutines that put all incomming messages onto channels.
+	go receiveMsgs(node, msgsFromOther)
+	go receiveMyMsgs(node, msgsFromThis)
+	go getDeadNode(node, deadNode)
+	go getUndelivered(node, undelivered)
+
+	// Initialize BackupHandler and store an initial backup.
+	var backup = &BackupHandler{
+		backups: make(map[network.Addr]*msgdata.BackupData),
+		addr:    node.Addr(),
+		invalid: make(chan struct{}),
+	}
+	backup.create(elevator)
+	go backup.changed(elevator)
+
+	// Track the hall calls of the ring, to catch calls that are not
+	// served in time.
+	calls := NewHallCalls()
+	calls.Start()
+
+	// The hall calls of the ring, of which every elevator keeps a
+	// replica. The hall lamps show the calls in the table, so they are
+	// the same on every elevator.
+	table := hallcall.NewTable(node.Addr())
+	gossipTicker := time.NewTicker(hallCallGossipInterval)
+	showHallCalls(panel, table)
+
+	// Where the car waits when it is idle. The parking floors are
+	// claimed over the ring.
+	parking := NewParking(settings.Parking, drv.Floors())
+	parkTicker := time.NewTicker(parkInterval)
+
+	// The traffic mode, which is picked by the elevator with the lowest
+	// address and sent to the others.
+	traffic := NewTraffic(drv.Floors())
+	trafficTicker := time.NewTicker(trafficInterval)
+
+	// Start elevator in local mode.
+	mode = Local
+
+	// The requests waiting to be put up for auction, or taken in local
+	// mode. The queue belongs to this loop, so adding to it never blocks.
+	var unassigned []Request
+
+	// The service mode is updated at least this often.
+	modeTicker := time.NewTicker(modePollInterval)
+
+	// Check the other elevators for version skew once in a while.
+	memberTicker := time.NewTicker(time.Second)
+	skewed := make(map[network.Addr]bool)
+
+	// The auctions in flight. reqch is ready while there are
+	// unassigned requests and room in the table. When the table is
+	// full, reqch is set to nil, so no more requests are taken until an
+	// auction finishes.
+	auctions := NewAuctions(traffic)
+	auctionTicker := time.NewTicker(auctionPollInterval)
+	ready := make(chan struct{})
+	close(ready)
+	var reqch chan struct{}
+
+	// Hall calls that have waited for long are put up for auction
+	// again now and then.
+	var rebalance <-chan time.Time
+	if settings.RebalanceAge > 0 && settings.RebalanceInterval > 0 {
+		rebalance = time.NewTicker(settings.RebalanceInterval).C
+	}
+
+	for {
+		/*
+		 * Update elevator service mode.
+		 */
+		if node.IsConnected() && elevator.IsRunning() {
+			switch mode {
+			case Local:
+				gossipHallCalls(node, table)
+			case Stopped:
+			case Online:
+			}
+
+			mode = Online
+		} else if node.IsConnected() && !elevator.IsRunning() {
+			switch mode {
+			case Online:
+				// Hand our hall requests over to the other elevators.
+				unassigned = append(unassigned, elevator.TakeHallRequests()...)
+			case Local:
+				gossipHallCalls(node, table)
+			case Stopped:
+			}
+
+			mode = Stopped
+		} else {
+			switch mode {
+			case Stopped:
+				fallthrough
+			case Online:
+				// Serve the requests of the auctions that were in
+				// flight when the elevator was disconnected.
+				for _, r := range auctions.TakeAll() {
+					elevator.AddRequest(r)
+					announceDispatch(node, keypads, node.Addr(), r)
+				}
+
+			case Local:
+			}
+
+			mode = Local
+		}
+
+		if auctions.Full() || len(unassigned) == 0 {
+			reqch = nil
+		} else {
+			reqch = ready
+		}
+
+		/*
+		 * Process messages and handle backups.
+		 */
+		select {
+
+		case <-watchdog.timer.C:
+			watchdog.writeBackup(backup.get())
+			watchdog.timer.Reset(watchdogResendInterval)
+
+		case <-backup.invalid:
+			old := backup.get()
+			bd := backup.create(elevator)
+			traffic.ObserveBackup(old, bd, time.Now())
+			watchdog.writeBackup(bd)
+			calls.Update(bd, backup.backups, node.Members())
+
+			if mode != Local {
+				sendData(node, msgdata.BACKUP, bd)
+				debug.Printf("Sent backup message: \n\t%v\n", bd)
+			}
+
+		case r := <-panel.Requests:
+			if table.Set(r) {
+				hallCallsChanged(node, panel, table, mode)
+				observeHallCalls(table, parking, traffic)
+			}
+			unassigned = append(unassigned, r)
+
+		case kc := <-keypads.Calls:
+			keypads.Wait(kc)
+			if table.Set(kc.req) {
+				hallCallsChanged(node, panel, table, mode)
+				observeHallCalls(table, parking, traffic)
+			}
+			unassigned = append(unassigned, kc.req)
+
+		case r := <-elevator.Served:
+			if table.Clear(r) {
+				hallCallsChanged(node, panel, table, mode)
+				observeHallCalls(table, parking, traffic)
+			}
+
+		case <-reqch:
+			req := unassigned[0]
+			unassigned = unassigned[1:]
+			if mode == Online || mode == Stopped {
+				auctions.Bid(node, elevator, mode, req, 0)
+			} else if mode == Local {
+				elevator.AddRequest(req)
+				announceDispatch(node, keypads, node.Addr(), req)
+			}
+
+		case msg := <-msgsFromOther:
+			if mode == Stopped {
+				node.ForwardMessage(msg)
+			} else if mode == Local {
+				break
+			}
+
+			switch msg.Type {
+			case msgdata.COST:
+				var cd msgdata.CostData
+				if err := unpackData(msg.Data, &cd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				debug.Printf("Received cost message: \n\t%v\n", cd)
+
+				// Update cost message if our cost is lower. A stopped
+				// elevator is not available.
+				if mode == Online && serves(node, node.Addr(), cd.Req.Floor) {
+					cost := auctions.Cost(elevator, cd.Req)
+					if cost < cd.Cost {
+						cd.Elevator = node.Addr()
+						cd.Cost = cost
+						auctions.Lead(cd.Req)
+					}
+				}
+
+				debug.Printf("Forwarded cost message: \n\t%v\n", cd)
+
+				packData(msg.Data, &cd)
+
+			case msgdata.ASSIGN:
+				var ad msgdata.AssignData
+				if err := unpackData(msg.Data, &ad); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				debug.Printf("Received assign message: \n\t%v\n", ad)
+
+				// ASSIGN is sent straight to the elevator that
+				// won the request.
+				if ad.Elevator == node.Addr() {
+					elevator.AddRequest(ad.Req)
+					if table.Set(ad.Req) {
+						hallCallsChanged(node, panel, table, mode)
+					}
+				}
+
+			case msgdata.BACKUP:
+				var bd msgdata.BackupData
+				if err := unpackData(msg.Data, &bd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				debug.Printf("Forwarded backup message: \n\t%v\n", bd)
+
+				traffic.ObserveBackup(backup.backups[bd.Elevator], &bd, time.Now())
+				backup.update(&bd)
+				calls.Update(&bd, backup.backups, node.Members())
+
+			case msgdata.SYNC:
+				// Sent by elevators from before the table of hall
+				// calls, to light their lamps when they join.
+				var sd msgdata.SyncData
+				unpackData(msg.Data, &sd)
+				syncBackup(&sd, backup.get())
+				packData(msg.Data, &sd)
+
+			case msgdata.HALLCALLS:
+				var hd msgdata.HallCallData
+				if err := unpackData(msg.Data, &hd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				if table.Merge(&hd) {
+					debug.Printf("Merged hall calls: \n\t%v\n", hd)
+					showHallCalls(panel, table)
+					observeHallCalls(table, parking, traffic)
+				}
+
+			case msgdata.PARK:
+				var pd msgdata.ParkData
+				if err := unpackData(msg.Data, &pd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				parking.Claim(&pd, time.Now())
+
+			case msgdata.MODE:
+				var md msgdata.ModeData
+				if err := unpackData(msg.Data, &md); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				traffic.Heard(node, &md, time.Now())
+
+			case msgdata.DISPATCH:
+				var dd msgdata.DispatchData
+				if err := unpackData(msg.Data, &dd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				debug.Printf("Received dispatch message: \n\t%v\n", dd)
+				keypads.Dispatched(carName(node, dd.Elevator), dd.Req)
+
+			}
+			node.ForwardMessage(msg)
+
+		case msg := <-msgsFromThis:
+			if mode == Local {
+				break
+			}
+
+			switch msg.Type {
+			case msgdata.COST:
+				// A broken message is left to the auction timeout.
+				var cd msgdata.CostData
+				if err := unpackData(msg.Data, &cd); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				debug.Printf("Cost message returned: \n\t%v\n", cd)
+
+				a, ok := auctions.Get(cd.ID)
+				if !ok {
+					debug.Printf("Auction %v is no longer in flight.\n", cd.ID)
+					break
+				}
+
+				// Refuse to dispatch to an elevator that does not serve the floor.
+				if !serves(node, cd.Elevator, cd.Req.Floor) {
+					errorlog.Printf("%v does not serve floor %v\n",
+						cd.Elevator, cd.Req.Floor)
+					cd.Elevator = node.Addr()
+				}
+
+				// A hall call this elevator has is only given up for a
+				// better bid, and only if it has not been served in the
+				// meantime.
+				if a.rebalance {
+					better := cd.Elevator != node.Addr() && a.cost-cd.Cost > a.margin
+					if !better || !elevator.GiveUp(cd.Req) {
+						auctions.Finish(cd.ID)
+						break
+					}
+					debug.Printf("Gave up %v to %v.\n", cd.Req, cd.Elevator)
+					a.rebalance = false
+				}
+
+				// Keep the request if this elevator has the lowest cost.
+				if cd.Elevator == node.Addr() {
+					auctions.Finish(cd.ID)
+					if mode != Stopped {
+						elevator.AddRequest(cd.Req)
+						calls.Assigned(cd.Req, node.Addr())
+						announceDispatch(node, keypads, node.Addr(), cd.Req)
+					} else {
+						unassigned = append(unassigned, cd.Req)
+					}
+					break
+				}
+
+				// Assign request to elevator with lowest cost value.
+				var ad = msgdata.AssignData{
+					ID:       cd.ID,
+					Elevator: cd.Elevator,
+					Req:      cd.Req,
+				}
+				sendDataTo(node, cd.Elevator, msgdata.ASSIGN, &ad)
+				debug.Printf("Sent assign message: \n\t%v\n", ad)
+				a.deadline = time.Now().Add(auctionTimeout)
+
+			case msgdata.ASSIGN:
+				var ad msgdata.AssignData
+				if err := unpackData(msg.Data, &ad); err != nil {
+					errorlog.Println(err)
+					break
+				}
+
+				// The ASSIGN has been acknowledged by the elevator
+				// it was sent to. The auction is complete.
+				debug.Printf("Assign message delivered: \n\t%v\n", ad)
+				auctions.Finish(ad.ID)
+				calls.Assigned(ad.Req, ad.Elevator)
+				announceDispatch(node, keypads, ad.Elevator, ad.Req)
+
+			}
+
+		case fe := <-elevator.Faults:
+			errorlog.Println("Elevator fault:", fe)
+
+		case b := <-calls.Breaches:
+			errorlog.Println("SLA breach:", b)
+			if mode == Local {
+				break
+			}
+
+			// The car that has the call gives it up for any better
+			// bid. If that car has left the ring, the elevator that
+			// gave it the call, or else the one with the lowest
+			// address, puts it up for auction again.
+			if b.Holder == node.Addr() {
+				for _, r := range elevator.HallRequests(b.Req.Floor, b.Req.Direction) {
+					auctions.Escalate(node, elevator, mode, r)
+				}
+			} else if _, ok := node.Member(b.Holder); !ok && (b.Mine || lowestAddr(node)) {
+				unassigned = append(unassigned, b.Req)
+			}
+
+		case <-gossipTicker.C:
+			if mode != Local {
+				gossipHallCalls(node, table)
+			}
+
+		case now := <-parkTicker.C:
+			parking.Update(node, elevator, mode, traffic.Mode(), now)
+
+		case now := <-trafficTicker.C:
+			traffic.Update(node, mode, now)
+
+		case <-rebalance:
+			if mode != Local {
+				auctions.Rebalance(node, elevator, mode)
+			}
+
+		case <-memberTicker.C:
+			for addr, meta := range node.Members() {
+				if meta.Version == version || meta.Version == "" {
+					delete(skewed, addr)
+				} else if !skewed[addr] {
+					errorlog.Printf("%v (%v) runs version %v, this elevator runs %v\n",
+						addr, meta.Name, meta.Version, version)
+					skewed[addr] = true
+				}
+			}
+
+		case msg := <-undelivered:
+			if msg.Type != msgdata.ASSIGN {
+				break
+			}
+
+			var ad msgdata.AssignData
+			if err := unpackData(msg.Data, &ad); err != nil {
+				errorlog.Println(err)
+				break
+			}
+
+			// The elevator that won the request did not answer. Try
+			// again with the remaining elevators.
+			debug.Printf("Assign message not delivered: \n\t%v\n", ad)
+			if a, ok := auctions.Get(ad.ID); ok {
+				auctions.Finish(ad.ID)
+				auctions.Bid(node, elevator, mode, a.req, a.tries+1)
+			}
+
+		case now := <-auctionTicker.C:
+			for _, a := range auctions.Expired(now) {
+				if a.rebalance {
+					continue // the elevator still has the call
+				}
+				if a.tries+1 < auctionTries && mode != Local {
+					debug.Printf("Auction for %v timed out, trying again.\n", a.req)
+					auctions.Bid(node, elevator, mode, a.req, a.tries+1)
+					continue
+				}
+				// A car that is not online can not serve the request
+				// now. Queue it again, so it is put up for auction or
+				// taken in local mode.
+				if mode != Online {
+					debug.Printf("Auction for %v timed out, queueing it again.\n", a.req)
+					unassigned = append(unassigned, a.req)
+					continue
+				}
+				// Nobody answers. Better to serve the request here
+				// than to lose it.
+				errorlog.Printf("Auction for %v failed, taking it.\n", a.req)
+				elevator.AddRequest(a.req)
+				announceDispatch(node, keypads, node.Addr(), a.req)
+			}
+
+		case dead := <-deadNode:
+			debug.Printf("%v has been disconnected. Try to find backup.\n", dead)
+
+			// Lookup backup for the disconnected elevator.
+			if deadbackup, found := backup.backups[dead]; found {
+				debug.Printf("Found backup of %v\n", dead)
+
+				unassigned = append(unassigned, restoreBackup(deadbackup)...)
+			}
+
+		case <-modeTicker.C:
+			// Update the service mode.
+		}
+
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+)
+
+// CostFunction prices the steps of a simulated trip to a request. The
+// elevators compare their costs, so they must all use the same cost
+// function.
+type CostFunction interface {
+	// Start is the cost of starting the car from a stop.
+	Start() float64
+
+	// Move is the cost of moving one floor from floor in direction dir.
+	Move(floor int, dir elev.Direction) float64
+
+	// DoorCycle is the cost of stopping at floor and opening and
+	// closing the doors.
+	DoorCycle(floor int) float64
+
+	// Detour is the extra cost of stopping at floor for a cab call
+	// while the car is heading away from the request.
+	Detour(floor int) float64
+
+	// Unavailable is the cost bid by an elevator that can not take
+	// requests.
+	Unavailable() float64
+}
+
+// The cost functions that can be chosen with cost in the config.
+var costFunctions = map[string]func(e *Elevator) CostFunction{
+	"unit": func(*Elevator) CostFunction { return unitCost{} },
+	"time": func(e *Elevator) CostFunction { return timeCost{e.times} },
+}
+
+// unavailableCost is bid by an elevator that can not take requests. It
+// is larger than any real cost, so the bid never wins against a car
+// that can serve the request.
+var unavailableCost = math.Inf(1)
+
+// newCostFunction returns the cost function with the given name for e.
+// main refuses to start with an unknown name; should one get here
+// anyway, it is logged and the unit cost is used.
+func newCostFunction(name string, e *Elevator) CostFunction {
+	if f, ok := costFunctions[name]; ok {
+		return f(e)
+	}
+	errorlog.Printf("Unknown cost function %q, using unit cost.\n", name)
+	return unitCost{}
+}
+
+// unitCost is the original cost model, in made up units.
+type unitCost struct{}
+
+func (unitCost) Start() float64                   { return 0 }
+func (unitCost) Move(int, elev.Direction) float64 { return 3 }
+func (unitCost) DoorCycle(int) float64            { return 4 }
+func (unitCost) Detour(int) float64               { return 3 }
+func (unitCost) Unavailable() float64             { return unavailableCost }
+
+// timeCost estimates the time to serve the request in seconds, from the
+// travel, start and door times measured on this elevator.
+type timeCost struct {
+	times *tripTimes
+}
+
+func (c timeCost) Start() float64 {
+	return c.times.startTime().Seconds()
+}
+
+func (c timeCost) Move(floor int, dir elev.Direction) float64 {
+	return c.times.travelTime(floor, dir).Seconds()
+}
+
+func (c timeCost) DoorCycle(int) float64 {
+	return c.times.doorTime().Seconds()
+}
+
+// A detour costs about the time to travel one floor.
+func (c timeCost) Detour(floor int) float64 {
+	return c.Move(floor, elev.Up)
+}
+
+func (timeCost) Unavailable() float64 { return unavailableCost }
+
+const (
+	// Times used until they have been measured.
+	defaultTravelTime = 2 * time.Second
+	defaultStartTime  = 500 * time.Millisecond
+
+	// Weight of a new measurement in the averages.
+	tripTimeWeight = 0.125
+)
+
+// tripTimes holds running averages of the times measured on the
+// elevator: the travel time between each pair of neighbouring floors,
+// the extra time to start from a stop, and the time of a door cycle.
+// They are kept in the backup, so they survive a restart.
+type tripTimes struct {
+	mu     sync.Mutex
+	travel []time.Duration // from each floor to the next
+	start  time.Duration
+	door   time.Duration
+}
+
+func newTripTimes(floors int) *tripTimes {
+	t := &tripTimes{
+		travel: make([]time.Duration, floors-1),
+		start:  defaultStartTime,
+		door:   settings.DoorOpenTime + 2*settings.DoorMoveTime,
+	}
+	for i := range t.travel {
+		t.travel[i] = defaultTravelTime
+	}
+	return t
+}
+
+// gap returns the index in travel of the move from floor in direction
+// dir, or -1 if there is no such move.
+func (t *tripTimes) gap(floor int, dir elev.Direction) int {
+	if dir == elev.Down {
+		floor--
+	}
+	if floor < 0 || floor >= len(t.travel) {
+		return -1
+	}
+	return floor
+}
+
+// travelTime returns the time to move one floor from floor in
+// direction dir, not counting the time to start.
+func (t *tripTimes) travelTime(floor int, dir elev.Direction) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i := t.gap(floor, dir); i != -1 {
+		return t.travel[i]
+	}
+	return defaultTravelTime
+}
+
+func (t *tripTimes) startTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.start
+}
+
+func (t *tripTimes) doorTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.door
+}
+
+// addMove adds the time d the car took to move one floor from floor in
+// direction dir. If the car started from a stop, the time beyond the
+// travel time counts towards the start time.
+func (t *tripTimes) addMove(floor int, dir elev.Direction, d time.Duration, fromStop bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.gap(floor, dir)
+	switch {
+	case i == -1:
+	case fromStop:
+		extra := d - t.travel[i]
+		if extra < 0 {
+			extra = 0
+		}
+		t.start = average(t.start, extra)
+	default:
+		t.travel[i] = average(t.travel[i], d)
+	}
+}
+
+func (t *tripTimes) addDoor(d time.Duration) {
+	t.mu.Lock()
+	t.door = average(t.door, d)
+	t.mu.Unlock()
+}
+
+// save copies the times into a backup.
+func (t *tripTimes) save(bd *msgdata.BackupData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bd.DoorTime = t.door
+	bd.StartTime = t.start
+	bd.Travel = append([]time.Duration(nil), t.travel...)
+}
+
+// load restores the times measured before from a backup. Times that
+// were not measured keep their defaults.
+func (t *tripTimes) load(bd *msgdata.BackupData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bd.DoorTime != 0 {
+		t.door = bd.DoorTime
+	}
+	if bd.StartTime != 0 {
+		t.start = bd.StartTime
+	}
+	for i := range t.travel {
+		if i < len(bd.Travel) && bd.Travel[i] != 0 {
+			t.travel[i] = bd.Travel[i]
+		}
+	}
+}
+
+func average(avg, d time.Duration) time.Duration {
+	return avg + time.Duration(tripTimeWeight*float64(d-avg))
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"math"
+	"sync/atomic"
 	"time"
 
 	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
 )
 
-const maxSimulationSteps = 64
+const (
+	maxSimulationSteps = 8 * elev.MaxFloors // enough to cross the building a few times
+	faultRetryInterval = 500 * time.Millisecond
+	doorPollInterval   = 25 * time.Millisecond
+	servedBuffer       = 2 * elev.MaxFloors
+)
 
 // stateFn represents the state of the elevator as a function that
 // returns the next state.
@@ -18,15 +26,65 @@ type Elevator struct {
 	floor     int
 	direction elev.Direction
 
-	stopped bool
+	// Set when the car is halted and does not take hall calls. It is
+	// read by other goroutines, so it is only used through IsRunning
+	// and setStopped.
+	stopped int32
+
+	// Faults reports faults in the motor and the floor sensor. Events
+	// are dropped if nobody reads them.
+	Faults     chan FaultEvent
+	fault      *Fault
+	faultTries int
+	lost       bool // the car has not reached a floor since it started
+
+	// Served reports the hall calls the car has served. Calls are
+	// dropped if nobody reads them.
+	Served chan Request
+
+	// calls holds functions to run on the elevator goroutine, so other
+	// goroutines can look at the state between events. It is only used
+	// through do, after Start.
+	calls   chan func()
+	started int32
+
+	drv     elev.Driver
+	err     error // first driver error since the last fault
+	scanner *elev.Scanner
+	events  <-chan elev.Event
+	panel   *Panel
+
+	floors     int
+	dest       []bool
+	destBuffer []bool
+
+	requests       [][2]bool
+	requestsBuffer [][2]bool
+
+	// pickups[floor][dest] is set for a keypad call waiting at floor
+	// for a car to dest. The destination becomes a stop when the car
+	// picks the passenger up.
+	pickups [][]bool
 
-	panel *Panel
+	// when each hall call was given to the car, or zero
+	callTimes [][2]time.Time
 
-	dest       [elev.NumFloors]bool
-	destBuffer [elev.NumFloors]bool
+	// The floor the car goes to when it is idle, or -1, and since when
+	// it has had nothing to do.
+	park       int
+	parkBuffer int
+	idleSince  time.Time
 
-	requests       [elev.NumFloors][2]bool
-	requestsBuffer [elev.NumFloors][2]bool
+	// door cycle
+	doorStarted     time.Time
+	doorDeadline    time.Time
+	obstructedSince time.Time
+
+	// measured times, and the cost function that may use them
+	motor    elev.Direction // last direction sent to the motor
+	fromStop bool           // the motor was started since the last floor
+	times    *tripTimes
+	costFn   CostFunction
 
 	// simulator
 	simulate   bool
@@ -34,32 +92,113 @@ type Elevator struct {
 	virtualreq Request
 }
 
-func NewElevator(p *Panel) *Elevator {
+func NewElevator(drv elev.Driver, sc *elev.Scanner, p *Panel) *Elevator {
 	e := &Elevator{
+		drv:       drv,
+		scanner:   sc,
+		events:    sc.Subscribe(elev.FloorReached, elev.StopPressed, elev.InputError),
 		panel:     p,
 		direction: elev.Stop,
+		Faults:    make(chan FaultEvent, faultBuffer),
+		Served:    make(chan Request, servedBuffer),
+		calls:     make(chan func()),
+	}
+	e.times = newTripTimes(drv.Floors())
+	e.costFn = newCostFunction(settings.Cost, e)
+	e.floors = drv.Floors()
+	e.dest = make([]bool, e.floors)
+	e.destBuffer = make([]bool, e.floors)
+	e.requests = make([][2]bool, e.floors)
+	e.requestsBuffer = make([][2]bool, e.floors)
+	e.callTimes = make([][2]time.Time, e.floors)
+	e.park, e.parkBuffer = -1, -1
+	e.pickups = make([][]bool, e.floors)
+	for floor := range e.pickups {
+		e.pickups[floor] = make([]bool, e.floors)
 	}
 	return e
 }
 
 // Initializes elevator from backup. LoadBackup may be called with a
-// empty backupData struct.
-func (e *Elevator) LoadBackup(bd *backupData) {
-	e.floor = bd.floor
-	e.direction = bd.direction
-	e.dest = bd.dest
-	e.destBuffer = bd.dest
-	//e.requests = bd.requests
-	//e.requestsBuffer = bd.requests
+// empty BackupData struct. A backup from an elevator with a different
+// number of floors is ignored.
+func (e *Elevator) LoadBackup(bd *msgdata.BackupData) {
+	if bd.Floors() != e.floors {
+		return
+	}
+	e.floor = bd.Floor
+	e.direction = bd.Direction
+	copy(e.dest, bd.Dest)
+	copy(e.destBuffer, bd.Dest)
+	e.times.load(bd)
+	//e.requests = bd.Requests
+	//e.requestsBuffer = bd.Requests
+}
+
+// SimulateCost returns the cost for the elevator to serve req, as if
+// the pending requests were assigned to it as well.
+func (e *Elevator) SimulateCost(req Request, pending ...Request) (cost float64) {
+	e.do(func() { cost = e.simulateTrip(req, e.costFn, pending...) })
+	return cost
+}
+
+// ETA returns the estimated time until the car arrives at req, from the
+// times measured on the car. It does not matter whether req is assigned
+// to the car. ETA returns false if the car is stopped or faulty, or
+// does not serve the floor.
+func (e *Elevator) ETA(req Request) (eta time.Duration, ok bool) {
+	e.do(func() { eta, ok = e.eta(req) })
+	return eta, ok
 }
 
-func (e *Elevator) SimulateCost(req Request) float64 {
+func (e *Elevator) eta(req Request) (time.Duration, bool) {
+	if !e.IsRunning() || e.fault != nil || !req.IsValid(e.floors) {
+		return 0, false
+	}
+	cost := e.simulateTrip(req, timeCost{e.times})
+	return time.Duration(cost * float64(time.Second)), true
+}
+
+// simulateTrip runs a virtual copy of the elevator until it reaches req,
+// and returns the cost of the trip given by costFn. For a keypad call
+// the trip goes on until the passenger is at the destination, so the
+// cost covers the whole journey and not just the wait.
+func (e *Elevator) simulateTrip(req Request, costFn CostFunction, pending ...Request) float64 {
+	if !req.IsValid(e.floors) {
+		return math.Inf(1)
+	}
+
+	// A car recovering from a fault can not tell when it gets there, so
+	// its hall calls move to other cars when they are rebalanced.
+	if e.fault != nil {
+		return costFn.Unavailable()
+	}
+
 	//create virtual elevator used for simulating cost
 	var ve *Elevator = new(Elevator)
 	*ve = *e
+	ve.dest = append([]bool(nil), e.dest...)
+	ve.destBuffer = append([]bool(nil), e.destBuffer...)
+	ve.requests = append([][2]bool(nil), e.requests...)
+	ve.requestsBuffer = append([][2]bool(nil), e.requestsBuffer...)
+	ve.pickups = make([][]bool, len(e.pickups))
+	for floor := range e.pickups {
+		ve.pickups[floor] = append([]bool(nil), e.pickups[floor]...)
+	}
 
 	ve.simulate = true
-	ve.requests[req.floor][indexOfDir(req.direction)] = true
+	ve.park, ve.parkBuffer = -1, -1
+	ve.costFn = costFn
+	ve.cost = 0
+	for _, r := range pending {
+		if r.IsValid(ve.floors) && r != req {
+			ve.requests[r.Floor][indexOfDir(r.Direction)] = true
+			if dest, ok := r.Dest(); ok {
+				ve.pickups[r.Floor][dest] = true
+			}
+		}
+	}
+	ve.requests[req.Floor][indexOfDir(req.Direction)] = true
 	ve.virtualreq = req
 
 	for i := 0; ve.state != nil && i < maxSimulationSteps; i++ {
@@ -69,92 +208,366 @@ func (e *Elevator) SimulateCost(req Request) float64 {
 }
 
 func (e *Elevator) Start() {
+	atomic.StoreInt32(&e.started, 1)
 	go e.run()
-	go e.readPanel()
+}
+
+// do runs f on the elevator goroutine, and returns when f has returned.
+// Before Start, the caller owns the elevator and f runs at once.
+func (e *Elevator) do(f func()) {
+	if atomic.LoadInt32(&e.started) == 0 {
+		f()
+		return
+	}
+	done := make(chan struct{})
+	e.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// sleep waits for d, running the functions sent to do meanwhile.
+func (e *Elevator) sleep(d time.Duration) {
+	timeout := time.After(d)
+	for {
+		select {
+		case f := <-e.calls:
+			f()
+		case <-timeout:
+			return
+		}
+	}
 }
 
 func (e *Elevator) IsRunning() bool {
-	return !e.stopped
+	return atomic.LoadInt32(&e.stopped) == 0
+}
+
+func (e *Elevator) setStopped(stopped bool) {
+	var v int32
+	if stopped {
+		v = 1
+	}
+	atomic.StoreInt32(&e.stopped, v)
 }
 
 func (e *Elevator) AddRequest(req Request) {
-	if req.isValid() {
-		e.requestsBuffer[req.floor][indexOfDir(req.direction)] = true
+	if req.IsValid(e.floors) {
+		e.do(func() {
+			if dest, ok := req.Dest(); ok {
+				e.pickups[req.Floor][dest] = true
+			}
+			if t := &e.callTimes[req.Floor][indexOfDir(req.Direction)]; t.IsZero() {
+				*t = time.Now()
+			}
+			e.requestsBuffer[req.Floor][indexOfDir(req.Direction)] = true
+		})
 	} else {
 		errorlog.Println("Invalid request")
 	}
 }
 
+// TakeHallRequests removes the hall requests from the elevator and
+// returns them, so they can be given to other elevators. A keypad call
+// is returned for each passenger waiting.
+func (e *Elevator) TakeHallRequests() []Request {
+	var reqs []Request
+	e.do(func() {
+		for floor := 0; floor < e.floors; floor++ {
+			for _, dir := range []elev.Direction{elev.Down, elev.Up} {
+				if e.requestsBuffer[floor][indexOfDir(dir)] {
+					for _, req := range e.hallRequests(floor, dir) {
+						e.giveUp(req)
+						reqs = append(reqs, req)
+					}
+				}
+			}
+		}
+	})
+	return reqs
+}
+
+// OldHallRequests returns the hall requests that were given to the car
+// more than age ago. They are not removed.
+func (e *Elevator) OldHallRequests(age time.Duration) (reqs []Request) {
+	e.do(func() { reqs = e.oldHallRequests(age) })
+	return reqs
+}
+
+func (e *Elevator) oldHallRequests(age time.Duration) []Request {
+	var reqs []Request
+	for floor := 0; floor < e.floors; floor++ {
+		for _, dir := range []elev.Direction{elev.Down, elev.Up} {
+			since := e.callTimes[floor][indexOfDir(dir)]
+			if e.requestsBuffer[floor][indexOfDir(dir)] && !since.IsZero() &&
+				time.Since(since) > age {
+				reqs = append(reqs, e.hallRequests(floor, dir)...)
+			}
+		}
+	}
+	return reqs
+}
+
+// HallRequests returns the requests behind the hall call at floor in
+// direction dir, as hallRequests does, or nil if the car does not serve
+// the floor.
+func (e *Elevator) HallRequests(floor int, dir elev.Direction) (reqs []Request) {
+	if !(Request{Floor: floor, Direction: dir}).IsValid(e.floors) {
+		return nil
+	}
+	e.do(func() { reqs = e.hallRequests(floor, dir) })
+	return reqs
+}
+
+// hallRequests returns the requests behind the hall call at floor in
+// direction dir: a keypad call for each passenger waiting, or else a
+// single request.
+func (e *Elevator) hallRequests(floor int, dir elev.Direction) []Request {
+	var reqs []Request
+	for dest, waiting := range e.pickups[floor] {
+		req := msgdata.NewDestRequest(floor, dest)
+		if waiting && req.Direction == dir {
+			reqs = append(reqs, req)
+		}
+	}
+	if reqs == nil {
+		reqs = append(reqs, Request{Floor: floor, Direction: dir})
+	}
+	return reqs
+}
+
+// GiveUp removes a hall request that has been given to another car. The
+// hall call stays until its last keypad call is removed. The lamp is
+// left on, since the call is still to be served. GiveUp returns false
+// if the car does not have the request, for instance because it has
+// served it. The check and the removal are done on the elevator
+// goroutine, so a call the car is arriving at is either served or given
+// up, never both.
+func (e *Elevator) GiveUp(req Request) (ok bool) {
+	e.do(func() { ok = e.giveUp(req) })
+	return ok
+}
+
+func (e *Elevator) giveUp(req Request) bool {
+	if !req.IsValid(e.floors) || !e.requestsBuffer[req.Floor][indexOfDir(req.Direction)] {
+		return false
+	}
+	dest, keypad := req.Dest()
+	if _, waiting := e.hallRequests(req.Floor, req.Direction)[0].Dest(); waiting != keypad {
+		return false
+	}
+	if keypad {
+		if !e.pickups[req.Floor][dest] {
+			return false
+		}
+		e.pickups[req.Floor][dest] = false
+		if _, more := e.hallRequests(req.Floor, req.Direction)[0].Dest(); more {
+			return true
+		}
+	}
+	e.requestsBuffer[req.Floor][indexOfDir(req.Direction)] = false
+	e.callTimes[req.Floor][indexOfDir(req.Direction)] = time.Time{}
+	return true
+}
+
+// Park sends the car to floor when it has been idle for
+// settings.ParkDelay. It waits there with the doors closed. A floor of
+// -1 leaves the car where it stops.
+func (e *Elevator) Park(floor int) {
+	if floor >= e.floors {
+		floor = -1
+	}
+	e.do(func() { e.parkBuffer = floor })
+}
+
+// Idle returns the floor of the car, and true if the car has had
+// nothing to do for settings.ParkDelay. A car that is parking is still
+// idle.
+func (e *Elevator) Idle() (floor int, idle bool) {
+	e.do(func() {
+		floor = e.floor
+		since := e.idleSince
+		idle = e.IsRunning() && e.fault == nil && !since.IsZero() &&
+			time.Since(since) >= settings.ParkDelay
+	})
+	return floor, idle
+}
+
+// readPanel adds the cab buttons pressed since the last call to the
+// destinations. It does not block.
 func (e *Elevator) readPanel() {
 	for {
-		floor := <-e.panel.Commands
-		e.destBuffer[floor] = true
+		select {
+		case floor := <-e.panel.Commands:
+			e.destBuffer[floor] = true
+		default:
+			return
+		}
 	}
 }
 
 func (e *Elevator) run() {
 	for e.state = start; e.state != nil; {
 
-		e.requests = e.requestsBuffer
-		e.dest = e.destBuffer
+		e.readPanel()
+		copy(e.requests, e.requestsBuffer)
+		copy(e.dest, e.destBuffer)
+		e.park = e.parkBuffer
 
 		// advance to next state
 		e.state = e.state(e)
+		if e.err != nil {
+			e.state = fault
+		}
 	}
 }
 
 func start(e *Elevator) stateFn {
-	if f := elev.ReadFloorSensor(); f == -1 {
+	e.drainEvents()
+	f := e.scanner.Floor()
+	if f >= e.floors {
+		return e.detectFault(e.checkFloor(f))
+	}
+	if f == -1 {
+		e.lost = true
 		if e.direction == elev.Stop {
-			elev.SetMotorDirection(elev.Down)
+			e.setMotor(elev.Down)
 			e.direction = elev.Down
 		} else {
-			elev.SetMotorDirection(e.direction)
+			e.setMotor(e.direction)
 		}
 		return moving
 	}
-	e.floor = elev.ReadFloorSensor()
-	elev.SetFloorIndicator(e.floor)
+	e.floor = f
+	e.setIndicator(e.floor)
 	return idle
 }
 
+// fault is entered when the driver fails. The elevator reports itself
+// as stopped, so its requests are handed over, and keeps trying to stop
+// the motor until the driver answers again.
+func fault(e *Elevator) stateFn {
+	if e.simulate {
+		e.cost = e.costFn.Unavailable()
+		return nil
+	}
+
+	errorlog.Println("Elevator driver failed:", e.err)
+	e.setStopped(true)
+
+	for e.drv.SetMotorDirection(elev.Stop) != nil {
+		e.sleep(faultRetryInterval)
+	}
+	debug.Println("Elevator driver is back.")
+
+	e.err = nil
+	e.setStopped(false)
+	return start
+}
+
+// emergencyStop halts the car until the stop button is pressed again.
+// The cab destinations are cancelled, and the elevator reports itself
+// as stopped so its hall requests are handed over and it does not win
+// new ones. If the car is at a floor, the doors stay open.
+func emergencyStop(e *Elevator) stateFn {
+	if e.simulate {
+		// The stop may have been pressed before e.stopped is set, so a
+		// halted car bids as unavailable rather than as already there.
+		e.cost = e.costFn.Unavailable()
+		return nil
+	}
+
+	e.setMotor(elev.Stop)
+	e.setStopLamp(1)
+	e.setStopped(true)
+	debug.Println("Emergency stop.")
+
+	if e.scanner.Floor() != -1 {
+		e.setDoorLamp(1)
+	}
+	for floor := 0; floor < e.floors; floor++ {
+		e.dest[floor] = false
+		e.destBuffer[floor] = false
+		e.panel.SetLamp(elev.Command, floor, false)
+	}
+
+	// Reset by pressing the stop button again.
+wait:
+	for {
+		select {
+		case ev := <-e.events:
+			if ev.Type == elev.StopPressed {
+				break wait
+			}
+			if ev.Type == elev.InputError {
+				e.check(ev.Err)
+				return fault
+			}
+		case f := <-e.calls:
+			f()
+		}
+	}
+
+	debug.Println("Emergency stop reset.")
+	e.setStopLamp(0)
+	e.setDoorLamp(0)
+	e.setStopped(false)
+	return start
+}
+
 func moving(e *Elevator) stateFn {
 	if e.simulate {
+		e.cost += e.costFn.Move(e.floor, e.direction)
 		e.floor = e.floor + int(e.direction)
-		e.cost += 3
 		return atFloor
 	}
 
-	timeout := time.After(2 * time.Second)
-	
-	for elev.ReadFloorSensor() == -1 {
+	started := time.Now()
+	timeout := time.After(settings.MotorStallTime)
+
+	for {
 		select {
+		case ev := <-e.events:
+			switch ev.Type {
+			case elev.FloorReached:
+				if f := e.checkFloor(ev.Floor); f != nil {
+					return e.detectFault(f)
+				}
+				if !e.lost {
+					e.times.addMove(e.floor, e.direction, time.Since(started), e.fromStop)
+				}
+				e.lost = false
+				e.fromStop = false
+				e.floor = ev.Floor
+				return atFloor
+			default:
+				if next := interrupt(e, ev); next != nil {
+					return next
+				}
+			}
+		case f := <-e.calls:
+			f()
 		case <-timeout:
-			e.stopped = true
-		default:
-			time.Sleep(100 * time.Millisecond)
+			return e.detectFault(&Fault{Type: MotorStall, Floor: e.floor, Sensor: -1, Since: time.Now()})
 		}
 	}
-	e.stopped = false
-	
-	e.floor = elev.ReadFloorSensor()
-	return atFloor
 }
 
 func atFloor(e *Elevator) stateFn {
 	if !e.simulate {
-		elev.SetFloorIndicator(e.floor)
+		e.setIndicator(e.floor)
 	}
 
 	// Is this floor a destination?
 	if e.dest[e.floor] {
 		if !e.simulate {
-			elev.SetMotorDirection(elev.Stop)
+			e.setMotor(elev.Stop)
 		}
 		e.dest[e.floor] = false
 		e.destBuffer[e.floor] = false
 
-		if e.simulate && e.floor == e.virtualreq.floor {
+		if e.arrived() {
 			return nil
 		}
 
@@ -175,10 +588,10 @@ func atFloor(e *Elevator) stateFn {
 	// Is there a request at this floor in the direction we're going?
 	if e.requests[e.floor][indexOfDir(e.direction)] {
 		if !e.simulate {
-			elev.SetMotorDirection(elev.Stop)
+			e.setMotor(elev.Stop)
 		}
 
-		if e.simulate && e.floor == e.virtualreq.floor {
+		if e.arrived() {
 			return nil
 		}
 
@@ -188,62 +601,186 @@ func atFloor(e *Elevator) stateFn {
 		return doorsOpen
 	}
 
-	// No more destinations, and no more requests in the direction we are going.
-	if !e.hasDest() && !e.hasWork() {
+	// No more destinations, and no more requests in the direction we are
+	// going. A car on its way to park goes on.
+	if !e.hasDest() && !e.hasWork() && !e.parkingAhead() {
 		if !e.simulate {
-			elev.SetMotorDirection(elev.Stop)
+			e.setMotor(elev.Stop)
 		}
 		e.direction = elev.Stop
 		return idle
 	}
 
 	// Fail safe; should never be true.
-	if (e.direction == elev.Up && e.floor == elev.NumFloors-1) ||
+	if (e.direction == elev.Up && e.floor == e.floors-1) ||
 		(e.direction == elev.Down && e.floor == 0) {
 		if !e.simulate {
-			elev.SetMotorDirection(elev.Stop)
+			e.setMotor(elev.Stop)
 		}
 		e.direction = elev.Stop
 		return idle
 	}
 
-	// Wait untill floor is passed.
-	if !e.simulate {
-		timeout := time.After(1 * time.Second)
-		
-		for elev.ReadFloorSensor() == -1 {
-			select {
-			case <-timeout:
-				e.stopped = true
-			default:
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
-		e.stopped = false
-	}
-
 	return moving
 }
 
 func doorsOpen(e *Elevator) stateFn {
 	if e.simulate {
-		if (e.floor < e.virtualreq.floor && e.direction == elev.Down) ||
-			(e.floor > e.virtualreq.floor && e.direction == elev.Up) {
-			e.cost = e.cost + 3 // fixed cost for internal commands
+		if (e.floor < e.virtualreq.Floor && e.direction == elev.Down) ||
+			(e.floor > e.virtualreq.Floor && e.direction == elev.Up) {
+			e.cost += e.costFn.Detour(e.floor) // internal commands
 		}
 
-		e.cost = e.cost + 4 // fixed cost for waiting until the doors close
+		e.cost += e.costFn.DoorCycle(e.floor) // waiting until the doors close
+		return gotoFloor
+	}
+
+	e.doorStarted = time.Now()
+	return doorOpening
+}
+
+// The door cycle is doorOpening, doorOpen and doorClosing. The doors
+// are held open while obstructed, and reopen if they are obstructed
+// while closing. Pressing the cab button of the current floor while the
+// doors are open keeps them open for longer. A virtual elevator in the
+// middle of a door cycle finishes it at once.
+
+func doorOpening(e *Elevator) stateFn {
+	if e.simulate {
+		return gotoFloor
+	}
+
+	e.setDoorLamp(1)
+	if next := e.waitDoor(settings.DoorMoveTime, false); next != nil {
+		return next
+	}
+	e.doorDeadline = time.Now().Add(settings.DoorOpenTime)
+	return doorOpen
+}
+
+func doorOpen(e *Elevator) stateFn {
+	if e.simulate {
 		return gotoFloor
 	}
 
-	elev.SetDoorOpenLamp(1)
-	defer elev.SetDoorOpenLamp(0)
+	ticker := time.NewTicker(doorPollInterval)
+	defer ticker.Stop()
 
-	timeOut := time.After(3 * time.Second)
-	<-timeOut
+	for {
+		select {
+		case ev := <-e.events:
+			if next := interrupt(e, ev); next != nil {
+				return next
+			}
+		case f := <-e.calls:
+			f()
+		case now := <-ticker.C:
+			if e.holdPressed() {
+				e.doorDeadline = now.Add(settings.DoorHoldTime)
+			}
+			if e.scanner.Obstruction() {
+				if e.obstructedSince.IsZero() {
+					e.obstructedSince = now
+				}
+				if now.Sub(e.obstructedSince) > settings.DoorFaultTime {
+					return doorFault
+				}
+				continue
+			}
+			e.obstructedSince = time.Time{}
+			if now.After(e.doorDeadline) {
+				return doorClosing
+			}
+		}
+	}
+}
+
+func doorClosing(e *Elevator) stateFn {
+	if e.simulate {
+		return gotoFloor
+	}
+
+	if next := e.waitDoor(settings.DoorMoveTime, true); next != nil {
+		return next
+	}
+	e.setDoorLamp(0)
+	e.times.addDoor(time.Since(e.doorStarted))
 	return gotoFloor
 }
 
+// doorFault is entered when the doors have been obstructed for too
+// long. The elevator reports itself as stopped, so its hall calls are
+// handed to other elevators, and waits with the doors open until the
+// obstruction is gone.
+func doorFault(e *Elevator) stateFn {
+	if e.simulate {
+		e.cost = e.costFn.Unavailable()
+		return nil
+	}
+
+	errorlog.Printf("Doors obstructed for more than %v.\n", settings.DoorFaultTime)
+	e.setStopped(true)
+
+	ticker := time.NewTicker(doorPollInterval)
+	defer ticker.Stop()
+
+	for e.scanner.Obstruction() {
+		select {
+		case ev := <-e.events:
+			if next := interrupt(e, ev); next != nil {
+				return next
+			}
+		case f := <-e.calls:
+			f()
+		case <-ticker.C:
+		}
+	}
+
+	debug.Println("Door obstruction cleared.")
+	e.setStopped(false)
+	e.obstructedSince = time.Time{}
+	return doorClosing
+}
+
+// waitDoor waits while the doors open or close. If reopen is set, an
+// obstruction or a hold request makes it return doorOpening. It returns
+// nil when the doors have finished moving.
+func (e *Elevator) waitDoor(d time.Duration, reopen bool) stateFn {
+	timeout := time.After(d)
+	ticker := time.NewTicker(doorPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-e.events:
+			if next := interrupt(e, ev); next != nil {
+				return next
+			}
+		case f := <-e.calls:
+			f()
+		case <-ticker.C:
+			if reopen && (e.scanner.Obstruction() || e.holdPressed()) {
+				return doorOpening
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// holdPressed returns true if the cab button of the current floor has
+// been pressed, and clears it.
+func (e *Elevator) holdPressed() bool {
+	e.readPanel()
+	if !e.destBuffer[e.floor] {
+		return false
+	}
+	e.destBuffer[e.floor] = false
+	e.dest[e.floor] = false
+	e.panel.SetLamp(elev.Command, e.floor, false)
+	return true
+}
+
 func gotoFloor(e *Elevator) stateFn {
 	// Assumption: motor is stopped when entering this function, but
 	// e.direction holds the previous direction of motion.
@@ -251,14 +788,10 @@ func gotoFloor(e *Elevator) stateFn {
 		for f := range e.dest {
 			// Are there more destinations in the direction of motion?
 			if e.dest[f] && f > e.floor && e.direction == elev.Up {
-				if !e.simulate {
-					elev.SetMotorDirection(elev.Up)
-				}
+				e.startMotor(elev.Up)
 				return moving
 			} else if e.dest[f] && f < e.floor && e.direction == elev.Down {
-				if !e.simulate {
-					elev.SetMotorDirection(elev.Down)
-				}
+				e.startMotor(elev.Down)
 				return moving
 			} else if e.dest[f] && f == e.floor {
 				return atFloor
@@ -276,29 +809,31 @@ func gotoFloor(e *Elevator) stateFn {
 
 	// Check for request in diection of motion.
 	if e.hasWork() {
-		if !e.simulate {
-			elev.SetMotorDirection(e.direction)
-		}
+		e.startMotor(e.direction)
 		return moving
 	}
 
 	// If we get to this point, there are no more destinations.
 	if !e.simulate {
-		elev.SetMotorDirection(elev.Stop)
+		e.setMotor(elev.Stop)
 	}
 	e.direction = elev.Stop
 	return idle
 }
 
 func idle(e *Elevator) stateFn {
+	if e.hasDest() || e.hasRequests() {
+		e.idleSince = time.Time{}
+	}
+
 	if e.hasDest() {
 		e.direction = elev.Up
 		return gotoFloor
 	}
 
-	for floor := 0; floor < elev.NumFloors; floor++ {
+	for floor := 0; floor < e.floors; floor++ {
 		if e.requests[floor][indexOfDir(elev.Up)] || e.requests[floor][indexOfDir(elev.Down)] {
-			if e.simulate && floor == e.floor && floor == e.virtualreq.floor {
+			if floor == e.floor && e.arrived() {
 				return nil
 			} else if floor == e.floor && e.requests[floor][indexOfDir(elev.Up)] {
 				e.clearRequest(floor, elev.Up)
@@ -321,15 +856,65 @@ func idle(e *Elevator) stateFn {
 	}
 
 	if !e.simulate {
-		time.Sleep(25 * time.Millisecond)
+		if e.idleSince.IsZero() {
+			e.idleSince = time.Now()
+		}
+		if next := e.goPark(); next != nil {
+			return next
+		}
+
+		select {
+		case ev := <-e.events:
+			if next := interrupt(e, ev); next != nil {
+				return next
+			}
+		case f := <-e.calls:
+			f()
+		case <-time.After(25 * time.Millisecond):
+		}
 	}
 
 	return idle
 }
 
+// goPark starts the car towards the floor it parks at, once it has been
+// idle for settings.ParkDelay. It returns nil if the car stays.
+func (e *Elevator) goPark() stateFn {
+	if e.park == -1 || e.park == e.floor || time.Since(e.idleSince) < settings.ParkDelay {
+		return nil
+	}
+	debug.Printf("Parking at floor %v.\n", e.park)
+	e.direction = elev.Up
+	if e.park < e.floor {
+		e.direction = elev.Down
+	}
+	e.startMotor(e.direction)
+	return moving
+}
+
+// parkingAhead returns true if the car has nothing to do, and the floor
+// it parks at is in the direction of motion.
+func (e *Elevator) parkingAhead() bool {
+	if e.park == -1 || e.idleSince.IsZero() || e.hasDest() || e.hasRequests() {
+		return false
+	}
+	return (e.direction == elev.Up && e.park > e.floor) ||
+		(e.direction == elev.Down && e.park < e.floor)
+}
+
+// hasRequests returns true if the car has any hall requests.
+func (e *Elevator) hasRequests() bool {
+	for floor := 0; floor < e.floors; floor++ {
+		if e.requests[floor][indexOfDir(elev.Up)] || e.requests[floor][indexOfDir(elev.Down)] {
+			return true
+		}
+	}
+	return false
+}
+
 // Checks if there are more requests in the current direction of motion.
 func (e *Elevator) hasWork() bool {
-	for floor := 0; floor < elev.NumFloors; floor++ {
+	for floor := 0; floor < e.floors; floor++ {
 		if e.requests[floor][indexOfDir(elev.Up)] || e.requests[floor][indexOfDir(elev.Down)] {
 			if (e.direction == elev.Up && floor > e.floor) ||
 				(e.direction == elev.Down && floor < e.floor) {
@@ -342,7 +927,7 @@ func (e *Elevator) hasWork() bool {
 
 // Checks if there are more requests in the current direction of motion.
 func (e *Elevator) hasDest() bool {
-	for floor := 0; floor < elev.NumFloors; floor++ {
+	for floor := 0; floor < e.floors; floor++ {
 		if e.dest[floor] {
 			return true
 		}
@@ -350,16 +935,117 @@ func (e *Elevator) hasDest() bool {
 	return false
 }
 
-// Clear requests and resets panel lamp.
+// The driver helpers remember the first error, which sends the
+// elevator to the fault state after the current state.
+
+func (e *Elevator) setMotor(dir elev.Direction) {
+	if e.motor == elev.Stop && dir != elev.Stop {
+		e.fromStop = true
+	}
+	e.motor = dir
+	e.check(e.drv.SetMotorDirection(dir))
+}
+
+// startMotor starts the car from a stop. A virtual elevator adds the
+// cost of starting instead.
+func (e *Elevator) startMotor(dir elev.Direction) {
+	if e.simulate {
+		e.cost += e.costFn.Start()
+		return
+	}
+	e.setMotor(dir)
+}
+
+func (e *Elevator) setIndicator(floor int) {
+	e.check(e.drv.SetFloorIndicator(floor))
+}
+
+func (e *Elevator) setDoorLamp(val int) {
+	e.check(e.drv.SetDoorOpenLamp(val))
+}
+
+func (e *Elevator) setStopLamp(val int) {
+	e.check(e.drv.SetStopLamp(val))
+}
+
+// interrupt returns the state to go to for an event that interrupts
+// normal operation, or nil if the event does not.
+func interrupt(e *Elevator, ev elev.Event) stateFn {
+	switch ev.Type {
+	case elev.StopPressed:
+		return emergencyStop
+	case elev.InputError:
+		e.check(ev.Err)
+		return fault
+	}
+	return nil
+}
+
+func (e *Elevator) check(err error) {
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// drainEvents drops events that arrived before the elevator knew where
+// it was.
+func (e *Elevator) drainEvents() {
+	for {
+		select {
+		case <-e.events:
+		default:
+			return
+		}
+	}
+}
+
+// arrived returns true if a virtual elevator has reached the request it
+// simulates. A keypad call is reached when the car gets to the
+// destination, so at the pickup floor the destination becomes the
+// request instead.
+func (e *Elevator) arrived() bool {
+	if !e.simulate || e.floor != e.virtualreq.Floor {
+		return false
+	}
+	dest, ok := e.virtualreq.Dest()
+	if !ok {
+		return true
+	}
+	e.dest[dest] = true
+	e.virtualreq = Request{Floor: dest, Direction: e.virtualreq.Direction}
+	return false
+}
+
+// Clear requests and resets panel lamp. The destinations of the keypad
+// calls at the floor become stops, since the passengers get on. A hall
+// call that another car has is left alone, and so is its lamp.
 func (e *Elevator) clearRequest(floor int, dir elev.Direction) {
-	req := Request{floor, dir}
-	if !req.isValid() {
+	req := Request{Floor: floor, Direction: dir}
+	if !req.IsValid(e.floors) {
 		return
 	}
 
-	e.requests[floor][indexOfDir(dir)] = false
-	e.requestsBuffer[floor][indexOfDir(dir)] = false
-	if !e.simulate {
+	i := indexOfDir(dir)
+	held := e.requestsBuffer[floor][i]
+	e.requests[floor][i] = false
+	e.requestsBuffer[floor][i] = false
+	if !e.simulate && held {
 		e.panel.SetLamp(btnFromDir(dir), floor, false)
+		e.callTimes[floor][i] = time.Time{}
+		select {
+		case e.Served <- req:
+		default:
+		}
+	}
+
+	for dest, waiting := range e.pickups[floor] {
+		if waiting && (dest > floor) == (dir == elev.Up) {
+			e.pickups[floor][dest] = false
+			e.dest[dest] = true
+			e.destBuffer[dest] = true
+			if !e.simulate {
+				e.panel.SetLamp(elev.Command, dest, true)
+			}
+		}
 	}
 }
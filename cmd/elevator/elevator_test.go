@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+func newTestElevator(t *testing.T, drv elev.Driver) *Elevator {
+	sc := elev.NewScanner(drv)
+	if err := sc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sc.Stop)
+	return NewElevator(drv, sc, NewPanel(drv, sc))
+}
+
+// startElevator starts the elevator goroutine of e, and stops it at the
+// end of the test, so it does not read the settings of the tests after.
+func startElevator(t *testing.T, e *Elevator) {
+	e.Start()
+	t.Cleanup(func() {
+		// The goroutine blocks for good in the function.
+		e.calls <- func() { select {} }
+	})
+}
+
+// outputDriver is a mock driver that also sends the motor and door lamp
+// outputs on channels, so a test can wait for them. Each read of the
+// floor sensor, which the scanner does once a scan, is sent on reads.
+type outputDriver struct {
+	*elev.Mock
+	motor chan elev.Direction
+	door  chan int
+	reads chan struct{}
+}
+
+func newOutputDriver(floors int) *outputDriver {
+	return &outputDriver{
+		Mock:  elev.NewMock(floors),
+		motor: make(chan elev.Direction, 64),
+		door:  make(chan int, 64),
+		reads: make(chan struct{}, 64),
+	}
+}
+
+func (d *outputDriver) ReadFloorSensor() (int, error) {
+	select {
+	case d.reads <- struct{}{}:
+	default:
+	}
+	return d.Mock.ReadFloorSensor()
+}
+
+func (d *outputDriver) SetMotorDirection(dir elev.Direction) error {
+	err := d.Mock.SetMotorDirection(dir)
+	if err == nil {
+		select {
+		case d.motor <- dir:
+		default:
+		}
+	}
+	return err
+}
+
+func (d *outputDriver) SetDoorOpenLamp(val int) error {
+	err := d.Mock.SetDoorOpenLamp(val)
+	if err == nil {
+		select {
+		case d.door <- val:
+		default:
+		}
+	}
+	return err
+}
+
+// waitMotor waits until the motor is set to dir.
+func waitMotor(t *testing.T, d *outputDriver, dir elev.Direction) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case got := <-d.motor:
+			if got == dir {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for motor %d", dir)
+		}
+	}
+}
+
+// waitDoorLamp waits until the door lamp is set to val.
+func waitDoorLamp(t *testing.T, d *outputDriver, val int) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-d.door:
+			if got == val {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for door lamp %d", val)
+		}
+	}
+}
+
+// waitScans waits until the scanner has read the inputs n more times.
+func waitScans(t *testing.T, d *outputDriver, n int) {
+	t.Helper()
+	for len(d.reads) > 0 {
+		<-d.reads
+	}
+	timeout := time.After(time.Second)
+	for ; n > 0; n-- {
+		select {
+		case <-d.reads:
+		case <-timeout:
+			t.Fatal("timed out waiting for the scanner")
+		}
+	}
+}
+
+// waitState waits for the state a state function running in another
+// goroutine sends on done.
+func waitState(t *testing.T, done <-chan stateFn, what string) stateFn {
+	t.Helper()
+	select {
+	case next := <-done:
+		return next
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return nil
+}
+
+// waitRunning waits until e.IsRunning returns running.
+func waitRunning(t *testing.T, e *Elevator, running bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); e.IsRunning() != running; {
+		if time.Now().After(deadline) {
+			t.Fatalf("IsRunning = %v, want %v", !running, running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStartAtFloor(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	drv.SetFloor(2)
+	e := newTestElevator(t, drv)
+
+	if start(e) == nil {
+		t.Fatal("start returned nil state")
+	}
+	if e.floor != 2 {
+		t.Errorf("floor = %d, want 2", e.floor)
+	}
+	if got := drv.FloorIndicator(); got != 2 {
+		t.Errorf("floor indicator = %d, want 2", got)
+	}
+	if got := drv.Motor(); got != elev.Stop {
+		t.Errorf("motor = %d, want Stop", got)
+	}
+}
+
+func TestStartBetweenFloors(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	drv.SetFloor(-1)
+	e := newTestElevator(t, drv)
+
+	next := start(e)
+	if got := drv.Motor(); got != elev.Down {
+		t.Errorf("motor = %d, want Down", got)
+	}
+
+	// The car reaches the floor below.
+	drv.SetFloor(1)
+	next(e)
+	if e.floor != 1 {
+		t.Errorf("floor = %d, want 1", e.floor)
+	}
+}
+
+func TestGotoFloorStartsMotor(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.requests[2][indexOfDir(elev.Up)] = true
+
+	next := idle(e)
+	next(e)
+	if got := drv.Motor(); got != elev.Up {
+		t.Errorf("motor = %d, want Up", got)
+	}
+}
+
+func TestSimulateCost(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.state = idle
+
+	// Three floors up from an idle car.
+	cost := e.SimulateCost(Request{Floor: 3, Direction: elev.Down})
+	if cost != 9 {
+		t.Errorf("cost = %v, want 9", cost)
+	}
+	if drv.Motor() != elev.Stop {
+		t.Error("simulation moved the motor")
+	}
+}
+
+func TestHaltedCost(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	for _, state := range []stateFn{emergencyStop, doorFault, fault} {
+		e.state = state
+		if cost := e.SimulateCost(Request{Floor: 3, Direction: elev.Down}); cost != e.costFn.Unavailable() {
+			t.Errorf("cost of a halted car = %v, want %v", cost, e.costFn.Unavailable())
+		}
+	}
+}
+
+func TestCostFunctions(t *testing.T) {
+	for _, tc := range []struct {
+		costFn CostFunction
+		want   float64
+	}{
+		{unitCost{}, 3 + 4 + 2*3},
+		{timeCost{&tripTimes{
+			travel: []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second},
+			start:  time.Second,
+			door:   4 * time.Second,
+		}}, 1 + 2 + 4 + 1 + 2*3},
+	} {
+		drv := elev.NewMock(elev.DefaultFloors)
+		e := newTestElevator(t, drv)
+		e.costFn = tc.costFn
+		e.state = idle
+
+		// A stop at floor 1 on the way to floor 3.
+		e.dest[1] = true
+		e.destBuffer[1] = true
+		if cost := e.SimulateCost(Request{Floor: 3, Direction: elev.Down}); cost != tc.want {
+			t.Errorf("%T: cost = %v, want %v", tc.costFn, cost, tc.want)
+		}
+		if u := tc.costFn.Unavailable(); u <= tc.want {
+			t.Errorf("%T: unavailable cost %v beats a real cost", tc.costFn, u)
+		}
+	}
+}
+
+func TestDriverError(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+
+	drv.SetError(errors.New("disconnected"))
+	start(e)
+	if e.err == nil {
+		t.Fatal("driver error not recorded")
+	}
+
+	drv.SetError(nil)
+	fault(e)
+	if e.err != nil || !e.IsRunning() {
+		t.Errorf("elevator still faulty after the driver came back")
+	}
+}
+
+func TestSimulateCostSixFloors(t *testing.T) {
+	drv := elev.NewMock(6)
+	e := newTestElevator(t, drv)
+	e.state = idle
+
+	if cost := e.SimulateCost(Request{Floor: 5, Direction: elev.Down}); cost != 15 {
+		t.Errorf("cost = %v, want 15", cost)
+	}
+	if cost := e.SimulateCost(Request{Floor: 6, Direction: elev.Down}); !math.IsInf(cost, 1) {
+		t.Errorf("cost for missing floor = %v, want +Inf", cost)
+	}
+}
+
+func TestDestinationCall(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.state = idle
+	req := msgdata.NewDestRequest(1, 3)
+
+	// One floor to the pickup, a door cycle, and two floors to the
+	// destination.
+	if cost := e.SimulateCost(req); cost != 3+4+2*3 {
+		t.Errorf("cost = %v, want 13", cost)
+	}
+
+	e.AddRequest(req)
+	if got := e.TakeHallRequests(); !reflect.DeepEqual(got, []Request{req}) {
+		t.Errorf("TakeHallRequests = %v, want %v", got, []Request{req})
+	}
+
+	// The destination becomes a stop when the car picks the
+	// passenger up.
+	e.AddRequest(req)
+	e.floor = 1
+	e.clearRequest(1, elev.Up)
+	if !e.destBuffer[3] || drv.Lamp(elev.Command, 3) != 1 {
+		t.Error("destination is not a stop after the pickup")
+	}
+	if e.pickups[1][3] {
+		t.Error("pickup not cleared")
+	}
+}
+
+func TestEmergencyStop(t *testing.T) {
+	drv := newOutputDriver(elev.DefaultFloors)
+	drv.SetFloor(-1)
+	e := newTestElevator(t, drv)
+	e.AddRequest(Request{Floor: 2, Direction: elev.Up})
+	e.destBuffer[3] = true
+	startElevator(t, e)
+	waitMotor(t, drv, elev.Down)
+
+	// The car is between floors, looking for one, when the stop
+	// button is pressed. The checks run on the elevator goroutine, so
+	// they see the car once it is halted.
+	drv.SetStop(1)
+	waitMotor(t, drv, elev.Stop)
+	waitRunning(t, e, false)
+	if drv.StopLamp() != 1 {
+		t.Errorf("stop lamp = %d, want lit", drv.StopLamp())
+	}
+	var cancelled bool
+	e.do(func() { cancelled = !e.destBuffer[3] })
+	if !cancelled {
+		t.Error("cab destination not cancelled")
+	}
+	if reqs := e.TakeHallRequests(); len(reqs) != 1 || reqs[0].Floor != 2 {
+		t.Errorf("hall requests = %v, want the request at floor 2", reqs)
+	}
+
+	// A second press resets, and the car looks for a floor again.
+	drv.SetStop(0)
+	waitScans(t, drv, 5)
+	drv.SetStop(1)
+	waitMotor(t, drv, elev.Down)
+	if drv.StopLamp() != 0 || !e.IsRunning() {
+		t.Error("elevator not running after reset")
+	}
+}
+
+func TestDoorObstruction(t *testing.T) {
+	defer func(s Settings) { settings = s }(settings)
+	settings = Settings{
+		DoorOpenTime:  50 * time.Millisecond,
+		DoorMoveTime:  10 * time.Millisecond,
+		DoorHoldTime:  50 * time.Millisecond,
+		DoorFaultTime: 300 * time.Millisecond,
+	}
+
+	drv := newOutputDriver(elev.DefaultFloors)
+	drv.SetFloor(1)
+	e := newTestElevator(t, drv)
+	e.floor = 1
+	obstruction := e.scanner.Subscribe(elev.ObstructionChanged)
+	drv.SetObstruction(1)
+	select {
+	case <-obstruction:
+	case <-time.After(time.Second):
+		t.Fatal("obstruction not seen by the scanner")
+	}
+
+	// The doors are held open while obstructed, and the car gives up
+	// its hall calls after the fault time.
+	done := make(chan stateFn)
+	go func() { done <- doorOpening(e)(e) }()
+	next := waitState(t, done, "the door fault")
+	for len(drv.door) > 0 {
+		if <-drv.door != 1 {
+			t.Fatal("doors not held open by obstruction")
+		}
+	}
+	if drv.DoorOpenLamp() != 1 || !e.IsRunning() {
+		t.Fatal("doors not held open by obstruction")
+	}
+	go func() { done <- next(e) }()
+	waitRunning(t, e, false)
+
+	// The doors close when the obstruction is gone.
+	drv.SetObstruction(0)
+	next = waitState(t, done, "the door fault to clear")
+	if !e.IsRunning() {
+		t.Error("elevator not running after door fault")
+	}
+	next(e)
+	if drv.DoorOpenLamp() != 0 {
+		t.Error("doors not closed")
+	}
+}
+
+func TestMotorStall(t *testing.T) {
+	defer func(s Settings) { settings = s }(settings)
+	settings.MotorStallTime = 100 * time.Millisecond
+	settings.FaultHandoverTime = 200 * time.Millisecond
+
+	drv := newOutputDriver(elev.DefaultFloors)
+	drv.SetFloor(1)
+	e := newTestElevator(t, drv)
+	e.floor = 1
+	e.direction = elev.Up
+	left := e.scanner.Subscribe(elev.FloorLeft)
+	drv.SetFloor(-1)
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("floor 1 not left")
+	}
+
+	// The car left floor 1 but never reaches floor 2. The states run
+	// until the fault is cleared.
+	done := make(chan stateFn)
+	go func() {
+		next := moving(e)
+		for e.fault != nil {
+			next = next(e)
+		}
+		done <- next
+	}()
+	waitFault(t, e, MotorStall, FaultDetected)
+
+	// The car is driven back to floor 1.
+	waitFault(t, e, MotorStall, FaultReversing)
+	waitMotor(t, drv, elev.Down)
+
+	// The reverse fails too, and the hall calls are handed over.
+	waitFault(t, e, MotorStall, FaultHandedOver)
+	if e.IsRunning() {
+		t.Error("elevator running after handover time")
+	}
+
+	drv.SetFloor(0)
+	waitState(t, done, "the fault to clear")
+	if e.fault != nil || e.floor != 0 || !e.IsRunning() {
+		t.Errorf("fault = %v, floor = %d, want cleared at floor 0", e.fault, e.floor)
+	}
+}
+
+// waitFault waits for a fault event of type ft with action a.
+func waitFault(t *testing.T, e *Elevator, ft FaultType, a FaultAction) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case fe := <-e.Faults:
+			if fe.Fault.Type == ft && fe.Action == a {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v %v", ft, a)
+		}
+	}
+}
+
+func TestStopDuringRecovery(t *testing.T) {
+	defer func(s Settings) { settings = s }(settings)
+	settings.MotorStallTime = time.Second
+	settings.FaultHandoverTime = time.Hour
+
+	drv := newOutputDriver(elev.DefaultFloors)
+	drv.SetFloor(1)
+	e := newTestElevator(t, drv)
+	events := make(chan elev.Event, 1)
+	e.events = events
+	e.floor = 1
+	e.fault = &Fault{Type: FloorSequence, Floor: 1, Sensor: -1, Since: time.Now()}
+
+	// The stop button is pressed while the car is re-homing.
+	done := make(chan stateFn)
+	go func() { done <- recovering(e) }()
+	waitMotor(t, drv, elev.Down)
+	events <- elev.Event{Type: elev.StopPressed}
+	next := waitState(t, done, "the emergency stop")
+	if e.fault != nil || e.faultTries != 0 {
+		t.Errorf("fault = %v after %d tries, want cleared", e.fault, e.faultTries)
+	}
+
+	// Once the stop is reset, the car bids for hall calls again.
+	go func() { done <- next(e) }()
+	events <- elev.Event{Type: elev.StopPressed}
+	waitState(t, done, "the stop to be reset")
+	e.state = idle
+	req := Request{Floor: 3, Direction: elev.Down}
+	if cost := e.SimulateCost(req); cost == e.costFn.Unavailable() {
+		t.Error("car still unavailable after the stop was reset")
+	}
+	if _, ok := e.ETA(req); !ok || !e.IsRunning() {
+		t.Error("car not running after the stop was reset")
+	}
+}
+
+func TestFloorSequence(t *testing.T) {
+	for _, tc := range []struct {
+		floor int
+		fault FaultType
+	}{
+		{3, FloorSequence},
+		{7, SensorRange},
+	} {
+		drv := elev.NewMock(elev.DefaultFloors)
+		drv.SetFloor(1)
+		e := newTestElevator(t, drv)
+		e.floor = 1
+		e.direction = elev.Up
+		drv.SetMotorDirection(elev.Up)
+
+		done := make(chan stateFn)
+		go func() { done <- moving(e) }()
+		drv.SetFloor(-1)
+		time.Sleep(50 * time.Millisecond)
+		drv.SetFloor(tc.floor)
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("floor %d: no fault", tc.floor)
+		}
+		if e.fault == nil || e.fault.Type != tc.fault {
+			t.Errorf("floor %d: fault = %v, want %v", tc.floor, e.fault, tc.fault)
+		}
+		if drv.Motor() != elev.Stop {
+			t.Errorf("floor %d: motor = %d, want stopped", tc.floor, drv.Motor())
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the recorder
+// while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestReplay(t *testing.T) {
+	s := settings
+	t.Cleanup(func() { settings = s })
+	settings.DoorOpenTime = 200 * time.Millisecond
+	settings.DoorMoveTime = 50 * time.Millisecond
+
+	// Record a trip from floor 0 to floor 2. Each input is held for a
+	// few scans after the car has seen it, so the replay, which reads
+	// it at other times, sees it for long enough too.
+	const hold = 5
+	var log syncBuffer
+	drv := newOutputDriver(elev.DefaultFloors)
+	rec := elev.NewRecorder(drv, &log)
+	rec.Init()
+	e := newTestElevator(t, rec)
+	moves := e.scanner.Subscribe(elev.FloorReached, elev.FloorLeft)
+	e.panel.Start()
+	startElevator(t, e)
+
+	drv.Press(elev.Command, 2, 1)
+	waitMotor(t, drv, elev.Up)
+	waitScans(t, drv, hold)
+	drv.Press(elev.Command, 2, 0)
+	waitScans(t, drv, hold)
+	for _, floor := range []int{-1, 1, -1, 2} {
+		drv.SetFloor(floor)
+		select {
+		case <-moves:
+		case <-time.After(time.Second):
+			t.Fatalf("floor %d not seen:\n%s", floor, log.String())
+		}
+		waitScans(t, drv, hold)
+	}
+	waitMotor(t, drv, elev.Stop)
+	waitDoorLamp(t, drv, 1)
+	waitDoorLamp(t, drv, 0)
+
+	// Play it back to a new elevator. When the replay is done, the
+	// car still has to catch up with the last inputs.
+	rp, err := elev.NewReplay(strings.NewReader(log.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.Init()
+	e = newTestElevator(t, rp)
+	e.panel.Start()
+	startElevator(t, e)
+
+	select {
+	case <-rp.Done():
+	case <-time.After(rp.Length() + time.Second):
+		t.Fatal("replay not done")
+	}
+	for deadline := time.Now().Add(2 * time.Second); rp.Check() != nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v\nrecording:\n%s", rp.Check(), log.String())
+		}
+		time.Sleep(doorPollInterval)
+	}
+}
+
+func TestETA(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.state = idle
+	e.times = &tripTimes{
+		travel: []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second},
+		start:  time.Second,
+		door:   4 * time.Second,
+	}
+
+	if eta, ok := e.ETA(Request{Floor: 2, Direction: elev.Down}); !ok || eta != 5*time.Second {
+		t.Errorf("ETA = %v, %v, want 5s", eta, ok)
+	}
+
+	// A move from a stop adds to the start time, other moves to the
+	// travel time of the floor.
+	e.times.addMove(0, elev.Up, 4*time.Second, true)
+	e.times.addMove(1, elev.Up, 3*time.Second, false)
+	if e.times.start != 1125*time.Millisecond || e.times.travel[1] != 2125*time.Millisecond {
+		t.Errorf("start = %v, travel = %v", e.times.start, e.times.travel)
+	}
+
+	// The times survive a backup.
+	bd := msgdata.NewBackupData(elev.DefaultFloors)
+	e.times.save(bd)
+	times := newTripTimes(elev.DefaultFloors)
+	times.load(bd)
+	if !reflect.DeepEqual(times.travel, e.times.travel) || times.start != e.times.start {
+		t.Errorf("loaded %+v, want %+v", times, e.times)
+	}
+
+	var buf bytes.Buffer
+	writeETA(&buf, "car", e)
+	if !strings.Contains(buf.String(), `{"floor":2,"direction":"down","assigned":false,"eta":5.25}`) {
+		t.Errorf("eta = %s", buf.String())
+	}
+
+	e.setStopped(true)
+	if _, ok := e.ETA(Request{Floor: 2, Direction: elev.Down}); ok {
+		t.Error("ETA of a stopped car")
+	}
+}
+
+// TestETAWhileMoving reads the ETAs and costs while the car runs. Run
+// it with -race, since the handler and the car are different
+// goroutines.
+func TestETAWhileMoving(t *testing.T) {
+	drv := newOutputDriver(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	reached := e.scanner.Subscribe(elev.FloorReached)
+	e.AddRequest(Request{Floor: 2, Direction: elev.Down})
+	startElevator(t, e)
+	waitMotor(t, drv, elev.Up)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for {
+			var buf bytes.Buffer
+			writeETA(&buf, "car", e)
+			e.SimulateCost(Request{Floor: 0, Direction: elev.Up})
+			var out struct{ Floor int }
+			if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+				done <- err
+				return
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+		}
+	}()
+
+	for _, floor := range []int{-1, 1, -1, 2} {
+		drv.SetFloor(floor)
+		if floor == -1 {
+			continue
+		}
+		select {
+		case <-reached:
+		case <-time.After(time.Second):
+			t.Fatalf("floor %d not reached", floor)
+		}
+	}
+	waitMotor(t, drv, elev.Stop)
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeETA(&buf, "car", e)
+	if !strings.Contains(buf.String(), `"floor":2,"running":true`) {
+		t.Errorf("eta = %s", buf.String())
+	}
+}
+
+func TestAuctions(t *testing.T) {
+	as := NewAuctions(NewTraffic(4))
+	req := Request{Floor: 2, Direction: elev.Up}
+	ids := make(map[uint32]bool)
+	for i := 0; i < maxAuctions; i++ {
+		id := as.Start(req, 0)
+		if id == 0 || ids[id] {
+			t.Fatalf("auction %d got ID %v", i, id)
+		}
+		ids[id] = true
+	}
+	if !as.Full() {
+		t.Error("table not full")
+	}
+
+	as.Lead(req)
+	if got := as.Expired(time.Now()); len(got) != 0 {
+		t.Errorf("%d auctions expired at once", len(got))
+	}
+	if got := as.Expired(time.Now().Add(2 * auctionTimeout)); len(got) != maxAuctions {
+		t.Errorf("%d auctions expired, want %d", len(got), maxAuctions)
+	}
+	if as.Full() || len(as.Leading()) != 0 {
+		t.Error("expired auctions left in the table")
+	}
+
+	// A request the elevator is leading on makes its next bids higher.
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.state = idle
+	down := Request{Floor: 3, Direction: elev.Down}
+	if e.SimulateCost(down, req) <= e.SimulateCost(down) {
+		t.Error("pending request does not add to the cost")
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	up := Request{Floor: 1, Direction: elev.Up}
+	k1, k2 := msgdata.NewDestRequest(2, 0), msgdata.NewDestRequest(2, 1)
+	e.AddRequest(up)
+	e.AddRequest(k1)
+	e.AddRequest(k2)
+
+	if got := e.OldHallRequests(time.Hour); got != nil {
+		t.Errorf("OldHallRequests(1h) = %v, want none", got)
+	}
+	time.Sleep(time.Millisecond)
+	if got := e.OldHallRequests(0); len(got) != 3 {
+		t.Errorf("OldHallRequests(0) = %v, want 3 requests", got)
+	}
+
+	// The hall call at floor 2 stays until both passengers are given up.
+	if !e.GiveUp(k1) || !e.requestsBuffer[2][indexOfDir(elev.Down)] {
+		t.Error("hall call removed with a passenger left")
+	}
+	if e.GiveUp(Request{Floor: 2, Direction: elev.Down}) {
+		t.Error("gave up a keypad call as a button call")
+	}
+	if !e.GiveUp(k2) || e.requestsBuffer[2][indexOfDir(elev.Down)] {
+		t.Error("hall call left after the last passenger")
+	}
+
+	// A served call can not be given up.
+	e.clearRequest(1, elev.Up)
+	if e.GiveUp(up) {
+		t.Error("gave up a served call")
+	}
+}
+
+// TestGiveUpWhileRunning gives up calls of a running car. A call is
+// either given up or served, never both.
+func TestGiveUpWhileRunning(t *testing.T) {
+	drv := newOutputDriver(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	reached := e.scanner.Subscribe(elev.FloorReached)
+	down := Request{Floor: 2, Direction: elev.Down}
+	e.AddRequest(down)
+	startElevator(t, e)
+	waitMotor(t, drv, elev.Up)
+
+	if got := e.HallRequests(down.Floor, down.Direction); !reflect.DeepEqual(got, []Request{down}) {
+		t.Errorf("HallRequests = %v, want %v", got, []Request{down})
+	}
+
+	// Given up on the way, the car stops at the next floor without
+	// serving it.
+	if !e.GiveUp(down) {
+		t.Fatal("call not given up while moving")
+	}
+	drv.SetFloor(-1)
+	drv.SetFloor(1)
+	select {
+	case <-reached:
+	case <-time.After(time.Second):
+		t.Fatal("floor 1 not reached")
+	}
+	waitMotor(t, drv, elev.Stop)
+	if got := e.OldHallRequests(0); got != nil {
+		t.Errorf("OldHallRequests = %v after giving up", got)
+	}
+
+	// Once served, a call can not be given up.
+	up := Request{Floor: 1, Direction: elev.Up}
+	e.AddRequest(up)
+	select {
+	case r := <-e.Served:
+		if r != up {
+			t.Fatalf("served %v, want %v", r, up)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call at the floor of the car not served")
+	}
+	if e.GiveUp(up) {
+		t.Error("gave up a served call")
+	}
+}
+
+func TestHallCallDeadline(t *testing.T) {
+	hc := NewHallCalls()
+	var x, y network.Addr
+	x[15], y[15] = 1, 2
+	members := map[network.Addr]network.Meta{x: {}, y: {}}
+	now := time.Now()
+
+	// A call given to x, which dies before it sends a backup.
+	req := Request{Floor: 2, Direction: elev.Up}
+	hc.Assigned(req, x)
+	hc.check(now)
+	hc.check(now.Add(settings.CallDeadline + time.Second))
+	select {
+	case b := <-hc.Breaches:
+		if b.Req != req || b.Holder != x || !b.Mine {
+			t.Errorf("breach = %+v", b)
+		}
+	default:
+		t.Fatal("no breach")
+	}
+	hc.check(now.Add(settings.CallDeadline + 2*time.Second))
+	if len(hc.Breaches) != 0 {
+		t.Error("breach raised twice in one deadline")
+	}
+
+	// A call in the backup of y is served when it leaves the backup.
+	bd := msgdata.NewBackupData(elev.DefaultFloors)
+	bd.Elevator = y
+	bd.Requests[3][indexOfDir(elev.Down)] = true
+	backups := map[network.Addr]*msgdata.BackupData{y: bd}
+	hc.Update(bd, backups, members)
+	served := msgdata.NewBackupData(elev.DefaultFloors)
+	served.Elevator = y
+	backups[y] = served
+	hc.Update(served, backups, members)
+
+	down := Request{Floor: 3, Direction: elev.Down}
+	hc.calls[down].gone = now.Add(-2 * callGrace)
+	hc.Update(served, backups, members)
+	if _, ok := hc.calls[down]; ok {
+		t.Error("served call still tracked")
+	}
+	if _, ok := hc.calls[req]; !ok {
+		t.Error("call without a backup dropped")
+	}
+}
+
+func TestParking(t *testing.T) {
+	var x, y network.Addr
+	x[15], y[15] = 1, 2
+	now := time.Now()
+
+	// Only one car parks at the lobby, the one closest to it.
+	pk := NewParking("lobby", 6)
+	if got := pk.choose(x, 3, pk.lobby(2), now); got != 0 {
+		t.Errorf("lobby = %d, want 0", got)
+	}
+	pk.Claim(&msgdata.ParkData{Elevator: y, Floor: 0, From: 4}, now)
+	if got := pk.choose(x, 3, pk.lobby(2), now); got != 0 {
+		t.Errorf("lobby with a farther claim = %d, want 0", got)
+	}
+	pk.Claim(&msgdata.ParkData{Elevator: y, Floor: 0, From: 1}, now)
+	if got := pk.choose(x, 3, pk.lobby(2), now); got != -1 {
+		t.Errorf("lobby with a closer claim = %d, want -1", got)
+	}
+	if got := pk.choose(x, 3, pk.lobby(2), now.Add(2*parkClaimTime)); got != 0 {
+		t.Errorf("lobby with an old claim = %d, want 0", got)
+	}
+
+	// The cars spread out over the zones.
+	pk = NewParking("zones", 6)
+	if got := pk.zones(2); !reflect.DeepEqual(got, []int{1, 4}) {
+		t.Errorf("zones = %v, want [1 4]", got)
+	}
+	pk.Claim(&msgdata.ParkData{Elevator: y, Floor: 4, From: 4}, now)
+	if got := pk.choose(x, 5, pk.zones(2), now); got != 1 {
+		t.Errorf("zone = %d, want 1", got)
+	}
+
+	// The busiest floor is the best guess for the next call.
+	pk = NewParking("predict", 6)
+	up3 := Request{Floor: 3, Direction: elev.Up}
+	down5 := Request{Floor: 5, Direction: elev.Down}
+	pk.Observe([]Request{up3, down5}, now)
+	pk.Observe([]Request{down5}, now)
+	pk.Observe([]Request{up3, down5}, now)
+	if got := pk.predict(1); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("predict = %v, want [3]", got)
+	}
+
+	// An idle car goes to its parking floor.
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.floor = 1
+	e.Park(3)
+	e.park = e.parkBuffer
+	e.idleSince = now.Add(-settings.ParkDelay - time.Second)
+	if _, idle := e.Idle(); !idle {
+		t.Error("car is not idle")
+	}
+	if e.goPark() == nil || drv.Motor() != elev.Up {
+		t.Error("car did not go to park")
+	}
+
+	// The same, with the car running.
+	s := settings
+	t.Cleanup(func() { settings = s })
+	settings.ParkDelay = 50 * time.Millisecond
+	out := newOutputDriver(elev.DefaultFloors)
+	e = newTestElevator(t, out)
+	startElevator(t, e)
+	for deadline := time.Now().Add(time.Second); ; {
+		if floor, idle := e.Idle(); idle && floor == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("running car is not idle")
+		}
+		time.Sleep(doorPollInterval)
+	}
+	e.Park(2)
+	waitMotor(t, out, elev.Up)
+	if floor, idle := e.Idle(); !idle || floor != 0 {
+		t.Errorf("Idle = %d, %v while parking, want 0, true", floor, idle)
+	}
+}
+
+func TestTraffic(t *testing.T) {
+	defer func(s Settings) { settings = s }(settings)
+
+	if _, err := parseSchedule("07:30-09:30 up-peak, 16:00 down-peak"); err == nil {
+		t.Error("schedule without an end time parsed")
+	}
+	schedule, err := parseSchedule("07:30-09:30 up-peak, 22:00-01:00 down-peak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTraffic(6)
+	tr.schedule = schedule
+	day := time.Date(2020, 1, 6, 0, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		at   time.Duration
+		want TrafficMode
+	}{
+		{8 * time.Hour, UpPeak},
+		{9*time.Hour + 30*time.Minute, InterFloor},
+		{23 * time.Hour, DownPeak},
+		{30 * time.Minute, DownPeak},
+		{12 * time.Hour, InterFloor},
+	} {
+		if got := tr.detect(day.Add(tc.at)); got != tc.want {
+			t.Errorf("mode at %v = %v, want %v", tc.at, got, tc.want)
+		}
+	}
+
+	// Most calls going up from the lobby are up-peak traffic, once
+	// there are enough of them.
+	settings.Traffic = "auto"
+	settings.LobbyFloor = 0
+	tr = NewTraffic(6)
+	now := time.Now()
+	up0 := Request{Floor: 0, Direction: elev.Up}
+	for i := 0; i < trafficMinCalls-1; i++ {
+		tr.ObserveHallCalls([]Request{up0}, now)
+		tr.ObserveHallCalls(nil, now)
+	}
+	if got := tr.detect(now); got != InterFloor {
+		t.Errorf("mode with too few calls = %v, want %v", got, InterFloor)
+	}
+	tr.ObserveBackup(nil, &msgdata.BackupData{Floor: 0, Dest: []bool{false, false, true}}, now)
+	if got := tr.detect(now); got != UpPeak {
+		t.Errorf("mode = %v, want %v", got, UpPeak)
+	}
+	if got := tr.detect(now.Add(2 * trafficWindow)); got != InterFloor {
+		t.Errorf("mode after the window = %v, want %v", got, InterFloor)
+	}
+
+	// In up-peak every car parks at the lobby.
+	var x, y network.Addr
+	x[15], y[15] = 1, 2
+	pk := NewParking("", 6)
+	pk.Claim(&msgdata.ParkData{Elevator: y, Floor: 0, From: 1}, now)
+	if got := pk.choose(x, 3, pk.policyFor(UpPeak)(pk, 2), now); got != 0 {
+		t.Errorf("up-peak parking = %d, want 0", got)
+	}
+	if got := pk.policyFor(DownPeak)(pk, 2); !reflect.DeepEqual(got, []int{2, 4}) {
+		t.Errorf("down-peak parking = %v, want [2 4]", got)
+	}
+
+	// In down-peak, a car with a down call bids more for calls that
+	// would delay it.
+	drv := elev.NewMock(elev.DefaultFloors)
+	e := newTestElevator(t, drv)
+	e.state = idle
+	e.floor = 0
+	e.AddRequest(Request{Floor: 3, Direction: elev.Down})
+	copy(e.requests, e.requestsBuffer)
+	time.Sleep(time.Millisecond)
+	up1 := Request{Floor: 1, Direction: elev.Up}
+	tr.mode = DownPeak
+	if tr.Cost(e, up1) <= e.SimulateCost(up1) {
+		t.Error("down-peak does not weight the down call")
+	}
+	tr.mode = InterFloor
+	if tr.Cost(e, up1) != e.SimulateCost(up1) {
+		t.Error("inter-floor weights the calls")
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	file := t.TempDir() + "/backup-0"
+	wd := &WatchdogHandler{file: file}
+	if bd, err := wd.start(); err != nil || bd.Floors() != 0 {
+		t.Fatalf("start without a file = %v, %v, want an empty backup", bd, err)
+	}
+
+	bd := msgdata.NewBackupData(elev.DefaultFloors)
+	bd.Floor = 2
+	bd.Dest[3] = true
+	if err := wd.writeBackup(bd); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted car picks up the backup.
+	got, err := (&WatchdogHandler{file: file}).start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Floor != 2 || !reflect.DeepEqual(got.Dest, bd.Dest) {
+		t.Errorf("backup read back as %v, want %v", got, bd)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"elevator-project/pkg/elev"
+)
+
+// Faults can be sent this far ahead of the reader before they are
+// dropped.
+const faultBuffer = 16
+
+type FaultType int
+
+const (
+	// The car did not reach a floor in time while the motor was on.
+	MotorStall FaultType = iota
+
+	// The car reached a floor that is not next to the last one.
+	FloorSequence
+
+	// The floor sensor reported a floor the elevator does not have.
+	SensorRange
+)
+
+func (t FaultType) String() string {
+	switch t {
+	case MotorStall:
+		return "motor stall"
+	case FloorSequence:
+		return "unexpected floor"
+	case SensorRange:
+		return "floor sensor out of range"
+	}
+	return fmt.Sprintf("fault(%d)", int(t))
+}
+
+// FaultAction is what the elevator does about a fault.
+type FaultAction int
+
+const (
+	FaultDetected FaultAction = iota
+
+	// Driving back towards the last floor.
+	FaultReversing
+
+	// Starting the motor again, when the car never left the floor.
+	FaultRestarting
+
+	// Driving down to the bottom floor to find the position again.
+	FaultRehoming
+
+	// The fault lasted too long, and the hall requests were given to
+	// the other elevators.
+	FaultHandedOver
+
+	FaultCleared
+)
+
+func (a FaultAction) String() string {
+	switch a {
+	case FaultDetected:
+		return "detected"
+	case FaultReversing:
+		return "reversing"
+	case FaultRestarting:
+		return "restarting"
+	case FaultRehoming:
+		return "re-homing"
+	case FaultHandedOver:
+		return "handed over"
+	case FaultCleared:
+		return "cleared"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// Fault describes a fault in the motor or the floor sensor.
+type Fault struct {
+	Type   FaultType
+	Floor  int // last known floor
+	Sensor int // floor sensor reading, for FloorSequence and SensorRange
+	Since  time.Time
+}
+
+// FaultEvent is sent on Elevator.Faults when a fault is detected,
+// handled or cleared.
+type FaultEvent struct {
+	Fault  Fault
+	Action FaultAction
+	Time   time.Time
+}
+
+func (fe FaultEvent) String() string {
+	s := fmt.Sprintf("%v %v after floor %d", fe.Fault.Type, fe.Action, fe.Fault.Floor)
+	if fe.Fault.Type != MotorStall {
+		s += fmt.Sprintf(" (sensor %d)", fe.Fault.Sensor)
+	}
+	return s
+}
+
+// checkFloor returns a fault if the floor sensor reading does not fit
+// the position of the car, or nil if it does.
+func (e *Elevator) checkFloor(floor int) *Fault {
+	f := &Fault{Floor: e.floor, Sensor: floor, Since: time.Now()}
+	switch {
+	case floor < 0 || floor >= e.floors:
+		f.Type = SensorRange
+	case !e.lost && floor != e.floor+int(e.direction):
+		f.Type = FloorSequence
+	default:
+		return nil
+	}
+	return f
+}
+
+// detectFault records a new fault and returns the state that handles
+// it.
+func (e *Elevator) detectFault(f *Fault) stateFn {
+	e.fault = f
+	e.faultTries = 0
+	e.setMotor(elev.Stop)
+	e.sendFault(FaultDetected)
+	return recovering
+}
+
+// recovering tries to get the car to a known floor after a fault. A
+// stalled car is first driven back towards the floor it left, or if it
+// never left the floor, the motor is started again. If that fails, or
+// the position is not known, the car is re-homed by driving it down to
+// the bottom floor. Re-homing is retried until it works. If the fault
+// lasts longer than the handover time, the elevator reports itself as
+// stopped, so its hall requests are given to the other elevators.
+func recovering(e *Elevator) stateFn {
+	if e.simulate {
+		return nil
+	}
+
+	e.faultTries++
+	dir, action := elev.Down, FaultRehoming
+	if e.fault.Type == MotorStall && e.direction != elev.Stop {
+		if e.scanner.Floor() == e.floor {
+			dir, action = e.direction, FaultRestarting
+		} else if e.faultTries == 1 {
+			dir, action = -e.direction, FaultReversing
+		}
+	}
+	e.sendFault(action)
+
+	// At the bottom floor there is nothing below to re-home to.
+	if action == FaultRehoming && e.scanner.Floor() == 0 {
+		return e.recovered(0)
+	}
+
+	e.setMotor(dir)
+	stall := time.NewTimer(settings.MotorStallTime)
+	defer stall.Stop()
+	ticker := time.NewTicker(faultRetryInterval)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case ev := <-e.events:
+			if ev.Type != elev.FloorReached {
+				if next := interrupt(e, ev); next != nil {
+					e.setMotor(elev.Stop)
+					e.dropFault()
+					return next
+				}
+				break
+			}
+			if ev.Floor < 0 || ev.Floor >= e.floors {
+				break
+			}
+			if action != FaultRehoming || ev.Floor == 0 {
+				e.setMotor(elev.Stop)
+				return e.recovered(ev.Floor)
+			}
+			// Passing a floor while re-homing shows the motor works.
+			stall.Reset(settings.MotorStallTime)
+
+		case <-stall.C:
+			e.setMotor(elev.Stop)
+			e.handOver()
+			retry = time.After(faultRetryInterval)
+
+		case <-retry:
+			return recovering
+
+		case f := <-e.calls:
+			f()
+
+		case <-ticker.C:
+			e.handOver()
+		}
+	}
+}
+
+// handOver reports the elevator as stopped if the fault has lasted
+// longer than the handover time.
+func (e *Elevator) handOver() {
+	if !e.IsRunning() || time.Since(e.fault.Since) < settings.FaultHandoverTime {
+		return
+	}
+	e.setStopped(true)
+	e.sendFault(FaultHandedOver)
+}
+
+// recovered clears the fault when the car has stopped at floor.
+func (e *Elevator) recovered(floor int) stateFn {
+	e.floor = floor
+	e.lost = false
+	e.direction = elev.Stop
+	e.sendFault(FaultCleared)
+	e.fault = nil
+	e.setStopped(false)
+	return start
+}
+
+// dropFault clears the fault when the recovery is cut short by the stop
+// button or a driver error. The state that takes over goes on to start,
+// which finds the position of the car again.
+func (e *Elevator) dropFault() {
+	e.direction = elev.Stop
+	e.sendFault(FaultCleared)
+	e.fault = nil
+	e.faultTries = 0
+}
+
+// sendFault sends a fault event without blocking.
+func (e *Elevator) sendFault(a FaultAction) {
+	select {
+	case e.Faults <- FaultEvent{Fault: *e.fault, Action: a, Time: time.Now()}:
+	default:
+	}
+}
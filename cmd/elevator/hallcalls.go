@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+const (
+	// The hall calls are checked against the deadline this often.
+	callPollInterval = time.Second
+
+	// A call that leaves every backup is taken as served after
+	// callGrace, so a call moving between two cars keeps its age.
+	callGrace = 2 * time.Second
+
+	breachBuffer = 16
+)
+
+// HallCalls tracks the hall calls of all the elevators on the ring, and
+// how long they have waited. The calls are learned from the backups,
+// and from the auctions of this elevator, so a call is tracked even if
+// the car it was given to dies before it sends a backup. A call that is
+// not served within settings.CallDeadline raises a Breach.
+type HallCalls struct {
+	// Breaches reports the calls that missed the deadline. Breaches are
+	// dropped if nobody reads them.
+	Breaches chan Breach
+
+	mu    sync.Mutex
+	calls map[Request]*hallCall // by floor and direction
+}
+
+type hallCall struct {
+	since     time.Time
+	assigned  time.Time // by this elevator
+	escalated time.Time // last breach
+	gone      time.Time // left every backup
+	holder    network.Addr
+	mine      bool // auctioned by this elevator
+	backedUp  bool // seen in a backup
+}
+
+// Breach is a hall call that has not been served in time.
+type Breach struct {
+	Req    Request
+	Holder network.Addr // the car that has the call
+	Mine   bool         // the call was auctioned by this elevator
+	Waited time.Duration
+}
+
+func (b Breach) String() string {
+	return fmt.Sprintf("%v has waited %v for %v", b.Req, b.Waited.Round(time.Second), b.Holder)
+}
+
+func NewHallCalls() *HallCalls {
+	return &HallCalls{
+		Breaches: make(chan Breach, breachBuffer),
+		calls:    make(map[Request]*hallCall),
+	}
+}
+
+func (hc *HallCalls) Start() {
+	go hc.watch()
+}
+
+// hallCallOf returns the hall call of req, without the destination of a
+// keypad call.
+func hallCallOf(req Request) Request {
+	return Request{Floor: req.Floor, Direction: req.Direction}
+}
+
+// Assigned records that this elevator gave req to the car at holder.
+func (hc *HallCalls) Assigned(req Request, holder network.Addr) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	now := time.Now()
+	c := hc.get(hallCallOf(req), now)
+	c.holder = holder
+	c.assigned = now
+	c.mine = true
+}
+
+// Update brings the calls up to date with a new backup, and the backups
+// of all the members of the ring. Backups of elevators that have left
+// the ring are ignored.
+func (hc *HallCalls) Update(bd *msgdata.BackupData, backups map[network.Addr]*msgdata.BackupData, members map[network.Addr]network.Meta) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	// A call given to a car that has not shown up in its backups has
+	// been served already if a later backup does not have it.
+	now := time.Now()
+	for req, c := range hc.calls {
+		if !c.backedUp && c.holder == bd.Elevator && now.Sub(c.assigned) > callGrace &&
+			!requested(bd, req.Floor, req.Direction) {
+			delete(hc.calls, req)
+		}
+	}
+
+	seen := make(map[Request]bool)
+	for addr, b := range backups {
+		if _, ok := members[addr]; !ok && len(members) > 0 {
+			continue
+		}
+		for floor := 0; floor < b.Floors(); floor++ {
+			for _, dir := range []elev.Direction{elev.Down, elev.Up} {
+				if requested(b, floor, dir) {
+					req := Request{Floor: floor, Direction: dir}
+					c := hc.get(req, now)
+					c.holder = addr
+					c.backedUp = true
+					c.gone = time.Time{}
+					seen[req] = true
+				}
+			}
+		}
+	}
+
+	// A call that was in a backup and is in none now has been served,
+	// or is on its way to another car.
+	for req, c := range hc.calls {
+		if seen[req] || !c.backedUp {
+			continue
+		}
+		if c.gone.IsZero() {
+			c.gone = now
+		} else if now.Sub(c.gone) > callGrace {
+			delete(hc.calls, req)
+		}
+	}
+}
+
+func (hc *HallCalls) get(req Request, now time.Time) *hallCall {
+	c, ok := hc.calls[req]
+	if !ok {
+		c = &hallCall{since: now}
+		hc.calls[req] = c
+	}
+	return c
+}
+
+func (hc *HallCalls) watch() {
+	ticker := time.NewTicker(callPollInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		hc.check(now)
+	}
+}
+
+// check raises a Breach for each call older than the deadline. A call
+// is raised again if it is still not served a deadline later.
+func (hc *HallCalls) check(now time.Time) {
+	if settings.CallDeadline <= 0 {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	for req, c := range hc.calls {
+		last := c.since
+		if c.escalated.After(last) {
+			last = c.escalated
+		}
+		if !c.gone.IsZero() || now.Sub(last) < settings.CallDeadline {
+			continue
+		}
+		c.escalated = now
+		select {
+		case hc.Breaches <- Breach{Req: req, Holder: c.holder, Mine: c.mine, Waited: now.Sub(c.since)}:
+		default:
+		}
+	}
+}
+
+// lowestAddr returns true if this elevator has the lowest address on
+// the ring.
+func lowestAddr(node *network.Node) bool {
+	me := node.Addr()
+	for addr := range node.Members() {
+		if bytes.Compare(addr[:], me[:]) < 0 {
+			return false
+		}
+	}
+	return true
+}
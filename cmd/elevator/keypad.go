@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+// keypadTimeout is how long a keypad waits for a car to be dispatched.
+const keypadTimeout = 10 * time.Second
+
+// keypadCall is a destination call entered on a floor keypad. The name
+// of the car it is dispatched to is sent on reply.
+type keypadCall struct {
+	req   Request
+	reply chan string
+}
+
+// Keypads are the floor keypads of destination dispatch. A passenger
+// enters the destination on the keypad, and the keypad shows the car
+// the call was dispatched to. The keypads are served over HTTP:
+//
+//	POST /call?from=1&to=4   enter a call, and wait for the car
+//	GET  /dispatch           the last car dispatched from each floor
+type Keypads struct {
+	Calls chan keypadCall
+
+	mu      sync.Mutex
+	waiting map[Request][]chan string
+	shown   map[int]dispatched // by floor
+}
+
+type dispatched struct {
+	Car  string `json:"car"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+func NewKeypads() *Keypads {
+	return &Keypads{
+		Calls:   make(chan keypadCall),
+		waiting: make(map[Request][]chan string),
+		shown:   make(map[int]dispatched),
+	}
+}
+
+// Wait registers a call, so Dispatched answers it.
+func (k *Keypads) Wait(kc keypadCall) {
+	k.mu.Lock()
+	k.waiting[kc.req] = append(k.waiting[kc.req], kc.reply)
+	k.mu.Unlock()
+}
+
+// Dispatched records that req was given to car, and answers the
+// keypads waiting for it. Requests that did not come from a keypad are
+// ignored.
+func (k *Keypads) Dispatched(car string, req Request) {
+	dest, ok := req.Dest()
+	if !ok {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.shown[req.Floor] = dispatched{Car: car, From: req.Floor, To: dest}
+	for _, reply := range k.waiting[req] {
+		reply <- car // buffered
+	}
+	delete(k.waiting, req)
+}
+
+func (k *Keypads) serveCall(w http.ResponseWriter, r *http.Request, floors int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST to enter a call.", http.StatusMethodNotAllowed)
+		return
+	}
+	from, err1 := strconv.Atoi(r.FormValue("from"))
+	to, err2 := strconv.Atoi(r.FormValue("to"))
+	req := msgdata.NewDestRequest(from, to)
+	if err1 != nil || err2 != nil || !req.IsValid(floors) {
+		http.Error(w, "Invalid call.", http.StatusBadRequest)
+		return
+	}
+
+	kc := keypadCall{req: req, reply: make(chan string, 1)}
+	select {
+	case k.Calls <- kc:
+	case <-time.After(keypadTimeout):
+		http.Error(w, "Elevator is busy.", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case car := <-kc.reply:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dispatched{Car: car, From: from, To: to})
+	case <-time.After(keypadTimeout):
+		http.Error(w, "No car was dispatched.", http.StatusGatewayTimeout)
+	}
+}
+
+func (k *Keypads) serveDispatch(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	out := make([]dispatched, 0, len(k.shown))
+	for _, d := range k.shown {
+		out = append(out, d)
+	}
+	k.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].From < out[j].From })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// announceDispatch shows the car a keypad call was given to on the
+// keypads of this elevator, and sends it to the other elevators for
+// theirs.
+func announceDispatch(node *network.Node, k *Keypads, addr network.Addr, req Request) {
+	if _, ok := req.Dest(); !ok {
+		return
+	}
+	k.Dispatched(carName(node, addr), req)
+	if node.IsConnected() {
+		dd := msgdata.DispatchData{Elevator: addr, Req: req}
+		sendData(node, msgdata.DISPATCH, &dd)
+		debug.Printf("Sent dispatch message: \n\t%v\n", dd)
+	}
+}
+
+// carName returns the name of the car at addr, or its address if the
+// name is not known.
+func carName(node *network.Node, addr network.Addr) string {
+	if addr == node.Addr() {
+		return node.Meta().Name
+	}
+	if meta, ok := node.Member(addr); ok && meta.Name != "" {
+		return meta.Name
+	}
+	return addr.String()
+}
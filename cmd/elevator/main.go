@@ -1,22 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
 	"elevator-project/pkg/config"
 	"elevator-project/pkg/elev"
+	"elevator-project/pkg/hallcall"
+	"elevator-project/pkg/msgdata"
 	"elevator-project/pkg/network"
 )
 
 var (
 	noWatchdog = flag.Bool("nowatchdog", false,
 		"Set this to run without a watchdog process.")
+	cars = flag.Int("cars", 1,
+		"Number of elevator cars to run in this process. Each car uses the simulator port after the previous car's.")
+)
+
+// Version of the elevator software. It is advertised to the other
+// elevators, which warn if it differs from their own.
+const version = "1.3"
+
+// Capabilities advertised to the other elevators.
+const (
+	capDirect uint32 = 1 << iota // ASSIGN is sent with SendTo
 )
 
 var debug *log.Logger
@@ -37,7 +53,7 @@ const (
 
 // Stores backups for all connected elevators.
 type BackupHandler struct {
-	backups map[network.Addr]*backupData
+	backups map[network.Addr]*msgdata.BackupData
 	addr    network.Addr
 
 	// An empty struct is sent on this channel when the latest backup
@@ -45,54 +61,67 @@ type BackupHandler struct {
 	invalid chan struct{}
 }
 
-// Copy the elevator state into a backupData struct, and store in backup database.
-func (b *BackupHandler) create(e *Elevator) *backupData {
-	var bd = &backupData{
-		elevator:  b.addr,
-		created:   time.Now(),
-		floor:     e.floor,
-		direction: e.direction,
-		requests:  e.requestsBuffer,
-		dest:      e.destBuffer,
+// Copy the elevator state into a BackupData struct, and store in backup database.
+func (b *BackupHandler) create(e *Elevator) *msgdata.BackupData {
+	var bd = &msgdata.BackupData{
+		Elevator:  b.addr,
+		Created:   time.Now(),
+		Floor:     e.floor,
+		Direction: e.direction,
+		Requests:  append([][2]bool(nil), e.requestsBuffer...),
+		Dest:      append([]bool(nil), e.destBuffer...),
 	}
+	e.times.save(bd)
 	b.backups[b.addr] = bd
 	return bd
 }
 
 // Get the latest backup of this elevator.
-func (b *BackupHandler) get() *backupData {
+func (b *BackupHandler) get() *msgdata.BackupData {
 	return b.backups[b.addr]
 }
 
-// Store backupData struct in database.
-func (b *BackupHandler) update(bd *backupData) {
-	b.backups[bd.elevator] = bd
+// Store BackupData struct in database.
+func (b *BackupHandler) update(bd *msgdata.BackupData) {
+	b.backups[bd.Elevator] = bd
 }
 
+const backupPollInterval = 10 * time.Millisecond
+
 // Check if current elevator state differs from latest backup. Runs in a goroutine.
 func (b *BackupHandler) changed(e *Elevator) bool {
 	for {
 		backup := b.backups[b.addr]
-		if !(e.requestsBuffer == backup.requests && e.destBuffer == backup.dest) {
+		if !reflect.DeepEqual(e.requestsBuffer, backup.Requests) ||
+			!reflect.DeepEqual(e.destBuffer, backup.Dest) {
 			b.invalid <- struct{}{}
 		}
+		time.Sleep(backupPollInterval)
 	}
 }
 
 // Handles communication with the watchdog process over Unix domain sockets.
+// A car that runs with others in one process has no watchdog process,
+// and keeps its backup in file instead.
 type WatchdogHandler struct {
 	conn     *net.UnixConn
 	watchdog *net.UnixAddr
 	addr     *net.UnixAddr
 	timer    *time.Timer
+
+	file string
+	last []byte // backup last written to file
 }
 
 const watchdogResendInterval = 150 * time.Millisecond
 
 // Connects to watchdog process and loads inital backup.
-func (wd *WatchdogHandler) start() (*backupData, error) {
+func (wd *WatchdogHandler) start() (*msgdata.BackupData, error) {
 	if *noWatchdog {
-		return &backupData{}, nil
+		return &msgdata.BackupData{}, nil
+	}
+	if wd.file != "" {
+		return wd.readFile()
 	}
 
 	// unlink socket
@@ -110,25 +139,28 @@ func (wd *WatchdogHandler) start() (*backupData, error) {
 		return nil, err
 	}
 
-	buf := make([]byte, 256)
+	buf := make([]byte, msgdata.MaxBackupSize)
 	n, _, err := wd.conn.ReadFromUnix(buf)
 	if err != nil {
 		return nil, err
 	}
 
-	bd := &backupData{}
+	bd := &msgdata.BackupData{}
 	unpackData(buf[:n], bd)
 
 	return bd, nil
 }
 
-// Send backupData to watchdog process.
-func (wd *WatchdogHandler) writeBackup(bd *backupData) error {
+// Send BackupData to watchdog process.
+func (wd *WatchdogHandler) writeBackup(bd *msgdata.BackupData) error {
 	if *noWatchdog {
 		return nil
 	}
 
 	data, _ := bd.MarshalBinary()
+	if wd.file != "" {
+		return wd.writeFile(data)
+	}
 	_, err := wd.conn.WriteToUnix(data, wd.watchdog)
 	if err != nil {
 		return err
@@ -136,351 +168,247 @@ func (wd *WatchdogHandler) writeBackup(bd *backupData) error {
 	return nil
 }
 
+// Load the backup from file. A missing file gives an empty backup.
+func (wd *WatchdogHandler) readFile() (*msgdata.BackupData, error) {
+	bd := &msgdata.BackupData{}
+	data, err := os.ReadFile(wd.file)
+	if os.IsNotExist(err) {
+		return bd, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	unpackData(data, bd)
+	wd.last = data
+	return bd, nil
+}
+
+// Write the backup to file if it has changed. The file is replaced in
+// one step, so a crash never leaves half a backup.
+func (wd *WatchdogHandler) writeFile(data []byte) error {
+	// Skip the address and time when comparing, as the watchdog does.
+	if len(data) >= 32 && len(wd.last) >= 32 && bytes.Equal(data[32:], wd.last[32:]) {
+		return nil
+	}
+	tmp := wd.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, wd.file); err != nil {
+		return err
+	}
+	wd.last = data
+	return nil
+}
+
+// watchRing holds the UDP port of the ring while several cars run on a
+// loopback ring. The cars can not join the ring of other elevator
+// processes, so an error is sent on c if one of them is heard.
+func watchRing(c chan<- error) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: network.UDPPort})
+	if err != nil {
+		return fmt.Errorf("can not run several cars beside another elevator on this host: %v", err)
+	}
+	go func() {
+		var buf [1]byte
+		_, raddr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			c <- fmt.Errorf("watching the ring: %v", err)
+			return
+		}
+		c <- fmt.Errorf("elevator at %v on the ring, which cars on a loopback ring can not join", raddr.IP)
+	}()
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
-	var mode ServiceMode
-
 	// Load configuration file.
 	conf, _ := config.LoadFile("./config")
 	elev.LoadConfig(conf)
 	network.LoadConfig(conf)
+	loadSettings(conf)
 
-	// Initialize WatchdogHandler and load elevator backup.
-	watchdog := &WatchdogHandler{
-		watchdog: &net.UnixAddr{conf["watchdog.socket"], "unixgram"},
-		addr:     &net.UnixAddr{conf["watchdog.elev_socket"], "unixgram"},
-		timer:    time.NewTimer(watchdogResendInterval),
+	if _, ok := costFunctions[settings.Cost]; !ok {
+		errorlog.Printf("Unknown cost function %q.\n", settings.Cost)
+		os.Exit(1)
 	}
-	wdbackup, _ := watchdog.start()
-
-	// Initialize elavator hardware.
-	err := elev.Init()
-	if err != nil {
-		debug.Println(err)
+	if *cars < 1 {
+		debug.Println("Need at least one car.")
 		os.Exit(1)
 	}
 
-	node := network.NewNode()
-	panel := NewPanel()
-	elevator := NewElevator(panel)
-
-	// Load the backup from the watchdog process. This does nothing if
-	// wdbackup has only nil-values.
-	elevator.LoadBackup(wdbackup)
-	panel.LoadBackup(wdbackup)
-
-	// Setup channels.
-	msgsFromOther := make(<-chan *network.Message)
-	msgsFromThis := make(<-chan *network.Message)
-	deadNode := make(<-chan network.Addr)
-
-	// Setup signal handler
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, syscall.SIGINT)
-
-	// Start all threads. NOTE!! The order matters.
-	node.Start()
-	panel.Start()
-	elevator.Start()
-
-	// Start Goroutines that put all incomming messages onto channels.
-	go receiveMsgs(node, msgsFromOther)
-	go receiveMyMsgs(node, msgsFromThis)
-	go getDeadNode(node, deadNode)
-
-	// Initialize BackupHandler and store an initial backup.
-	var backup = &BackupHandler{
-		backups: make(map[network.Addr]*backupData),
-		addr:    node.Addr(),
-		invalid: make(chan struct{}),
+	// Several cars share a loopback ring. They can not be mixed with
+	// elevators on the real ring, and there is no watchdog process to
+	// restart them, so each car keeps its backup in a file.
+	var hub *network.Loopback
+	ringConflict := make(chan error, 1)
+	if *cars > 1 {
+		if err := watchRing(ringConflict); err != nil {
+			errorlog.Println(err)
+			os.Exit(1)
+		}
+		hub = network.NewLoopback()
+		debug.Printf("Running %d cars on a loopback ring.\n", *cars)
 	}
-	backup.create(elevator)
-	go backup.changed(elevator)
-
-	// Start elevator in local mode.
-	mode = Local
-
-	// Channel containing all unassigned requests.
-	unassigned := make(chan Request, 32)
 
-	// When an unassigned request is being processed, reqch is set to nil. This means
-	// we process only one request at a time.
-	reqch := unassigned
-
-	// The current unassigned request being processed.
-	var req Request
-
-	for {
-		/*
-		 * Update elevator service mode.
-		 */
-		if node.IsConnected() && elevator.IsRunning() {
-			switch mode {
-			case Local:
-				sendData(node, SYNC, &syncData{})
-			case Stopped:
-			case Online:
-			}
+	name := conf["elevator.name"]
+	if name == "" {
+		name, _ = os.Hostname()
+	}
 
-			mode = Online
-		} else if node.IsConnected() && !elevator.IsRunning() {
-			switch mode {
-			case Online:
-				restoreBackup(unassigned, backup.get())
-			case Local:
-				sendData(node, SYNC, &syncData{})
-			case Stopped:
+	all := make([]*Car, *cars)
+	for i := range all {
+		c := &Car{name: name}
+		if *cars > 1 {
+			c.name = fmt.Sprintf("%s-%d", name, i)
+			c.node = network.NewNodeWithTransport(hub.NewTransport())
+			c.watchdog = &WatchdogHandler{
+				file:  fmt.Sprintf("%s-%d", conf["watchdog.backupfile"], i),
+				timer: time.NewTimer(watchdogResendInterval),
 			}
-
-			mode = Stopped
 		} else {
-			switch mode {
-			case Stopped: fallthrough
-			case Online:
-				// Only local requests on panel.
-				lightPanel(panel, backup.get(), nil)
-
-				// Check if the elevator was disconnected in the middle of a transaction.
-				if reqch == nil {
-					unassigned <- req
-					reqch = unassigned
-				}
-				
-			case Local:
+			c.node = network.NewNode()
+			c.watchdog = &WatchdogHandler{
+				watchdog: &net.UnixAddr{conf["watchdog.socket"], "unixgram"},
+				addr:     &net.UnixAddr{conf["watchdog.elev_socket"], "unixgram"},
+				timer:    time.NewTimer(watchdogResendInterval),
 			}
-
-			mode = Local
 		}
 
-		/*
-		 * Process messages and handle backups.
-		 */
-		select {
-
-		case <-watchdog.timer.C:
-			watchdog.writeBackup(backup.get())
-			watchdog.timer.Reset(watchdogResendInterval)
-
-		case <-backup.invalid:
-			bd := backup.create(elevator)
-			watchdog.writeBackup(bd)
-
-			if mode != Local {
-				sendData(node, BACKUP, bd)
-				debug.Printf("Sent backup message: \n\t%v\n", bd)
-			}
-
-		case r := <-panel.Requests:
-			unassigned <- r
-
-		case req = <-reqch:
-			if mode == Online {
-				var cd = costData{
-					elevator: node.Addr(),
-					req:      req,
-					cost:     elevator.SimulateCost(req),
-				}
-				sendData(node, COST, &cd)
-				debug.Printf("Sent cost message: \n\t%v\n", cd)
-
-				reqch = nil // handle only Request at a time.
-			} else if mode == Stopped {
-				var cd = costData{
-					elevator: node.Addr(),
-					req:      req,
-					cost:     9000.0,
-				}
-				sendData(node, COST, &cd)
-				debug.Printf("Sent cost message: \n\t%v\n", cd)
-
-				reqch = nil // handle only Request at a time.
-			} else if mode == Local {
-				elevator.AddRequest(req)
-			}
-
-		case msg := <-msgsFromOther:
-			if mode == Stopped {
-				node.ForwardMessage(msg)
-			} else if mode == Local {
-				break
-			}
-
-			switch msg.Type {
-			case COST:
-				var cd costData
-				if err := unpackData(msg.Data, &cd); err != nil {
-					errorlog.Println(err)
-					break
-				}
-
-				debug.Printf("Received cost message: \n\t%v\n", cd)
-
-				// Update cost message if our cost is lower.
-				cost := elevator.SimulateCost(cd.req)
-				if cost < cd.cost {
-					cd.elevator = node.Addr()
-					cd.cost = cost
-				}
-
-				debug.Printf("Forwarded cost message: \n\t%v\n", cd)
-
-				packData(msg.Data, &cd)
-
-			case ASSIGN:
-				var ad assignData
-				if err := unpackData(msg.Data, &ad); err != nil {
-					errorlog.Println(err)
-					break
-				}
-
-				debug.Printf("Received assign message: \n\t%v\n", ad)
-
-				// Add request to elevator if the request was assign to this elevator.
-				if ad.elevator == node.Addr() {
-					elevator.AddRequest(ad.req)
-					panel.SetLamp(btnFromDir(ad.req.direction), ad.req.floor, true)
-					ad.taken = true
-				}
-
-				debug.Printf("Forwarded assign message: \n\t%v\n", ad)
-
-				packData(msg.Data, &ad)
-
-			case BACKUP:
-				var bd backupData
-				if err := unpackData(msg.Data, &bd); err != nil {
-					errorlog.Println(err)
-					break
-				}
-
-				debug.Printf("Forwarded backup message: \n\t%v\n", bd)
-
-				old := backup.backups[bd.elevator]
-				lightPanel(panel, &bd, old)
-				backup.update(&bd)
-
-			case SYNC:
-				var sd syncData
-				unpackData(msg.Data, &sd)
-				syncBackup(&sd, backup.get())
-				packData(msg.Data, &sd)
-
-			}
-			node.ForwardMessage(msg)
-
-		case msg := <-msgsFromThis:
-			if mode == Local {
-				break
-			}
-
-			switch msg.Type {
-			case COST:
-				var cd costData
-				if err := unpackData(msg.Data, &cd); err != nil {
-					elevator.AddRequest(req)
-					reqch = unassigned
-					errorlog.Println(err)
-					break
-				}
-
-				// Assign request to elevator with lowest cost value.
-				var ad = assignData{
-					elevator: cd.elevator,
-					req:      cd.req,
-				}
-				sendData(node, ASSIGN, &ad)
-				debug.Printf("Cost message returned: \n\t%v\n", cd)
-				debug.Printf("Sent assign message: \n\t%v\n", ad)
-
-			case ASSIGN:
-				var ad assignData
-				if err := unpackData(msg.Data, &ad); err != nil {
-					elevator.AddRequest(req)
-					reqch = unassigned
-					errorlog.Println(err)
-					break
-				}
-
-				debug.Printf("Assign message returned: \n\t%v\n", ad)
-				if !ad.taken {
-					if mode != Stopped {
-						elevator.AddRequest(ad.req)
-					} else {
-						unassigned <- req
-					}
-				}
-
-				// Transaction complete. Ready to process next request.
-				reqch = unassigned
-
-			case SYNC:
-				var sd syncData
-				unpackData(msg.Data, &sd)
-				lightBackup(panel, sd.latest, nil)
+		// Load elevator backup.
+		var err error
+		c.backup, err = c.watchdog.start()
+		if err != nil {
+			errorlog.Println("Unable to load backup:", err)
+			c.backup = &msgdata.BackupData{}
+		}
+		if i == 0 {
+			c.metrics = conf["metrics.address"]
+		}
 
-			}
+		// Initialize elevator hardware.
+		c.drv, err = elev.NewCarDriver(i)
+		if err != nil {
+			debug.Println(err)
+			os.Exit(1)
+		}
+		err = c.drv.Init()
+		if err != nil {
+			debug.Println(err)
+			os.Exit(1)
+		}
+		c.scanner = elev.NewScanner(c.drv)
+		err = c.scanner.Start()
+		if err != nil {
+			debug.Println(err)
+			os.Exit(1)
+		}
+		all[i] = c
+	}
 
-		case <-interrupt:
-			elev.SetMotorDirection(elev.Stop)
-			os.Exit(0)
+	for _, c := range all {
+		go c.run()
+	}
 
-		case dead := <-deadNode:
-			debug.Printf("%v has been disconnected. Try to find backup.\n", dead)
+	// Stop all cars on SIGINT, or when the loopback ring meets an
+	// elevator it can not join.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT)
+	code := 0
+	select {
+	case <-interrupt:
+	case err := <-ringConflict:
+		errorlog.Println(err)
+		code = 1
+	}
+	for _, c := range all {
+		c.drv.SetMotorDirection(elev.Stop)
+	}
+	os.Exit(code)
+}
 
-			// Lookup backup for the disconnected elevator.
-			if deadbackup, found := backup.backups[dead]; found {
-				debug.Printf("Found backup of %v\n", dead)
+// serves returns true if the elevator at addr serves the floor.
+// Elevators that have not advertised their metadata are assumed to
+// serve every floor.
+func serves(node *network.Node, addr network.Addr, floor int) bool {
+	meta, ok := node.Member(addr)
+	if !ok || meta.Floors == 0 {
+		return true
+	}
+	return floor < meta.Floors
+}
 
-				restoreBackup(unassigned, deadbackup)
+// Extracts the requests from a backup.
+func restoreBackup(bd *msgdata.BackupData) []Request {
+	var reqs []Request
+	for floor := 0; floor < bd.Floors(); floor++ {
+		for _, dir := range []elev.Direction{elev.Down, elev.Up} {
+			if requested(bd, floor, dir) {
+				reqs = append(reqs, Request{Floor: floor, Direction: dir})
 			}
-		default:
 		}
-
 	}
-
-	os.Exit(0)
+	return reqs
 }
 
-// Extracts request from backup into channel.
-func restoreBackup(c chan Request, bd *backupData) {
-	for floor := 0; floor < elev.NumFloors; floor++ {
+// ORs the backup into SyncData. SyncData grows to the floors of the
+// tallest elevator.
+func syncBackup(sd *msgdata.SyncData, bd *msgdata.BackupData) {
+	for sd.Latest.Floors() < bd.Floors() {
+		sd.Latest.Requests = append(sd.Latest.Requests, [2]bool{})
+		sd.Latest.Dest = append(sd.Latest.Dest, false)
+	}
+	for floor := 0; floor < bd.Floors(); floor++ {
 		for _, dir := range []elev.Direction{elev.Down, elev.Up} {
-			if bd.requests[floor][indexOfDir(dir)] {
-				c <- Request{floor, dir}
+			if requested(bd, floor, dir) {
+				sd.Latest.Requests[floor][indexOfDir(dir)] = true
 			}
 		}
 	}
 }
 
-// ORs the backup into syncData.
-func syncBackup(sd *syncData, bd *backupData) {
-	for floor := 0; floor < elev.NumFloors; floor++ {
+// showHallCalls lights the hall lamps of the calls that are set in the
+// table, and turns the others off.
+func showHallCalls(panel *Panel, t *hallcall.Table) {
+	floors := panel.Floors()
+	for floor := 0; floor < floors; floor++ {
 		for _, dir := range []elev.Direction{elev.Down, elev.Up} {
-			if bd.requests[floor][indexOfDir(dir)] {
-				sd.latest.requests[floor][indexOfDir(dir)] = true
+			req := Request{Floor: floor, Direction: dir}
+			if !req.IsValid(floors) {
+				continue
+			}
+			if on := t.IsSet(req); panel.Lamp(btnFromDir(dir), floor) != on {
+				panel.SetLamp(btnFromDir(dir), floor, on)
 			}
 		}
 	}
 }
 
-// Update panel by comparing old and new backups.
-func lightPanel(panel *Panel, new, old *backupData) {
-	var empty backupData
-	if old == nil {
-		old = &empty
+// hallCallsChanged shows a change this elevator made to the table of
+// hall calls, and sends the table to the other elevators unless the
+// elevator is on its own.
+func hallCallsChanged(node *network.Node, panel *Panel, t *hallcall.Table, mode ServiceMode) {
+	showHallCalls(panel, t)
+	if mode != Local {
+		gossipHallCalls(node, t)
 	}
+}
 
-	for floor := 0; floor < elev.NumFloors; floor++ {
-		for _, dir := range []elev.Direction{elev.Down, elev.Up} {
-			if !old.requests[floor][indexOfDir(dir)] && new.requests[floor][indexOfDir(dir)] {
-				panel.SetLamp(btnFromDir(dir), floor, true)
-			} else if old.requests[floor][indexOfDir(dir)] && !new.requests[floor][indexOfDir(dir)] {
-				panel.SetLamp(btnFromDir(dir), floor, false)
-			}
-		}
+// gossipHallCalls sends the table of hall calls around the ring.
+func gossipHallCalls(node *network.Node, t *hallcall.Table) {
+	for _, hd := range t.Gossip() {
+		sendData(node, msgdata.HALLCALLS, hd)
 	}
+}
 
+// observeHallCalls lets the parking and the traffic mode learn from the
+// calls that are new in the table of hall calls.
+func observeHallCalls(t *hallcall.Table, pk *Parking, tr *Traffic) {
+	calls, now := t.Calls(), time.Now()
+	pk.Observe(calls, now)
+	tr.ObserveHallCalls(calls, now)
 }
 
 // Listen for disconnected elevators.
@@ -490,6 +418,13 @@ func getDeadNode(node *network.Node, c chan network.Addr) {
 	}
 }
 
+// Listen for direct messages that were never acknowledged.
+func getUndelivered(node *network.Node, c chan *network.Message) {
+	for {
+		c <- node.GetUndelivered()
+	}
+}
+
 // Listen for new messages from other elevators.
 func receiveMsgs(node *network.Node, msgs chan *network.Message) {
 	for {
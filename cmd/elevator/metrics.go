@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+// serveMetrics exposes the node statistics in the Prometheus text
+// format on http://addr/metrics, and the expected waiting times of the
+// hall calls in JSON on http://addr/eta. The floor keypads are served
+// on the same address. It only returns on error.
+func serveMetrics(addr string, node *network.Node, e *Elevator, k *Keypads) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, node.Stats())
+	})
+	mux.HandleFunc("/eta", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		writeETA(w, node.Meta().Name, e)
+	})
+	mux.HandleFunc("/call", func(w http.ResponseWriter, r *http.Request) {
+		k.serveCall(w, r, e.floors)
+	})
+	mux.HandleFunc("/dispatch", k.serveDispatch)
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		errorlog.Println(err)
+	}
+}
+
+func writeMetrics(w io.Writer, st network.Stats) {
+	fmt.Fprintln(w, "# HELP ring_ping_rtt_seconds Round-trip time of pings to neighbours.")
+	fmt.Fprintln(w, "# TYPE ring_ping_rtt_seconds histogram")
+	addrs := make([]network.Addr, 0, len(st.RTT))
+	for addr := range st.RTT {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	for _, addr := range addrs {
+		h := st.RTT[addr]
+		var cum uint64
+		for i, bound := range network.RTTBuckets {
+			cum += h.Counts[i]
+			fmt.Fprintf(w, "ring_ping_rtt_seconds_bucket{neighbour=\"%v\",le=\"%g\"} %d\n",
+				addr, bound.Seconds(), cum)
+		}
+		fmt.Fprintf(w, "ring_ping_rtt_seconds_bucket{neighbour=\"%v\",le=\"+Inf\"} %d\n",
+			addr, h.Count)
+		fmt.Fprintf(w, "ring_ping_rtt_seconds_sum{neighbour=\"%v\"} %g\n",
+			addr, h.Sum.Seconds())
+		fmt.Fprintf(w, "ring_ping_rtt_seconds_count{neighbour=\"%v\"} %d\n",
+			addr, h.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP ring_messages_sent_total Datagrams sent by message type.")
+	fmt.Fprintln(w, "# TYPE ring_messages_sent_total counter")
+	writeTypeCounts(w, "ring_messages_sent_total", st.Sent)
+
+	fmt.Fprintln(w, "# HELP ring_messages_received_total Datagrams received by message type.")
+	fmt.Fprintln(w, "# TYPE ring_messages_received_total counter")
+	writeTypeCounts(w, "ring_messages_received_total", st.Received)
+
+	fmt.Fprintln(w, "# HELP ring_resend_retries_total Messages resent.")
+	fmt.Fprintln(w, "# TYPE ring_resend_retries_total counter")
+	fmt.Fprintf(w, "ring_resend_retries_total %d\n", st.Retries)
+
+	fmt.Fprintln(w, "# HELP ring_resend_timeouts_total Messages given up on after all resends.")
+	fmt.Fprintln(w, "# TYPE ring_resend_timeouts_total counter")
+	fmt.Fprintf(w, "ring_resend_timeouts_total %d\n", st.Timeouts)
+
+	fmt.Fprintln(w, "# HELP ring_kicks_total Nodes kicked from the ring.")
+	fmt.Fprintln(w, "# TYPE ring_kicks_total counter")
+	fmt.Fprintf(w, "ring_kicks_total{by=\"local\"} %d\n", st.Kicks)
+	fmt.Fprintf(w, "ring_kicks_total{by=\"remote\"} %d\n", st.KicksSeen)
+
+	fmt.Fprintln(w, "# HELP ring_state_seconds_total Time spent in each node state.")
+	fmt.Fprintln(w, "# TYPE ring_state_seconds_total counter")
+	states := make([]string, 0, len(st.StateTime))
+	for state := range st.StateTime {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		fmt.Fprintf(w, "ring_state_seconds_total{state=\"%s\"} %g\n",
+			state, st.StateTime[state].Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP ring_drops_total Messages dropped.")
+	fmt.Fprintln(w, "# TYPE ring_drops_total counter")
+	fmt.Fprintf(w, "ring_drops_total %d\n", st.Drops)
+}
+
+func writeTypeCounts(w io.Writer, name string, counts map[network.MsgType]uint64) {
+	types := make([]network.MsgType, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	for _, t := range types {
+		fmt.Fprintf(w, "%s{type=\"%s\"} %d\n", name, msgdata.TypeName(t), counts[t])
+	}
+}
+
+// callETA is the expected waiting time for a hall call.
+type callETA struct {
+	Floor     int     `json:"floor"`
+	Direction string  `json:"direction"`
+	Assigned  bool    `json:"assigned"` // the call is assigned to this car
+	ETA       float64 `json:"eta"`      // seconds
+}
+
+// writeETA writes the time the car needs to reach every hall call, as
+// if the call was assigned to it. A stopped car has no calls. The times
+// are worked out on the elevator goroutine, and written after.
+func writeETA(w io.Writer, name string, e *Elevator) {
+	out := struct {
+		Car     string    `json:"car"`
+		Floor   int       `json:"floor"`
+		Running bool      `json:"running"`
+		Calls   []callETA `json:"calls"`
+	}{Car: name, Running: e.IsRunning(), Calls: []callETA{}}
+
+	e.do(func() {
+		out.Floor = e.floor
+		for floor := 0; floor < e.floors; floor++ {
+			for _, dir := range []elev.Direction{elev.Down, elev.Up} {
+				req := Request{Floor: floor, Direction: dir}
+				eta, ok := e.eta(req)
+				if !ok {
+					continue
+				}
+				name := "up"
+				if dir == elev.Down {
+					name = "down"
+				}
+				out.Calls = append(out.Calls, callETA{
+					Floor:     floor,
+					Direction: name,
+					Assigned:  e.requestsBuffer[floor][indexOfDir(dir)],
+					ETA:       eta.Seconds(),
+				})
+			}
+		}
+	})
+	json.NewEncoder(w).Encode(out)
+}
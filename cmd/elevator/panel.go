@@ -1,96 +1,114 @@
 package main
 
 import (
-	"time"
+	"sync"
 
 	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
 )
 
-const pollInterval = 25 * time.Millisecond
-
 // Panel holds the state of the elevator panel.
 type Panel struct {
 	Requests chan Request
+
+	// Commands holds the cab buttons pressed. A floor is sent once
+	// until its lamp is turned off, so the buffer never fills.
 	Commands chan int
 
-	lamps [elev.NumFloors][3]bool
+	drv    elev.Driver
+	events <-chan elev.Event
+
+	mu    sync.Mutex // guards lamps, set from the car and the panel
+	lamps [][3]bool
 }
 
-func NewPanel() *Panel {
+func NewPanel(drv elev.Driver, sc *elev.Scanner) *Panel {
 	p := new(Panel)
-	p.Requests = make(chan Request, maxRequests)
-	p.Commands = make(chan int)
+	p.drv = drv
+	p.events = sc.Subscribe(elev.ButtonPressed, elev.InputError)
+	p.lamps = make([][3]bool, drv.Floors())
+	p.Requests = make(chan Request, 2*drv.Floors())
+	p.Commands = make(chan int, drv.Floors())
 	return p
 }
 
 func (p *Panel) Start() {
-	go p.poll()
+	go p.listen()
 }
 
 // Initializes panel from backup. LoadBackup may be called with a
-// empty backupData struct.
-func (p *Panel) LoadBackup(bd *backupData) {
-	for floor := 0; floor < elev.NumFloors; floor++ {
-		//p.SetLamp(elev.CallDown, floor, bd.requests[floor][0])
-		//p.SetLamp(elev.CallUp, floor, bd.requests[floor][1])
-		p.SetLamp(elev.Command, floor, bd.dest[floor])
+// empty BackupData struct. A backup from an elevator with a different
+// number of floors is ignored.
+func (p *Panel) LoadBackup(bd *msgdata.BackupData) {
+	if bd.Floors() != p.Floors() {
+		return
+	}
+	for floor := range p.lamps {
+		//p.SetLamp(elev.CallDown, floor, bd.Requests[floor][0])
+		//p.SetLamp(elev.CallUp, floor, bd.Requests[floor][1])
+		p.SetLamp(elev.Command, floor, bd.Dest[floor])
 	}
 }
 
+// Floors returns the number of floors on the panel.
+func (p *Panel) Floors() int {
+	return len(p.lamps)
+}
+
+// Lamp reports whether the lamp of button b at floor is lit.
+func (p *Panel) Lamp(b elev.Button, floor int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lamps[floor][b]
+}
+
 func (p *Panel) SetLamp(b elev.Button, floor int, on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
 	if on {
-		elev.SetButtonLamp(b, floor, 1)
+		err = p.drv.SetButtonLamp(b, floor, 1)
 		p.lamps[floor][b] = true
 	} else {
-		elev.SetButtonLamp(b, floor, 0)
+		err = p.drv.SetButtonLamp(b, floor, 0)
 		p.lamps[floor][b] = false
 	}
+	if err != nil {
+		errorlog.Println("Unable to set button lamp:", err)
+	}
+}
+
+func (p *Panel) listen() {
+	for ev := range p.events {
+		switch ev.Type {
+		case elev.ButtonPressed:
+			p.pressed(ev.Button, ev.Floor)
+		case elev.InputError:
+			errorlog.Println("Unable to read panel:", ev.Err)
+		}
+	}
 }
 
-func (p *Panel) poll() {
-	var prev [elev.NumFloors][3]int
-
-	for {
-		for floor := 0; floor < elev.NumFloors; floor++ {
-			v := elev.ReadButton(elev.CallUp, floor)
-			if v != 0 && prev[floor][elev.CallUp] == 0 {
-				if !p.lamps[floor][elev.CallUp] {
-					p.Requests <- Request{
-						floor:     floor,
-						direction: elev.Up,
-					}
-					elev.SetButtonLamp(elev.CallUp, floor, 1)
-					p.lamps[floor][elev.CallUp] = true
-				}
-			}
-			prev[floor][elev.CallUp] = v
-
-			v = elev.ReadButton(elev.CallDown, floor)
-			if v != 0 && v != prev[floor][elev.CallDown] {
-				if !p.lamps[floor][elev.CallDown] {
-					p.Requests <- Request{
-						floor:     floor,
-						direction: elev.Down,
-					}
-					elev.SetButtonLamp(elev.CallDown, floor, 1)
-					p.lamps[floor][elev.CallDown] = true
-				}
-			}
-			prev[floor][elev.CallDown] = v
-
-			v = elev.ReadButton(elev.Command, floor)
-			if v != 0 && v != prev[floor][elev.Command] {
-				if !p.lamps[floor][elev.Command] {
-					select {
-					case p.Commands <- floor:
-						elev.SetButtonLamp(elev.Command, floor, 1)
-						p.lamps[floor][elev.Command] = true
-					default: // don't block
-					}
-				}
-			}
-			prev[floor][elev.Command] = v
+// pressed sends a request for a hall button, or a command for a cab
+// button, unless the lamp shows it is already taken care of.
+func (p *Panel) pressed(b elev.Button, floor int) {
+	if p.Lamp(b, floor) {
+		return
+	}
+
+	switch b {
+	case elev.CallUp:
+		p.Requests <- Request{Floor: floor, Direction: elev.Up}
+		p.SetLamp(b, floor, true)
+	case elev.CallDown:
+		p.Requests <- Request{Floor: floor, Direction: elev.Down}
+		p.SetLamp(b, floor, true)
+	case elev.Command:
+		select {
+		case p.Commands <- floor:
+			p.SetLamp(b, floor, true)
+		default: // don't block
 		}
-		time.Sleep(pollInterval)
 	}
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+const (
+	// The parking floors are chosen, and claimed again, this often.
+	parkInterval = time.Second
+
+	// A claim that has not been renewed for parkClaimTime is dropped,
+	// in case the elevator that made it is gone.
+	parkClaimTime = 3 * parkInterval
+
+	// Hall calls older than parkHistory do not count when the next
+	// call is predicted.
+	parkHistory = 15 * time.Minute
+)
+
+// The parking policies that can be chosen with parking in the config.
+// A policy returns the floors the idle cars should park at, best
+// first, for a ring of the given number of cars.
+var parkingPolicies = map[string]func(pk *Parking, cars int) []int{
+	"lobby":   (*Parking).lobby,
+	"zones":   (*Parking).zones,
+	"predict": (*Parking).predict,
+}
+
+// Parking decides where the car waits when it has nothing to do. The
+// idle cars on the ring claim the floors they park at with PARK
+// messages, and a floor goes to the car closest to it, so no two cars
+// park at the same floor unless the policy has room for more.
+type Parking struct {
+	policy func(pk *Parking, cars int) []int
+	floors int
+	target int // -1 if not parking
+	from   int // where the car was when it claimed target
+
+	claims map[network.Addr]parkClaim // of the other elevators
+
+	// The hall calls seen, and when each new one showed up.
+	seen  map[Request]bool
+	calls []parkCall
+}
+
+type parkClaim struct {
+	floor int
+	from  int
+	until time.Time
+}
+
+type parkCall struct {
+	floor int
+	at    time.Time
+}
+
+// NewParking returns the parking policy with the given name for a car
+// with the given number of floors. With no such policy the car only
+// parks in peak traffic.
+func NewParking(name string, floors int) *Parking {
+	return &Parking{
+		policy: parkingPolicies[name],
+		floors: floors,
+		target: -1,
+		claims: make(map[network.Addr]parkClaim),
+		seen:   make(map[Request]bool),
+	}
+}
+
+// lobbyFloor returns the lobby of a building with the given number of
+// floors.
+func lobbyFloor(floors int) int {
+	if settings.LobbyFloor < 0 || settings.LobbyFloor >= floors {
+		return 0
+	}
+	return settings.LobbyFloor
+}
+
+// lobby parks one car at the lobby.
+func (pk *Parking) lobby(cars int) []int {
+	return []int{lobbyFloor(pk.floors)}
+}
+
+// allLobby parks every car at the lobby, for up-peak traffic.
+func (pk *Parking) allLobby(cars int) []int {
+	floors := make([]int, cars)
+	for i := range floors {
+		floors[i] = lobbyFloor(pk.floors)
+	}
+	return floors
+}
+
+// zones splits the building into one zone for each car, and parks the
+// cars in the middle of the zones.
+func (pk *Parking) zones(cars int) []int {
+	return zones(0, pk.floors, cars)
+}
+
+// upperZones splits the floors above the lobby into zones, for
+// down-peak traffic.
+func (pk *Parking) upperZones(cars int) []int {
+	lobby := lobbyFloor(pk.floors)
+	if lobby == pk.floors-1 {
+		return pk.zones(cars)
+	}
+	return zones(lobby+1, pk.floors, cars)
+}
+
+// zones returns the middle floors of cars zones of the floors from low
+// up to high.
+func zones(low, high, cars int) []int {
+	var floors []int
+	for i := 0; i < cars; i++ {
+		floor := low + (2*i+1)*(high-low)/(2*cars)
+		if len(floors) == 0 || floors[len(floors)-1] != floor {
+			floors = append(floors, floor)
+		}
+	}
+	return floors
+}
+
+// policyFor returns the parking policy in the given traffic mode. In a
+// peak the cars wait where the calls come from, whatever the policy in
+// the config.
+func (pk *Parking) policyFor(traffic TrafficMode) func(pk *Parking, cars int) []int {
+	switch traffic {
+	case UpPeak:
+		return (*Parking).allLobby
+	case DownPeak:
+		return (*Parking).upperZones
+	}
+	return pk.policy
+}
+
+// predict parks the cars at the floors with the most hall calls lately,
+// or in zones if there have been none.
+func (pk *Parking) predict(cars int) []int {
+	count := make([]int, pk.floors)
+	var floors []int
+	for _, c := range pk.calls {
+		if c.floor < pk.floors {
+			if count[c.floor] == 0 {
+				floors = append(floors, c.floor)
+			}
+			count[c.floor]++
+		}
+	}
+	if len(floors) == 0 {
+		return pk.zones(cars)
+	}
+
+	sort.Slice(floors, func(i, j int) bool {
+		if count[floors[i]] != count[floors[j]] {
+			return count[floors[i]] > count[floors[j]]
+		}
+		return floors[i] < floors[j]
+	})
+	if len(floors) > cars {
+		floors = floors[:cars]
+	}
+	return floors
+}
+
+// Observe records the hall calls that are new since the last call, for
+// predicting the next call.
+func (pk *Parking) Observe(calls []Request, now time.Time) {
+	seen := make(map[Request]bool)
+	for _, req := range calls {
+		seen[req] = true
+		if !pk.seen[req] {
+			pk.calls = append(pk.calls, parkCall{floor: req.Floor, at: now})
+		}
+	}
+	pk.seen = seen
+
+	for len(pk.calls) > 0 && now.Sub(pk.calls[0].at) > parkHistory {
+		pk.calls = pk.calls[1:]
+	}
+}
+
+// Claim records the parking floor claimed by another elevator.
+func (pk *Parking) Claim(pd *msgdata.ParkData, now time.Time) {
+	if pd.Floor < 0 {
+		delete(pk.claims, pd.Elevator)
+		return
+	}
+	pk.claims[pd.Elevator] = parkClaim{
+		floor: pd.Floor,
+		from:  pd.From,
+		until: now.Add(parkClaimTime),
+	}
+}
+
+// choose returns the parking floor for a car at from, out of floors. A
+// floor may be in floors more than once, and then takes as many cars.
+// The car keeps the floor it has claimed while there is room for it, so
+// cars on their way to park do not swap floors as they pass each
+// other. Otherwise it takes the closest floor that has room for it, or
+// -1 if there is none.
+func (pk *Parking) choose(me network.Addr, from int, floors []int, now time.Time) int {
+	for addr, c := range pk.claims {
+		if now.After(c.until) {
+			delete(pk.claims, addr)
+		}
+	}
+
+	room := make(map[int]int)
+	for _, floor := range floors {
+		room[floor]++
+	}
+	if pk.target != -1 && pk.better(me, pk.target, pk.from) < room[pk.target] {
+		return pk.target
+	}
+
+	best := -1
+	for _, floor := range floors {
+		if pk.better(me, floor, from) < room[floor] && (best == -1 || abs(from-floor) < abs(from-best)) {
+			best = floor
+		}
+	}
+	return best
+}
+
+// better returns the number of other elevators with a better claim on
+// floor than a car at from. A claim is better if it was made closer to
+// the floor, or as close and from a lower address.
+func (pk *Parking) better(me network.Addr, floor, from int) int {
+	n := 0
+	for addr, c := range pk.claims {
+		if c.floor != floor {
+			continue
+		}
+		mine, theirs := abs(from-floor), abs(c.from-floor)
+		if theirs < mine || (theirs == mine && bytes.Compare(addr[:], me[:]) < 0) {
+			n++
+		}
+	}
+	return n
+}
+
+// Update sends the car to its parking floor if it is idle, and claims
+// the floor on the ring. A car that is busy again, or has no parking
+// policy in the traffic mode, gives up its claim.
+func (pk *Parking) Update(node *network.Node, e *Elevator, mode ServiceMode, traffic TrafficMode, now time.Time) {
+	policy := pk.policyFor(traffic)
+	if policy == nil && pk.target == -1 {
+		return
+	}
+
+	cars := 1
+	if mode != Local {
+		cars = len(node.Members())
+	}
+	target := -1
+	from, idle := e.Idle()
+	if idle && policy != nil {
+		target = pk.choose(node.Addr(), from, policy(pk, cars), now)
+	}
+	// The car only sets off once the floor has been claimed for a
+	// round, so two cars that choose the same floor at once do not both
+	// go there.
+	if target != pk.target {
+		debug.Printf("Parking floor %v, was %v.\n", target, pk.target)
+		pk.from = from
+		if target == -1 {
+			e.Park(-1)
+		}
+	} else {
+		// The claim gets stronger as the car gets closer.
+		if abs(from-target) < abs(pk.from-target) {
+			pk.from = from
+		}
+		e.Park(target)
+	}
+
+	if mode != Local && (target != -1 || pk.target != -1) {
+		pd := msgdata.ParkData{Elevator: node.Addr(), Floor: target, From: pk.from}
+		sendData(node, msgdata.PARK, &pd)
+	}
+	pk.target = target
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
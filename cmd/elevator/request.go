@@ -2,22 +2,10 @@ package main
 
 import (
 	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
 )
 
-const maxRequests = 2 * elev.NumFloors
-
-type Request struct {
-	floor     int
-	direction elev.Direction
-}
-
-func (req Request) isValid() bool {
-	if (req.floor == 0 && req.direction == elev.Down) ||
-		(req.floor == elev.NumFloors-1 && req.direction == elev.Up) {
-		return false
-	}
-	return true
-}
+type Request = msgdata.Request
 
 // btnFromDir converts a elev.Direction to the corresponding elev.Button.
 func btnFromDir(dir elev.Direction) elev.Button {
@@ -27,6 +15,13 @@ func btnFromDir(dir elev.Direction) elev.Button {
 	return elev.CallDown
 }
 
+// requested returns true if the backup has a request at floor in
+// direction dir. Backups from elevators with fewer floors have no
+// requests above their top floor.
+func requested(bd *msgdata.BackupData, floor int, dir elev.Direction) bool {
+	return floor < len(bd.Requests) && bd.Requests[floor][indexOfDir(dir)]
+}
+
 // indexOfDir return the index of a elev.Direction.
 func indexOfDir(dir elev.Direction) int {
 	if dir == elev.Down {
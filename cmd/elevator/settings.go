@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Settings holds the elevator settings from the [elevator] section of
+// the config file.
+type Settings struct {
+	// Time the doors stay open at a floor.
+	DoorOpenTime time.Duration
+
+	// Time the doors take to open or close.
+	DoorMoveTime time.Duration
+
+	// Extra open time when the cab button of the current floor is
+	// pressed while the doors are open.
+	DoorHoldTime time.Duration
+
+	// Time the doors may be obstructed before the car gives its hall
+	// calls to other elevators.
+	DoorFaultTime time.Duration
+
+	// Time the car may take from one floor to the next before the motor
+	// is considered stalled.
+	MotorStallTime time.Duration
+
+	// Time a motor or floor sensor fault may last before the car gives
+	// its hall calls to other elevators.
+	FaultHandoverTime time.Duration
+
+	// Name of the cost function used to bid for requests. All the
+	// elevators must use the same.
+	Cost string
+
+	// Hall calls a car has had for longer than RebalanceAge are put up
+	// for auction again every RebalanceInterval, and move to another
+	// car if it bids better. Zero age turns this off.
+	RebalanceAge      time.Duration
+	RebalanceInterval time.Duration
+
+	// Time a hall call may wait before it is logged as a breach of the
+	// service guarantee and put up for auction again. Zero turns this
+	// off.
+	CallDeadline time.Duration
+
+	// Where a car waits once it has been idle for ParkDelay: lobby,
+	// zones or predict, see parkingPolicies. Empty leaves the car where
+	// it stopped.
+	Parking    string
+	ParkDelay  time.Duration
+	LobbyFloor int
+
+	// How the traffic mode is chosen: auto detects it from the calls,
+	// and empty keeps inter-floor traffic. TrafficSchedule sets the
+	// mode for periods of the day, like "07:30-09:30 up-peak,
+	// 16:00-18:00 down-peak", and takes precedence.
+	Traffic         string
+	TrafficSchedule string
+}
+
+var defaultSettings = Settings{
+	DoorOpenTime:  3 * time.Second,
+	DoorMoveTime:  500 * time.Millisecond,
+	DoorHoldTime:  5 * time.Second,
+	DoorFaultTime: 20 * time.Second,
+
+	MotorStallTime:    4 * time.Second,
+	FaultHandoverTime: 10 * time.Second,
+
+	Cost: "unit",
+
+	RebalanceAge:      15 * time.Second,
+	RebalanceInterval: 5 * time.Second,
+
+	CallDeadline: time.Minute,
+
+	ParkDelay: 10 * time.Second,
+}
+
+// The settings in use. It is not called config, since that is the name
+// of the config package.
+var settings = defaultSettings
+
+// loadSettings reads the settings from conf. Missing or invalid values
+// keep their defaults.
+func loadSettings(conf map[string]string) {
+	duration(conf, "elevator.door_open_time", &settings.DoorOpenTime)
+	duration(conf, "elevator.door_move_time", &settings.DoorMoveTime)
+	duration(conf, "elevator.door_hold_time", &settings.DoorHoldTime)
+	duration(conf, "elevator.door_fault_time", &settings.DoorFaultTime)
+	duration(conf, "elevator.motor_stall_time", &settings.MotorStallTime)
+	duration(conf, "elevator.fault_handover_time", &settings.FaultHandoverTime)
+	duration(conf, "elevator.rebalance_age", &settings.RebalanceAge)
+	duration(conf, "elevator.rebalance_interval", &settings.RebalanceInterval)
+	duration(conf, "elevator.call_deadline", &settings.CallDeadline)
+	duration(conf, "elevator.park_delay", &settings.ParkDelay)
+	integer(conf, "elevator.lobby_floor", &settings.LobbyFloor)
+	if conf["elevator.cost"] != "" {
+		settings.Cost = conf["elevator.cost"]
+	}
+	if conf["elevator.parking"] != "" {
+		settings.Parking = conf["elevator.parking"]
+	}
+	if conf["elevator.traffic"] != "" {
+		settings.Traffic = conf["elevator.traffic"]
+	}
+	if conf["elevator.traffic_schedule"] != "" {
+		settings.TrafficSchedule = conf["elevator.traffic_schedule"]
+	}
+}
+
+func duration(conf map[string]string, key string, d *time.Duration) {
+	if v, err := time.ParseDuration(conf[key]); err == nil {
+		*d = v
+	}
+}
+
+func integer(conf map[string]string, key string, i *int) {
+	if v, err := strconv.Atoi(conf[key]); err == nil {
+		*i = v
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+// TrafficMode is the pattern of the traffic in the building. The
+// dispatch and the parking follow it.
+type TrafficMode int
+
+const (
+	InterFloor TrafficMode = iota // between all floors
+	UpPeak                        // most passengers go up from the lobby
+	DownPeak                      // most passengers go down to the lobby
+)
+
+var trafficModeNames = []string{"inter-floor", "up-peak", "down-peak"}
+
+func (m TrafficMode) String() string {
+	if m < 0 || int(m) >= len(trafficModeNames) {
+		return fmt.Sprintf("TrafficMode(%d)", int(m))
+	}
+	return trafficModeNames[m]
+}
+
+func parseTrafficMode(s string) (TrafficMode, bool) {
+	for m, name := range trafficModeNames {
+		if s == name {
+			return TrafficMode(m), true
+		}
+	}
+	return InterFloor, false
+}
+
+const (
+	// The traffic mode is picked, and sent around the ring, this often.
+	// A mode that has not been heard for modeTimeout is dropped, in case
+	// the elevator that picked it is gone.
+	trafficInterval = 5 * time.Second
+	modeTimeout     = 3 * trafficInterval
+
+	// The mode is detected from the calls of the last trafficWindow,
+	// once there are at least trafficMinCalls of them. It is a peak if
+	// peakShare of the calls go up from the lobby, or down to it.
+	trafficWindow   = 5 * time.Minute
+	trafficMinCalls = 10
+	peakShare       = 0.5
+
+	// In a peak, delaying a call the mode favours costs this many times
+	// as much.
+	peakWeight = 2
+)
+
+// Traffic picks the traffic mode of the ring, from the schedule in the
+// config or from the hall and cab calls of all the elevators. The mode
+// is picked by the elevator with the lowest address, and sent to the
+// others with MODE messages, so they all dispatch the same way.
+type Traffic struct {
+	mode     TrafficMode
+	heard    time.Time // the mode was picked by another elevator
+	floors   int
+	schedule []trafficPeriod
+
+	seen  map[Request]bool // hall calls
+	calls []trafficCall
+}
+
+// trafficPeriod is a part of the day with a set mode. The times are
+// from midnight, and a period that ends before it starts goes past
+// midnight.
+type trafficPeriod struct {
+	from, to time.Duration
+	mode     TrafficMode
+}
+
+type trafficCall struct {
+	at   time.Time
+	mode TrafficMode // the peak the call is typical of, or InterFloor
+}
+
+// NewTraffic returns the traffic mode of a car with the given number of
+// floors. It starts out as inter-floor.
+func NewTraffic(floors int) *Traffic {
+	schedule, err := parseSchedule(settings.TrafficSchedule)
+	if err != nil {
+		errorlog.Println(err)
+	}
+	return &Traffic{
+		floors:   floors,
+		schedule: schedule,
+		seen:     make(map[Request]bool),
+	}
+}
+
+// parseSchedule reads a schedule of periods like "07:30-09:30 up-peak",
+// separated by commas.
+func parseSchedule(s string) ([]trafficPeriod, error) {
+	var periods []trafficPeriod
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		times := strings.Split(fields[0], "-")
+		if len(fields) != 2 || len(times) != 2 {
+			return nil, fmt.Errorf("Invalid traffic period %q", part)
+		}
+		from, err1 := time.Parse("15:04", times[0])
+		to, err2 := time.Parse("15:04", times[1])
+		mode, ok := parseTrafficMode(fields[1])
+		if err1 != nil || err2 != nil || !ok {
+			return nil, fmt.Errorf("Invalid traffic period %q", part)
+		}
+		periods = append(periods, trafficPeriod{
+			from: time.Duration(from.Hour())*time.Hour + time.Duration(from.Minute())*time.Minute,
+			to:   time.Duration(to.Hour())*time.Hour + time.Duration(to.Minute())*time.Minute,
+			mode: mode,
+		})
+	}
+	return periods, nil
+}
+
+// Mode returns the traffic mode in use.
+func (tr *Traffic) Mode() TrafficMode {
+	return tr.mode
+}
+
+// ObserveHallCalls records the hall calls that are new since the last
+// call.
+func (tr *Traffic) ObserveHallCalls(calls []Request, now time.Time) {
+	lobby := lobbyFloor(tr.floors)
+	seen := make(map[Request]bool)
+	for _, req := range calls {
+		seen[req] = true
+		if tr.seen[req] {
+			continue
+		}
+		switch {
+		case req.Floor == lobby && req.Direction == elev.Up:
+			tr.add(UpPeak, now)
+		case req.Floor > lobby && req.Direction == elev.Down:
+			tr.add(DownPeak, now)
+		default:
+			tr.add(InterFloor, now)
+		}
+	}
+	tr.seen = seen
+}
+
+// ObserveBackup records the cab calls that are new in a backup since the
+// old backup of the same elevator, which may be nil.
+func (tr *Traffic) ObserveBackup(old, bd *msgdata.BackupData, now time.Time) {
+	lobby := lobbyFloor(tr.floors)
+	for floor, on := range bd.Dest {
+		if !on || (old != nil && floor < len(old.Dest) && old.Dest[floor]) {
+			continue
+		}
+		switch {
+		case bd.Floor == lobby && floor > lobby:
+			tr.add(UpPeak, now)
+		case floor == lobby:
+			tr.add(DownPeak, now)
+		default:
+			tr.add(InterFloor, now)
+		}
+	}
+}
+
+func (tr *Traffic) add(mode TrafficMode, now time.Time) {
+	tr.calls = append(tr.calls, trafficCall{at: now, mode: mode})
+}
+
+// detect returns the mode of the schedule at now, or else the mode of
+// the recent calls if the mode is detected.
+func (tr *Traffic) detect(now time.Time) TrafficMode {
+	y, m, d := now.Date()
+	day := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	for _, p := range tr.schedule {
+		if (p.from <= p.to && day >= p.from && day < p.to) ||
+			(p.from > p.to && (day >= p.from || day < p.to)) {
+			return p.mode
+		}
+	}
+
+	for len(tr.calls) > 0 && now.Sub(tr.calls[0].at) > trafficWindow {
+		tr.calls = tr.calls[1:]
+	}
+	if settings.Traffic != "auto" || len(tr.calls) < trafficMinCalls {
+		return InterFloor
+	}
+
+	var count [3]int
+	for _, c := range tr.calls {
+		count[c.mode]++
+	}
+	for _, mode := range []TrafficMode{UpPeak, DownPeak} {
+		if float64(count[mode]) >= peakShare*float64(len(tr.calls)) {
+			return mode
+		}
+	}
+	return InterFloor
+}
+
+// Update picks the traffic mode, if this elevator is the one to pick
+// it, and sends it to the other elevators. An elevator on its own picks
+// its own mode.
+func (tr *Traffic) Update(node *network.Node, mode ServiceMode, now time.Time) {
+	if mode != Local && !lowestAddr(node) && now.Sub(tr.heard) < modeTimeout {
+		return
+	}
+
+	if m := tr.detect(now); m != tr.mode {
+		debug.Printf("Traffic mode %v, was %v.\n", m, tr.mode)
+		tr.mode = m
+	}
+	if mode != Local {
+		md := msgdata.ModeData{Elevator: node.Addr(), Mode: int(tr.mode)}
+		sendData(node, msgdata.MODE, &md)
+	}
+}
+
+// Heard sets the traffic mode picked by another elevator. A mode from an
+// elevator with a higher address than this one is ignored, since this
+// elevator picks the mode before it.
+func (tr *Traffic) Heard(node *network.Node, md *msgdata.ModeData, now time.Time) {
+	me := node.Addr()
+	if bytes.Compare(md.Elevator[:], me[:]) > 0 {
+		return
+	}
+	if m := TrafficMode(md.Mode); m != tr.mode {
+		debug.Printf("Traffic mode %v from %v, was %v.\n", m, md.Elevator, tr.mode)
+		tr.mode = m
+	}
+	tr.heard = now
+}
+
+// favours returns true if req is a call the traffic mode gives weight
+// to: up from the lobby in up-peak, and down in down-peak.
+func (tr *Traffic) favours(req Request) bool {
+	switch tr.mode {
+	case UpPeak:
+		return req.Floor == lobbyFloor(tr.floors) && req.Direction == elev.Up
+	case DownPeak:
+		return req.Direction == elev.Down
+	}
+	return false
+}
+
+// Cost returns the cost for e to serve req, as if the pending requests
+// were assigned to it as well. In a peak, the delay req would cause the
+// calls of e the mode favours is added, weighted by peakWeight, so cars
+// with such calls are less likely to win other calls. The simulations
+// all run on the elevator goroutine at once, so they see the same car.
+func (tr *Traffic) Cost(e *Elevator, req Request, pending ...Request) (cost float64) {
+	e.do(func() {
+		cost = e.simulateTrip(req, e.costFn, pending...)
+		if tr.mode == InterFloor || tr.favours(req) {
+			return
+		}
+
+		with := append([]Request{req}, pending...)
+		for _, r := range e.oldHallRequests(0) {
+			if !tr.favours(r) {
+				continue
+			}
+			delay := e.simulateTrip(r, e.costFn, with...) - e.simulateTrip(r, e.costFn, pending...)
+			if delay > 0 {
+				cost += (peakWeight - 1) * delay
+			}
+		}
+	})
+	return cost
+}
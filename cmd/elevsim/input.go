@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"elevator-project/pkg/elev"
+)
+
+// Script commands, one per line. Lines starting with # are ignored.
+//
+//	cab 2             press the cab button for floor 2
+//	up 0              press the hall up button at floor 0
+//	down 3            press the hall down button at floor 3
+//	stop              press the stop button
+//	obstruction on    set the obstruction switch (on, off or toggle)
+//	sleep 1.5s        wait before the next command
+func runScript(s *Shaft, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := runCommand(s, line); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return sc.Err()
+}
+
+func runCommand(s *Shaft, line string) error {
+	f := strings.Fields(line)
+	arg := ""
+	if len(f) > 1 {
+		arg = f[1]
+	}
+
+	switch f[0] {
+	case "cab", "up", "down":
+		floor, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("bad floor %q", arg)
+		}
+		b := elev.Command
+		if f[0] == "up" {
+			b = elev.CallUp
+		} else if f[0] == "down" {
+			b = elev.CallDown
+		}
+		return s.Press(b, floor)
+
+	case "stop":
+		s.PressStop()
+
+	case "obstruction":
+		switch arg {
+		case "on":
+			s.SetObstruction(true)
+		case "off":
+			s.SetObstruction(false)
+		case "", "toggle":
+			s.ToggleObstruction()
+		default:
+			return fmt.Errorf("bad obstruction state %q", arg)
+		}
+
+	case "sleep":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+
+	default:
+		return fmt.Errorf("unknown command %q", f[0])
+	}
+	return nil
+}
+
+// Only the ten lowest floors can be reached from the keyboard.
+const keyHelp = "keys: 0-9 cab, u<n> hall up, d<n> hall down, s stop, o obstruction, q quit"
+
+// readKeys reads single key presses from stdin. The terminal is put in
+// cbreak mode if possible, otherwise keys take effect on enter.
+func readKeys(s *Shaft, quit chan<- struct{}) {
+	raw := setCbreak(true)
+
+	r := bufio.NewReader(os.Stdin)
+	var prefix byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+
+		switch {
+		case c >= '0' && c <= '9':
+			b := elev.Command
+			if prefix == 'u' {
+				b = elev.CallUp
+			} else if prefix == 'd' {
+				b = elev.CallDown
+			}
+			if err := s.Press(b, int(c-'0')); err != nil {
+				s.mu.Lock()
+				s.logf("%v", err)
+				s.mu.Unlock()
+			}
+			prefix = 0
+		case c == 'u' || c == 'd' || c == 'c':
+			prefix = c
+		case c == 's':
+			s.PressStop()
+		case c == 'o':
+			s.ToggleObstruction()
+		case c == 'q':
+			if raw {
+				setCbreak(false)
+			}
+			close(quit)
+			return
+		}
+	}
+}
+
+// setCbreak turns line buffering and echo of the terminal on stdin off
+// or on, and reports whether it succeeded.
+func setCbreak(on bool) bool {
+	args := []string{"cbreak", "-echo"}
+	if !on {
+		args = []string{"-cbreak", "echo"}
+	}
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run() == nil
+}
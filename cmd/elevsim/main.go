@@ -0,0 +1,156 @@
+// Elevsim simulates an elevator car and serves it over the TCP protocol
+// used by the simulator driver in pkg/elev, so the whole system can be
+// run without the lab hardware. Every command is four bytes, and the
+// read commands (6-9) are answered with four bytes.
+//
+//	1 dir 0 0          set motor direction (255 down, 0 stop, 1 up)
+//	2 button floor v   set button lamp
+//	3 floor 0 0        set floor indicator
+//	4 v 0 0            set door open lamp
+//	5 v 0 0            set stop lamp
+//	6 button floor 0   read button        -> 6 pressed 0 0
+//	7 0 0 0            read floor sensor  -> 7 atfloor floor 0
+//	8 0 0 0            read stop button   -> 8 pressed 0 0
+//	9 0 0 0            read obstruction   -> 9 active 0 0
+//
+// Buttons are pressed from the keyboard, or from a script given with
+// -script (see runScript for the commands).
+//
+// Examples:
+//
+//	elevsim                          serve on elevator.simulator_port
+//	elevsim -port 15658 -start 1.5   second car, starting between floors
+//	elevsim -script rush.txt -render=false
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"elevator-project/pkg/config"
+	"elevator-project/pkg/elev"
+)
+
+const (
+	defaultPort = 15657
+	stepTime    = 10 * time.Millisecond
+	drawTime    = 100 * time.Millisecond
+)
+
+var (
+	port   = flag.Int("port", 0, "TCP port to serve on. Defaults to elevator.simulator_port in ./config.")
+	floors = flag.Int("floors", elev.DefaultFloors, "Number of floors.")
+	travel = flag.Duration("travel", 1500*time.Millisecond, "Time between floors at full speed.")
+	accel  = flag.Float64("accel", 4, "Acceleration in floors per second squared.")
+	start  = flag.Float64("start", 0, "Start position of the car, in floors.")
+	script = flag.String("script", "", "Run button presses from this file.")
+	render = flag.Bool("render", true, "Draw the shaft in the terminal.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *port == 0 {
+		*port = defaultPort
+		if conf, err := config.LoadFile("./config"); err == nil {
+			if p, err := strconv.Atoi(conf["elevator.simulator_port"]); err == nil {
+				*port = p
+			}
+		}
+	}
+	if *floors < 2 || *floors > elev.MaxFloors {
+		fatal(fmt.Errorf("floors must be between 2 and %d", elev.MaxFloors))
+	}
+	if *start < 0 || *start > float64(*floors-1) {
+		fatal(fmt.Errorf("start position %v is outside the shaft", *start))
+	}
+
+	shaft := NewShaft(*floors, *travel, *accel, *start)
+
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: *port})
+	if err != nil {
+		fatal(err)
+	}
+	go serve(ln, shaft)
+
+	quit := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fatal(err)
+		}
+		go func() {
+			if err := runScript(shaft, f); err != nil {
+				fatal(err)
+			}
+			f.Close()
+		}()
+	} else {
+		go readKeys(shaft, quit)
+	}
+
+	step := time.NewTicker(stepTime)
+	draw := time.NewTicker(drawTime)
+	last := time.Now()
+	for {
+		select {
+		case now := <-step.C:
+			shaft.Step(now.Sub(last))
+			last = now
+		case <-draw.C:
+			if *render {
+				fmt.Print("\x1b[H\x1b[2J")
+				shaft.WriteShaft(os.Stdout)
+			}
+		case <-quit:
+			return
+		case <-interrupt:
+			if *script == "" {
+				setCbreak(false)
+			}
+			return
+		}
+	}
+}
+
+func serve(ln *net.TCPListener, shaft *Shaft) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			fatal(err)
+		}
+		go handle(conn, shaft)
+	}
+}
+
+func handle(conn *net.TCPConn, shaft *Shaft) {
+	addr := conn.RemoteAddr().String()
+	shaft.connected(addr)
+	defer shaft.disconnected(addr)
+	defer conn.Close()
+
+	var cmd [4]byte
+	for {
+		if _, err := io.ReadFull(conn, cmd[:]); err != nil {
+			return
+		}
+		if reply, ok := shaft.Handle(cmd); ok {
+			if _, err := conn.Write(reply[:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"elevator-project/pkg/elev"
+)
+
+// WriteShaft draws the shaft with two rows per floor, the lamps of each
+// floor and the state of the car.
+//
+//	FLOOR        UP DN CAB
+//	  3  = [  ]     .  *
+//	       |  |
+//	  2    |  |  .  .  .
+func (s *Shaft) WriteShaft(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	car := int(math.Floor(s.position*2 + 0.5))
+	if car < 0 {
+		car = 0
+	} else if car > 2*(s.floors-1) {
+		car = 2 * (s.floors - 1)
+	}
+	carStr := "[  ]"
+	if s.doorLamp {
+		carStr = "[||]"
+	}
+
+	fmt.Fprintln(w, "FLOOR        UP DN CAB")
+	for row := 2 * (s.floors - 1); row >= 0; row-- {
+		shaft := "|  |"
+		if row == car {
+			shaft = carStr
+		}
+		if row%2 == 1 {
+			fmt.Fprintf(w, "       %s\n", shaft)
+			continue
+		}
+
+		floor := row / 2
+		fmt.Fprintf(w, " %2d  %s %s  %s  %s  %s\n", floor,
+			sensorMark(floor == s.floorSensor()), shaft,
+			lamp(s.lamps[floor][elev.CallUp], floor == s.floors-1),
+			lamp(s.lamps[floor][elev.CallDown], floor == 0),
+			lamp(s.lamps[floor][elev.Command], false))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "position %.2f  speed %+.2f floors/s  motor %s  indicator %d\n",
+		s.position, s.velocity, dirName(s.motor), s.indicator)
+	fmt.Fprintf(w, "door %s  stop lamp %s  obstruction %s  clients %d\n",
+		onOff(s.doorLamp), onOff(s.stopLamp), onOff(s.obstruction), s.clients)
+	fmt.Fprintln(w)
+	for _, e := range s.events {
+		fmt.Fprintln(w, e)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, keyHelp)
+}
+
+func sensorMark(on bool) string {
+	if on {
+		return "="
+	}
+	return " "
+}
+
+func lamp(on, missing bool) string {
+	switch {
+	case missing:
+		return " "
+	case on:
+		return "*"
+	}
+	return "."
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"elevator-project/pkg/elev"
+)
+
+const (
+	// Half the height of the floor sensor, in floors.
+	sensorWidth = 0.08
+
+	// Room in the shaft below the bottom floor and above the top
+	// floor, in floors.
+	shaftMargin = 0.25
+
+	// How long a button stays pressed after a press.
+	pressDuration = 200 * time.Millisecond
+
+	maxEvents = 6
+)
+
+// Shaft is the physical model of one elevator car and its panel.
+// Positions are measured in floors from the bottom floor.
+type Shaft struct {
+	mu sync.Mutex
+
+	floors int
+	speed  float64 // floors per second at full speed
+	accel  float64 // floors per second squared
+
+	position float64
+	velocity float64
+	motor    elev.Direction
+
+	lamps     [][3]bool
+	indicator int
+	doorLamp  bool
+	stopLamp  bool
+
+	pressed     [][3]time.Time // button held until this time
+	stopPressed time.Time
+	obstruction bool
+
+	clients int
+	events  []string
+}
+
+func NewShaft(floors int, travel time.Duration, accel float64, start float64) *Shaft {
+	return &Shaft{
+		floors:   floors,
+		speed:    1 / travel.Seconds(),
+		accel:    accel,
+		position: start,
+		lamps:    make([][3]bool, floors),
+		pressed:  make([][3]time.Time, floors),
+	}
+}
+
+// Step advances the model by dt.
+func (s *Shaft) Step(dt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := float64(s.motor) * s.speed
+	dv := s.accel * dt.Seconds()
+	switch {
+	case s.velocity < target:
+		s.velocity = math.Min(s.velocity+dv, target)
+	case s.velocity > target:
+		s.velocity = math.Max(s.velocity-dv, target)
+	}
+
+	s.position += s.velocity * dt.Seconds()
+
+	bottom, top := -shaftMargin, float64(s.floors-1)+shaftMargin
+	if s.position < bottom || s.position > top {
+		s.position = math.Max(bottom, math.Min(s.position, top))
+		if s.velocity != 0 {
+			s.logf("Car hit the end of the shaft at %.2f floors/s", math.Abs(s.velocity))
+		}
+		s.velocity = 0
+	}
+}
+
+// floorSensor returns the floor the car is at, or -1 between floors.
+func (s *Shaft) floorSensor() int {
+	f := math.Floor(s.position + 0.5)
+	if math.Abs(s.position-f) <= sensorWidth {
+		return int(f)
+	}
+	return -1
+}
+
+// Press holds a button down long enough for the controller to see it.
+func (s *Shaft) Press(b elev.Button, floor int) error {
+	if floor < 0 || floor >= s.floors {
+		return fmt.Errorf("no floor %d", floor)
+	}
+	if floor == 0 && b == elev.CallDown || floor == s.floors-1 && b == elev.CallUp {
+		return fmt.Errorf("no %s button at floor %d", buttonName(b), floor)
+	}
+	s.mu.Lock()
+	s.pressed[floor][b] = time.Now().Add(pressDuration)
+	s.logf("Pressed %s %d", buttonName(b), floor)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Shaft) PressStop() {
+	s.mu.Lock()
+	s.stopPressed = time.Now().Add(pressDuration)
+	s.logf("Pressed stop")
+	s.mu.Unlock()
+}
+
+func (s *Shaft) SetObstruction(on bool) {
+	s.mu.Lock()
+	s.obstruction = on
+	s.logf("Obstruction %s", onOff(on))
+	s.mu.Unlock()
+}
+
+func (s *Shaft) ToggleObstruction() {
+	s.mu.Lock()
+	on := !s.obstruction
+	s.mu.Unlock()
+	s.SetObstruction(on)
+}
+
+// Handle executes one 4-byte command from a client. Read commands
+// return a reply and true.
+func (s *Shaft) Handle(cmd [4]byte) (reply [4]byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reply[0] = cmd[0]
+	now := time.Now()
+
+	switch cmd[0] {
+	case 1:
+		dir := elev.Direction(int8(cmd[1]))
+		if dir != s.motor {
+			s.logf("Motor %s", dirName(dir))
+		}
+		s.motor = dir
+	case 2:
+		b, floor := int(cmd[1]), int(cmd[2])
+		if b < 3 && floor < s.floors {
+			s.lamps[floor][b] = cmd[3] != 0
+		}
+	case 3:
+		s.indicator = int(cmd[1])
+	case 4:
+		s.doorLamp = cmd[1] != 0
+	case 5:
+		s.stopLamp = cmd[1] != 0
+
+	case 6:
+		b, floor := int(cmd[1]), int(cmd[2])
+		if b < 3 && floor < s.floors && now.Before(s.pressed[floor][b]) {
+			reply[1] = 1
+		}
+		return reply, true
+	case 7:
+		if f := s.floorSensor(); f != -1 {
+			reply[1] = 1
+			reply[2] = byte(f)
+		}
+		return reply, true
+	case 8:
+		if now.Before(s.stopPressed) {
+			reply[1] = 1
+		}
+		return reply, true
+	case 9:
+		if s.obstruction {
+			reply[1] = 1
+		}
+		return reply, true
+
+	default:
+		s.logf("Unknown command %v", cmd)
+	}
+	return reply, false
+}
+
+func (s *Shaft) connected(addr string) {
+	s.mu.Lock()
+	s.clients++
+	s.logf("Client %s connected", addr)
+	s.mu.Unlock()
+}
+
+func (s *Shaft) disconnected(addr string) {
+	s.mu.Lock()
+	s.clients--
+	s.motor = elev.Stop
+	s.logf("Client %s disconnected", addr)
+	s.mu.Unlock()
+}
+
+// logf adds a line to the event log. Must be called with s.mu held.
+func (s *Shaft) logf(format string, v ...interface{}) {
+	line := time.Now().Format("15:04:05.000 ") + fmt.Sprintf(format, v...)
+	if !*render {
+		fmt.Println(line)
+	}
+	s.events = append(s.events, line)
+	if len(s.events) > maxEvents {
+		s.events = s.events[1:]
+	}
+}
+
+func buttonName(b elev.Button) string {
+	switch b {
+	case elev.CallUp:
+		return "up"
+	case elev.CallDown:
+		return "down"
+	}
+	return "cab"
+}
+
+func dirName(d elev.Direction) string {
+	switch d {
+	case elev.Up:
+		return "up"
+	case elev.Down:
+		return "down"
+	}
+	return "stop"
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,321 @@
+// Ringdump prints the messages sent between the elevators in a
+// readable form. It captures live from a network interface, listens
+// on the ring port, or reads pcap files written by tcpdump or by
+// ringdump itself.
+//
+// Examples:
+//
+//	ringdump -i eth0 -t COST,ASSIGN
+//	ringdump -i eth0 -w ring.pcap
+//	ringdump -r ring.pcap -n 129.241.187.152 -v
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"elevator-project/pkg/capture"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+var (
+	iface     = flag.String("i", "", "Capture live on this network interface.")
+	listenUDP = flag.Bool("u", false, "Listen on the ring port instead of capturing.")
+	readFile  = flag.String("r", "", "Read packets from a pcap file.")
+	writeFile = flag.String("w", "", "Also write the shown packets to a pcap file.")
+	types     = flag.String("t", "", "Comma-separated message types to show, by name or number.")
+	node      = flag.String("n", "", "Only show messages to or from this node.")
+	msgID     = flag.Uint64("id", 0, "Only show messages with this ID.")
+	verbose   = flag.Bool("v", false, "Also show PING, ALIVE and ACK messages.")
+	hexdump   = flag.Bool("X", false, "Dump the payload in hex.")
+	noColor   = flag.Bool("nocolor", false, "Do not use colours.")
+)
+
+// Filter for the messages to show.
+type filter struct {
+	types map[network.MsgType]bool
+	node  network.Addr
+	id    uint32
+}
+
+func main() {
+	flag.Parse()
+
+	var src capture.Source
+	var err error
+	switch {
+	case *readFile != "":
+		src, err = capture.OpenFile(*readFile)
+	case *iface != "":
+		src, err = capture.Listen(*iface)
+	case *listenUDP:
+		src, err = capture.ListenUDP()
+	default:
+		fmt.Fprintln(os.Stderr, "ringdump: one of -i, -u or -r is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer src.Close()
+
+	f, err := parseFilter()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var pw *capture.Writer
+	if *writeFile != "" {
+		fd, err := os.Create(*writeFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer fd.Close()
+		pw = capture.NewWriter(fd)
+	}
+
+	for {
+		p, err := src.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		msg, err := network.ParseMessage(p.Payload)
+		if err != nil {
+			fmt.Printf("%s | %s > %s  %v\n", p.Time.Format("15:04:05.000000"),
+				colorAddr(p.From), colorAddr(p.To), err)
+			continue
+		}
+		if !f.match(p, msg) {
+			continue
+		}
+
+		fmt.Println(format(p, msg))
+		if *hexdump {
+			fmt.Print(indent(hex.Dump(p.Payload)))
+		}
+		if pw != nil {
+			if err := pw.WritePacket(p); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func parseFilter() (*filter, error) {
+	f := new(filter)
+
+	if *types != "" {
+		f.types = make(map[network.MsgType]bool)
+		for _, s := range strings.Split(*types, ",") {
+			t, ok := parseType(strings.TrimSpace(s))
+			if !ok {
+				return nil, fmt.Errorf("unknown message type %q", s)
+			}
+			f.types[t] = true
+		}
+	}
+
+	if *node != "" {
+		ip := net.ParseIP(*node)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid node address %q", *node)
+		}
+		copy(f.node[:], ip.To16())
+	}
+
+	f.id = uint32(*msgID)
+	return f, nil
+}
+
+func parseType(s string) (network.MsgType, bool) {
+	if n, err := strconv.ParseUint(s, 0, 32); err == nil {
+		return network.MsgType(n), true
+	}
+	for t := network.MsgType(0); t < 0x20; t++ {
+		if strings.EqualFold(msgdata.TypeName(t), s) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func (f *filter) match(p *capture.Packet, msg *network.Message) bool {
+	if f.types != nil {
+		// A DIRECT matches both its own type and the type it carries.
+		dmsg, ok := msg.Unwrap(p.From)
+		if !f.types[msg.Type] && !(ok && f.types[dmsg.Type]) {
+			return false
+		}
+	} else if !*verbose {
+		switch msg.Type {
+		case network.PING, network.ALIVE, network.ACK:
+			return false
+		}
+	}
+	if !f.node.IsZero() && p.From != f.node && p.To != f.node {
+		return false
+	}
+	if f.id != 0 && msg.ID != f.id {
+		if ackID, ok := msg.Acked(); !ok || ackID != f.id {
+			return false
+		}
+	}
+	return true
+}
+
+func format(p *capture.Packet, msg *network.Message) string {
+	fromTo := fmt.Sprintf("%s > %s", colorAddr(p.From), colorAddr(p.To))
+	pad := 36 - len(fmt.Sprintf("%v > %v", p.From, p.To))
+	if pad < 1 {
+		pad = 1
+	}
+
+	header := fmt.Sprintf("%s | %s%s(id %10d, read_count %2d) %s",
+		p.Time.Format("15:04:05.000000"), fromTo, strings.Repeat(" ", pad),
+		msg.ID, msg.ReadCount, colorType(msg.Type))
+
+	details := describe(p, msg)
+	if details == "" {
+		return header
+	}
+	return header + "\n" + strings.Repeat(" ", 18) + details
+}
+
+// describe decodes the data of a message.
+func describe(p *capture.Packet, msg *network.Message) string {
+	s := describeData(p, msg)
+	if origin, m, ok := msg.Meta(); ok {
+		if s != "" {
+			s += " "
+		}
+		if !origin.IsZero() {
+			s += "origin " + colorAddr(origin) + " "
+		}
+		s += fmt.Sprintf("(name %q, floors %d, version %q, caps %#x)",
+			m.Name, m.Floors, m.Version, m.Caps)
+	}
+	return s
+}
+
+func describeData(p *capture.Packet, msg *network.Message) string {
+	switch msg.Type {
+	case network.HELLO:
+		l, ok := msg.Links()
+		if !ok {
+			return "(truncated)"
+		}
+		return fmt.Sprintf("(new right %s, new left %s, new left2nd %s)",
+			colorAddr(l.Right), colorAddr(l.Left), colorAddr(l.Left2nd))
+	case network.UPDATE:
+		l, ok := msg.Links()
+		if !ok {
+			return "(truncated)"
+		}
+		var s []string
+		if !l.Right.IsZero() {
+			s = append(s, "set right "+colorAddr(l.Right))
+		}
+		if !l.Left.IsZero() {
+			s = append(s, "set left "+colorAddr(l.Left))
+		}
+		if !l.Left2nd.IsZero() {
+			s = append(s, "set left2nd "+colorAddr(l.Left2nd))
+		}
+		return "(" + strings.Join(s, ", ") + ")"
+	case network.KICK:
+		dead, sender, ok := msg.Kicked()
+		if !ok {
+			return "(truncated)"
+		}
+		return fmt.Sprintf("(dead %s, sender %s)", colorAddr(dead), colorAddr(sender))
+	case network.ACK:
+		if id, ok := msg.Acked(); ok {
+			return fmt.Sprintf("(acked %d)", id)
+		}
+		return "(truncated)"
+	case network.DIRECT:
+		dmsg, ok := msg.Unwrap(p.From)
+		if !ok {
+			return "(truncated)"
+		}
+		return colorType(dmsg.Type) + " " + describeUser(dmsg)
+	}
+	if msg.Type >= 16 {
+		return describeUser(msg)
+	}
+	return ""
+}
+
+func describeUser(msg *network.Message) string {
+	data, err := msgdata.Decode(msg.Type, msg.Data)
+	if err != nil {
+		return fmt.Sprintf("(%v, %d bytes)", err, len(msg.Data))
+	}
+	return data.String()
+}
+
+func indent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = "        " + l
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Each node gets its own colour the first time it is seen.
+var (
+	addrColors = make(map[network.Addr]int)
+	nextColor  = 1
+)
+
+func colorAddr(a network.Addr) string {
+	if a.IsZero() {
+		return "*"
+	}
+	if *noColor {
+		return a.String()
+	}
+	c, ok := addrColors[a]
+	if !ok {
+		c = 30 + nextColor
+		nextColor = nextColor%6 + 1
+		addrColors[a] = c
+	}
+	return fmt.Sprintf("\x1b[%dm%v\x1b[m", c, a)
+}
+
+func colorType(t network.MsgType) string {
+	name := msgdata.TypeName(t)
+	if *noColor {
+		return name
+	}
+	switch t {
+	case network.PING, network.ALIVE, network.ACK:
+		return "\x1b[2m" + name + "\x1b[m"
+	case network.KICK:
+		return "\x1b[1;31m" + name + "\x1b[m"
+	case msgdata.COST, msgdata.ASSIGN, msgdata.DISPATCH, msgdata.PARK, msgdata.MODE:
+		return "\x1b[1;33m" + name + "\x1b[m"
+	case msgdata.BACKUP, msgdata.SYNC, msgdata.HALLCALLS:
+		return "\x1b[1;36m" + name + "\x1b[m"
+	}
+	return "\x1b[1m" + name + "\x1b[m"
+}
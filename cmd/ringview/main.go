@@ -0,0 +1,173 @@
+// Ringview shows the current topology of the ring network. It either
+// queries the nodes directly, or rebuilds the ring passively from the
+// HELLO, UPDATE and forwarded messages seen on the network, and flags
+// links that do not agree.
+//
+// Examples:
+//
+//	ringview                         query nodes on the local subnet
+//	ringview -q 129.241.187.255      query a specific broadcast address
+//	sudo ringview -i eth0            listen passively
+//	ringview -r ring.pcap -dot ring.dot
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"elevator-project/pkg/capture"
+	"elevator-project/pkg/network"
+)
+
+var (
+	queryAddr = flag.String("q", "255.255.255.255", "Send queries to this address.")
+	iface     = flag.String("i", "", "Listen passively on this network interface.")
+	listenUDP = flag.Bool("u", false, "Listen passively on the ring port.")
+	readFile  = flag.String("r", "", "Rebuild the ring from a pcap file and exit.")
+	dotFile   = flag.String("dot", "", "Write the ring in Graphviz DOT format to this file.")
+	interval  = flag.Duration("interval", time.Second, "Time between redraws and queries.")
+	expire    = flag.Duration("expire", 3*time.Second, "Forget nodes that are silent for this long.")
+	once      = flag.Bool("once", false, "Draw the ring once and exit.")
+)
+
+type observation struct {
+	from, to network.Addr
+	msg      *network.Message
+	time     time.Time
+}
+
+func main() {
+	flag.Parse()
+
+	topo := NewTopology()
+
+	if *readFile != "" {
+		src, err := capture.OpenFile(*readFile)
+		if err != nil {
+			fatal(err)
+		}
+		var last time.Time
+		for {
+			p, err := src.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fatal(err)
+			}
+			if msg, err := network.ParseMessage(p.Payload); err == nil {
+				topo.Observe(p.From, p.To, msg, p.Time)
+				last = p.Time
+			}
+		}
+		src.Close()
+		show(topo, last)
+		return
+	}
+
+	obs := make(chan observation, 64)
+	var query func()
+
+	switch {
+	case *iface != "" || *listenUDP:
+		var src capture.Source
+		var err error
+		if *iface != "" {
+			src, err = capture.Listen(*iface)
+		} else {
+			src, err = capture.ListenUDP()
+		}
+		if err != nil {
+			fatal(err)
+		}
+		go readSource(src, obs)
+
+	default:
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		if err != nil {
+			fatal(err)
+		}
+		to := &net.UDPAddr{IP: net.ParseIP(*queryAddr), Port: network.UDPPort}
+		if to.IP == nil {
+			fatal(fmt.Errorf("invalid address %q", *queryAddr))
+		}
+		query = func() {
+			var buf [12]byte
+			buf[7] = byte(network.QUERY)
+			conn.WriteToUDP(buf[:], to)
+		}
+		go readReplies(conn, obs)
+	}
+
+	ticker := time.NewTicker(*interval)
+	if query != nil {
+		query()
+	}
+	for {
+		select {
+		case o := <-obs:
+			topo.Observe(o.from, o.to, o.msg, o.time)
+		case now := <-ticker.C:
+			topo.Expire(now.Add(-*expire))
+			if !*once {
+				fmt.Print("\x1b[H\x1b[2J")
+			}
+			show(topo, now)
+			if *once {
+				return
+			}
+			if query != nil {
+				query()
+			}
+		}
+	}
+}
+
+func show(topo *Topology, now time.Time) {
+	topo.WriteASCII(os.Stdout, now)
+	if *dotFile != "" {
+		f, err := os.Create(*dotFile)
+		if err != nil {
+			fatal(err)
+		}
+		topo.WriteDOT(f)
+		f.Close()
+	}
+}
+
+func readSource(src capture.Source, obs chan observation) {
+	for {
+		p, err := src.Next()
+		if err != nil {
+			fatal(err)
+		}
+		if msg, err := network.ParseMessage(p.Payload); err == nil {
+			obs <- observation{p.From, p.To, msg, p.Time}
+		}
+	}
+}
+
+func readReplies(conn *net.UDPConn, obs chan observation) {
+	buf := make([]byte, 256)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fatal(err)
+		}
+		msg, err := network.ParseMessage(buf[:n])
+		if err != nil || msg.Type != network.LINKS {
+			continue
+		}
+		var from network.Addr
+		copy(from[:], raddr.IP.To16())
+		obs <- observation{from: from, msg: msg, time: time.Now()}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"elevator-project/pkg/network"
+)
+
+// WriteASCII draws the ring, the links of each node and the problems
+// found.
+func (t *Topology) WriteASCII(w io.Writer, now time.Time) {
+	if len(t.nodes) == 0 {
+		fmt.Fprintln(w, "No nodes seen.")
+		return
+	}
+
+	ring, closed := t.Ring()
+	names := make([]string, len(ring))
+	for i, a := range ring {
+		names[i] = a.String()
+	}
+	line := strings.Join(names, " --> ")
+
+	fmt.Fprintf(w, "Ring of %d nodes, following left links:\n\n", len(ring))
+	if closed {
+		fmt.Fprintf(w, "  +--> %s --+\n", line)
+		fmt.Fprintf(w, "  |%s|\n", strings.Repeat(" ", len(line)+8))
+		fmt.Fprintf(w, "  +%s+\n", strings.Repeat("-", len(line)+8))
+	} else {
+		fmt.Fprintf(w, "  %s --> ?\n", line)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "  %-16s %-12s %-16s %-16s %-16s %s\n",
+		"NODE", "NAME", "RIGHT", "LEFT", "LEFT2ND", "SEEN")
+	for _, addr := range t.Addrs() {
+		ni := t.nodes[addr]
+		seen := "-"
+		if !ni.lastSeen.IsZero() {
+			seen = fmt.Sprintf("%.1fs ago", now.Sub(ni.lastSeen).Seconds())
+		}
+		fmt.Fprintf(w, "  %-16s %-12s %-16s %-16s %-16s %s\n", addr, ni.name,
+			addrOrNone(ni.links.Right), addrOrNone(ni.links.Left),
+			addrOrNone(ni.links.Left2nd), seen)
+	}
+
+	problems := t.Check()
+	if len(problems) > 0 {
+		fmt.Fprintln(w)
+		for _, p := range problems {
+			fmt.Fprintf(w, "  \x1b[31m!\x1b[m %s\n", p.Desc)
+		}
+	}
+}
+
+// WriteDOT writes the topology as a Graphviz digraph. Left links are
+// solid, right links dashed and left2nd links dotted. Links involved
+// in a problem are red.
+func (t *Topology) WriteDOT(w io.Writer) {
+	bad := make(map[[2]network.Addr]bool)
+	for _, p := range t.Check() {
+		bad[[2]network.Addr{p.From, p.To}] = true
+	}
+
+	edge := func(from, to network.Addr, style string) {
+		if to.IsZero() {
+			return
+		}
+		attrs := "style=" + style
+		if bad[[2]network.Addr{from, to}] {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(w, "\t%q -> %q [%s];\n", from.String(), to.String(), attrs)
+	}
+
+	fmt.Fprintln(w, "digraph ring {")
+	for _, addr := range t.Addrs() {
+		ni := t.nodes[addr]
+		if bad[[2]network.Addr{addr, addr}] {
+			fmt.Fprintf(w, "\t%q [color=red];\n", addr.String())
+		} else {
+			fmt.Fprintf(w, "\t%q;\n", addr.String())
+		}
+		edge(addr, ni.links.Left, "solid")
+		edge(addr, ni.links.Right, "dashed")
+		edge(addr, ni.links.Left2nd, "dotted")
+	}
+	fmt.Fprintln(w, "}")
+}
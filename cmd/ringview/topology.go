@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"elevator-project/pkg/network"
+)
+
+// nodeInfo is what is known about a single node.
+type nodeInfo struct {
+	addr     network.Addr
+	name     string
+	links    network.Links
+	lastSeen time.Time
+}
+
+// Topology is rebuilt from the messages seen on the network.
+type Topology struct {
+	nodes map[network.Addr]*nodeInfo
+}
+
+func NewTopology() *Topology {
+	return &Topology{nodes: make(map[network.Addr]*nodeInfo)}
+}
+
+func (t *Topology) node(addr network.Addr) *nodeInfo {
+	ni, ok := t.nodes[addr]
+	if !ok {
+		ni = &nodeInfo{addr: addr}
+		t.nodes[addr] = ni
+	}
+	return ni
+}
+
+// Observe updates the topology with a message sent from one node to
+// another at time now.
+func (t *Topology) Observe(from, to network.Addr, msg *network.Message, now time.Time) {
+	if from.IsZero() {
+		return
+	}
+	t.node(from).lastSeen = now
+
+	if origin, m, ok := msg.Meta(); ok {
+		if origin.IsZero() {
+			origin = from
+		}
+		t.node(origin).name = m.Name
+	}
+
+	switch msg.Type {
+	case network.LINKS:
+		// The complete links of the sender.
+		if l, ok := msg.Links(); ok {
+			t.node(from).links = l
+		}
+
+	case network.HELLO:
+		// The receiver will use the links in the HELLO when it
+		// connects.
+		if l, ok := msg.Links(); ok && !to.IsZero() {
+			t.node(to).links = l
+		}
+
+	case network.UPDATE:
+		if l, ok := msg.Links(); ok && !to.IsZero() {
+			ni := t.node(to)
+			if !l.Right.IsZero() {
+				ni.links.Right = l.Right
+			}
+			if !l.Left.IsZero() {
+				ni.links.Left = l.Left
+			}
+			if !l.Left2nd.IsZero() {
+				ni.links.Left2nd = l.Left2nd
+			}
+		}
+
+	case network.KICK:
+		if dead, _, ok := msg.Kicked(); ok {
+			delete(t.nodes, dead)
+		}
+
+	default:
+		// Messages around the ring are always forwarded to the left
+		// node, and only accepted from the right node.
+		if msg.Type >= 16 && !to.IsZero() {
+			t.node(from).links.Left = to
+			t.node(to).links.Right = from
+		}
+	}
+}
+
+// Expire forgets nodes that have not sent anything since before.
+func (t *Topology) Expire(before time.Time) {
+	for addr, ni := range t.nodes {
+		if !ni.lastSeen.IsZero() && ni.lastSeen.Before(before) {
+			delete(t.nodes, addr)
+		}
+	}
+}
+
+// Addrs returns the addresses of all known nodes in sorted order.
+func (t *Topology) Addrs() []network.Addr {
+	addrs := make([]network.Addr, 0, len(t.nodes))
+	for addr := range t.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
+
+// Ring follows the left links from the lowest address and returns the
+// nodes in the order messages travel. ok is false if the links do not
+// lead back to the first node.
+func (t *Topology) Ring() (ring []network.Addr, ok bool) {
+	addrs := t.Addrs()
+	if len(addrs) == 0 {
+		return nil, false
+	}
+
+	visited := make(map[network.Addr]bool)
+	for a := addrs[0]; ; {
+		ring = append(ring, a)
+		visited[a] = true
+
+		ni, known := t.nodes[a]
+		if !known || ni.links.Left.IsZero() {
+			return ring, false
+		}
+		a = ni.links.Left
+		if a == addrs[0] {
+			return ring, true
+		}
+		if visited[a] {
+			return ring, false
+		}
+	}
+}
+
+// Problem is an inconsistency between the links of two nodes.
+type Problem struct {
+	From, To network.Addr
+	Desc     string
+}
+
+// Check returns the inconsistencies in the topology.
+func (t *Topology) Check() []Problem {
+	var problems []Problem
+
+	for _, addr := range t.Addrs() {
+		l := t.nodes[addr].links
+		if l.Left.IsZero() && l.Right.IsZero() {
+			problems = append(problems, Problem{addr, addr,
+				fmt.Sprintf("%v has no known links", addr)})
+			continue
+		}
+
+		// Links that have not been seen yet are not checked.
+		if !l.Left.IsZero() {
+			left, ok := t.nodes[l.Left]
+			switch {
+			case !ok:
+				problems = append(problems, Problem{addr, l.Left,
+					fmt.Sprintf("%v.left=%v, which is unknown", addr, l.Left)})
+			case left.links.Right != addr:
+				problems = append(problems, Problem{addr, l.Left,
+					fmt.Sprintf("%v.left=%v but %v.right=%v", addr, l.Left,
+						l.Left, addrOrNone(left.links.Right))})
+			case !l.Left2nd.IsZero() && left.links.Left != l.Left2nd:
+				problems = append(problems, Problem{addr, l.Left2nd,
+					fmt.Sprintf("%v.left2nd=%v but %v.left=%v", addr, l.Left2nd,
+						l.Left, addrOrNone(left.links.Left))})
+			}
+		}
+
+		if !l.Right.IsZero() {
+			right, ok := t.nodes[l.Right]
+			switch {
+			case !ok:
+				problems = append(problems, Problem{addr, l.Right,
+					fmt.Sprintf("%v.right=%v, which is unknown", addr, l.Right)})
+			case right.links.Left != addr:
+				problems = append(problems, Problem{addr, l.Right,
+					fmt.Sprintf("%v.right=%v but %v.left=%v", addr, l.Right,
+						l.Right, addrOrNone(right.links.Left))})
+			}
+		}
+	}
+
+	ring, _ := t.Ring()
+	if len(ring) < len(t.nodes) {
+		inRing := make(map[network.Addr]bool)
+		for _, a := range ring {
+			inRing[a] = true
+		}
+		for _, addr := range t.Addrs() {
+			if !inRing[addr] {
+				problems = append(problems, Problem{addr, addr,
+					fmt.Sprintf("%v is not in the ring through %v", addr, ring[0])})
+			}
+		}
+	}
+
+	return problems
+}
+
+func addrOrNone(a network.Addr) string {
+	if a.IsZero() {
+		return "none"
+	}
+	return a.String()
+}
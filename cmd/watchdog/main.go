@@ -14,7 +14,7 @@ import (
 	"time"
 
 	"elevator-project/pkg/config"
-	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
 )
 
 var infolog *log.Logger
@@ -84,14 +84,14 @@ func main() {
 
 const (
 	aliveTime  = 250 * time.Millisecond
-	backupSize = 34 + 3*elev.NumFloors
+	backupSize = msgdata.MaxBackupSize
 )
 
 type Watchdog struct {
 	conn   *net.UnixConn
 	proto  *exec.Cmd
 	cmd    *exec.Cmd
-	backup [backupSize]byte
+	backup []byte // latest backup, empty before the first
 
 	backupfile     *os.File
 	backupfilepath string
@@ -112,7 +112,7 @@ func (wd *Watchdog) Restart() {
 	// BUG(larskr): If there is a message in the watchdog socket waiting in the
 	// watchdog socket from the previous elevator process, it will read the ready
 	// message immediately and try to write to the elevator socket before it exists.
-	
+
 	// Wait for ready message.
 	var buf [16]byte
 	wd.conn.SetReadDeadline(time.Time{})
@@ -122,7 +122,7 @@ func (wd *Watchdog) Restart() {
 	}
 
 	// Send backup to elevator.
-	_, err = wd.conn.WriteToUnix(wd.backup[:], wd.elevator)
+	_, err = wd.conn.WriteToUnix(wd.backup, wd.elevator)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -131,10 +131,11 @@ func (wd *Watchdog) Restart() {
 func (wd *Watchdog) Flush() error {
 	wd.backupfile.Seek(0, os.SEEK_SET)
 
-	_, err := wd.backupfile.Write(wd.backup[:])
+	_, err := wd.backupfile.Write(wd.backup)
 	if err != nil {
 		return nil
 	}
+	wd.backupfile.Truncate(int64(len(wd.backup)))
 
 	wd.backupfile.Sync()
 
@@ -154,11 +155,13 @@ func (wd *Watchdog) Run() error {
 	}
 
 	if fi.Size() != 0 {
-		n, err := fd.Read(wd.backup[:])
-		if err != nil && n != backupSize {
+		buf := make([]byte, backupSize)
+		n, err := fd.Read(buf)
+		if err != nil {
 			fmt.Println(err)
 			return err
 		}
+		wd.backup = buf[:n]
 	}
 
 	wd.Restart()
@@ -172,7 +175,7 @@ func (wd *Watchdog) Run() error {
 		default:
 			wd.conn.SetReadDeadline(time.Now().Add(aliveTime))
 
-			_, _, err := wd.conn.ReadFromUnix(buf[:])
+			n, _, err := wd.conn.ReadFromUnix(buf[:])
 			if err != nil {
 				if wd.cmd.Process != nil {
 					wd.cmd.Process.Signal(syscall.SIGINT)
@@ -184,8 +187,9 @@ func (wd *Watchdog) Run() error {
 				continue
 			}
 
-			if !bytes.Equal(wd.backup[32:], buf[32:]) {
-				wd.backup = buf
+			// Skip the address and time when comparing.
+			if n < 32 || len(wd.backup) < 32 || !bytes.Equal(wd.backup[32:], buf[32:n]) {
+				wd.backup = append(wd.backup[:0], buf[:n]...)
 				wd.Flush()
 			}
 		}
@@ -1,25 +1,37 @@
+//go:build ignore
 // +build ignore
 
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 )
 
 func main() {
+	comedi := flag.Bool("comedi", true, "build with the comedi hardware driver (needs cgo and libcomedi)")
+	flag.Parse()
+
 	buildGoPath := os.Getenv("GOPATH")
 	if buildGoPath == "" {
 		fmt.Println("Cannot run make.go without GOPATH set.")
 		os.Exit(1)
 	}
 
-	targets := []string{"./bin/elevator", "./bin/watchdog"}
-	srcs := []string{"./cmd/elevator", "./cmd/watchdog"}
+	targets := []string{"./bin/elevator", "./bin/watchdog", "./bin/ringdump",
+		"./bin/ringview", "./bin/elevsim"}
+	srcs := []string{"./cmd/elevator", "./cmd/watchdog", "./cmd/ringdump",
+		"./cmd/ringview", "./cmd/elevsim"}
+
+	tags := ""
+	if *comedi {
+		tags = "comedi"
+	}
 
 	for i := range targets {
-		cmd := exec.Command("go", "build", "-o", targets[i], srcs[i])
+		cmd := exec.Command("go", "build", "-tags", tags, "-o", targets[i], srcs[i])
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
 		err := cmd.Run()
@@ -0,0 +1,125 @@
+// Package capture reads the UDP datagrams sent between the nodes of a
+// ring network, either live from a network interface or from pcap
+// files. It is used by the debugging tools and does not depend on cgo
+// or libpcap.
+package capture
+
+import (
+	"encoding/binary"
+	"time"
+
+	"elevator-project/pkg/network"
+)
+
+// Packet is a UDP datagram sent to or from network.UDPPort.
+type Packet struct {
+	Time    time.Time
+	From    network.Addr
+	To      network.Addr
+	Payload []byte
+}
+
+// A Source returns captured packets one at a time. Next returns io.EOF
+// when there are no more packets.
+type Source interface {
+	Next() (*Packet, error)
+	Close() error
+}
+
+// Link-layer header types used in pcap files.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// parseFrame extracts a ring datagram from a link-layer frame. It
+// returns false if the frame is not UDP on network.UDPPort.
+func parseFrame(linkType uint32, frame []byte, t time.Time) (*Packet, bool) {
+	var ethType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		ethType = binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		// Skip VLAN tag.
+		if ethType == 0x8100 && len(frame) >= 4 {
+			ethType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		ethType = binary.BigEndian.Uint16(frame[14:])
+		frame = frame[16:]
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		// Address family in host byte order; 2 is AF_INET.
+		if frame[0] != 2 && frame[3] != 2 {
+			return nil, false
+		}
+		ethType = 0x0800
+		frame = frame[4:]
+	case linkTypeRaw:
+		ethType = 0x0800
+	default:
+		return nil, false
+	}
+
+	if ethType != 0x0800 {
+		return nil, false
+	}
+	return parseIPv4(frame, t)
+}
+
+func parseIPv4(b []byte, t time.Time) (*Packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || total < ihl+8 || total > len(b) {
+		return nil, false
+	}
+	// Fragments are not reassembled. Ring messages are far smaller
+	// than the MTU.
+	if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return nil, false
+	}
+	if b[9] != 17 { // UDP
+		return nil, false
+	}
+
+	udp := b[ihl:total]
+	srcPort := binary.BigEndian.Uint16(udp[0:])
+	dstPort := binary.BigEndian.Uint16(udp[2:])
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if srcPort != network.UDPPort && dstPort != network.UDPPort {
+		return nil, false
+	}
+	if length < 8 || length > len(udp) {
+		return nil, false
+	}
+
+	p := &Packet{Time: t}
+	p.From = ipv4Addr(b[12:16])
+	p.To = ipv4Addr(b[16:20])
+	p.Payload = append([]byte(nil), udp[8:length]...)
+	return p, true
+}
+
+// ipv4Addr converts an IPv4 address to the IPv4-in-IPv6 form used by
+// network.Addr.
+func ipv4Addr(ip []byte) network.Addr {
+	var a network.Addr
+	a[10] = 0xff
+	a[11] = 0xff
+	copy(a[12:], ip)
+	return a
+}
@@ -0,0 +1,57 @@
+package capture
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// ETH_P_ALL in network byte order.
+const ethPAll = 0x0300
+
+type liveSource struct {
+	fd  int
+	buf [pcapSnapLen]byte
+}
+
+// Listen captures every ring datagram seen on the network interface,
+// including datagrams between other nodes if the switch forwards them
+// to this port. It uses a packet socket, which requires CAP_NET_RAW.
+func Listen(iface string) (Source, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, ethPAll)
+	if err != nil {
+		return nil, err
+	}
+
+	sll := &syscall.SockaddrLinklayer{Protocol: ethPAll, Ifindex: ifi.Index}
+	if err := syscall.Bind(fd, sll); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &liveSource{fd: fd}, nil
+}
+
+func (s *liveSource) Next() (*Packet, error) {
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, s.buf[:], 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := parseFrame(linkTypeEthernet, s.buf[:n], time.Now()); ok {
+			return p, nil
+		}
+	}
+}
+
+func (s *liveSource) Close() error {
+	return syscall.Close(s.fd)
+}
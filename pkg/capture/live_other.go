@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import (
+	"errors"
+)
+
+func Listen(iface string) (Source, error) {
+	return nil, errors.New("Live capture is only supported on Linux.")
+}
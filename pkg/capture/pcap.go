@@ -0,0 +1,159 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"elevator-project/pkg/network"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapHeaderSize = 24
+	pcapRecordSize = 16
+	pcapSnapLen    = 65535
+)
+
+type fileSource struct {
+	f        *os.File
+	r        *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+}
+
+// OpenFile opens a pcap file, as written by tcpdump -w or by Writer.
+// Packets that are not ring datagrams are skipped.
+func OpenFile(name string) (Source, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSource{f: f, r: bufio.NewReader(f)}
+
+	var hdr [pcapHeaderSize]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr[:]) == pcapMagic:
+		s.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[:]) == pcapMagic:
+		s.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[:]) == pcapMagicNano:
+		s.order, s.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[:]) == pcapMagicNano:
+		s.order, s.nano = binary.BigEndian, true
+	default:
+		f.Close()
+		return nil, errors.New("Not a pcap file.")
+	}
+	s.linkType = s.order.Uint32(hdr[20:])
+
+	return s, nil
+}
+
+func (s *fileSource) Next() (*Packet, error) {
+	var hdr [pcapRecordSize]byte
+	for {
+		// The file ends at a record boundary with io.EOF. Anything
+		// else is a truncated or unreadable record.
+		if _, err := io.ReadFull(s.r, hdr[:]); err == io.EOF {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("Truncated pcap record: %v", err)
+		}
+		sec := int64(s.order.Uint32(hdr[0:]))
+		frac := int64(s.order.Uint32(hdr[4:]))
+		inclLen := s.order.Uint32(hdr[8:])
+		if inclLen > pcapSnapLen {
+			return nil, errors.New("Corrupt pcap record.")
+		}
+
+		frame := make([]byte, inclLen)
+		if _, err := io.ReadFull(s.r, frame); err != nil {
+			return nil, fmt.Errorf("Truncated pcap record: %v", err)
+		}
+
+		if !s.nano {
+			frac *= 1000
+		}
+		if p, ok := parseFrame(s.linkType, frame, time.Unix(sec, frac)); ok {
+			return p, nil
+		}
+	}
+}
+
+func (s *fileSource) Close() error {
+	return s.f.Close()
+}
+
+// Writer writes packets to a pcap file with raw IPv4 link type.
+type Writer struct {
+	w      io.Writer
+	header bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WritePacket writes the packet with synthesized IPv4 and UDP headers.
+func (pw *Writer) WritePacket(p *Packet) error {
+	if !pw.header {
+		var hdr [pcapHeaderSize]byte
+		binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+		if _, err := pw.w.Write(hdr[:]); err != nil {
+			return err
+		}
+		pw.header = true
+	}
+
+	n := 28 + len(p.Payload)
+	buf := make([]byte, pcapRecordSize+n)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(p.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(n))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(n))
+
+	ip := buf[pcapRecordSize:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(n))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], p.From[12:])
+	copy(ip[16:20], p.To[12:])
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:20]))
+
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], network.UDPPort)
+	binary.BigEndian.PutUint16(udp[2:], network.UDPPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(p.Payload)))
+	copy(udp[8:], p.Payload)
+
+	_, err := pw.w.Write(buf)
+	return err
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,47 @@
+package capture
+
+import (
+	"net"
+	"time"
+
+	"elevator-project/pkg/network"
+)
+
+type udpSource struct {
+	conn *net.UDPConn
+	buf  [pcapSnapLen]byte
+}
+
+// ListenUDP listens on the ring port like a node does. It only sees
+// broadcasts and datagrams sent to this machine, but needs no special
+// privileges. It fails if a node is running on the same machine.
+func ListenUDP() (Source, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP:   net.IPv4zero,
+		Port: network.UDPPort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &udpSource{conn: conn}, nil
+}
+
+func (s *udpSource) Next() (*Packet, error) {
+	for {
+		n, raddr, err := s.conn.ReadFromUDP(s.buf[:])
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		p := &Packet{Time: time.Now()}
+		copy(p.From[:], raddr.IP.To16())
+		p.Payload = append([]byte(nil), s.buf[:n]...)
+		return p, nil
+	}
+}
+
+func (s *udpSource) Close() error {
+	return s.conn.Close()
+}
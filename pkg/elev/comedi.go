@@ -0,0 +1,153 @@
+//go:build comedi
+// +build comedi
+
+package elev
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The lab hardware has four floors.
+const comediFloors = 4
+
+var (
+	lampMatrix = [comediFloors][3]int{
+		{LIGHT_UP1, LIGHT_DOWN1, LIGHT_COMMAND1},
+		{LIGHT_UP2, LIGHT_DOWN2, LIGHT_COMMAND2},
+		{LIGHT_UP3, LIGHT_DOWN3, LIGHT_COMMAND3},
+		{LIGHT_UP4, LIGHT_DOWN4, LIGHT_COMMAND4},
+	}
+
+	buttonMatrix = [comediFloors][3]int{
+		{BUTTON_UP1, BUTTON_DOWN1, BUTTON_COMMAND1},
+		{BUTTON_UP2, BUTTON_DOWN2, BUTTON_COMMAND2},
+		{BUTTON_UP3, BUTTON_DOWN3, BUTTON_COMMAND3},
+		{BUTTON_UP4, BUTTON_DOWN4, BUTTON_COMMAND4},
+	}
+)
+
+// Comedi drives the elevator hardware in the lab through comedilib.
+// There is only one set of hardware, so there should only be one
+// Comedi driver.
+type Comedi struct {
+	motorSpeed int
+}
+
+func NewComedi(motorSpeed int) *Comedi {
+	return &Comedi{motorSpeed: motorSpeed}
+}
+
+func newComediDriver(motorSpeed, floors int) (Driver, error) {
+	if floors != comediFloors {
+		return nil, fmt.Errorf("The elevator hardware has %d floors, not %d.",
+			comediFloors, floors)
+	}
+	return NewComedi(motorSpeed), nil
+}
+
+func (c *Comedi) Init() error {
+	ret := InitIO()
+	if ret == 0 {
+		return errors.New("Unable to initalize elevator hardware.")
+	}
+
+	for f := 0; f < comediFloors; f++ {
+		c.SetButtonLamp(CallUp, f, 0)
+		c.SetButtonLamp(CallDown, f, 0)
+		c.SetButtonLamp(Command, f, 0)
+	}
+
+	c.SetStopLamp(0)
+	c.SetDoorOpenLamp(0)
+	c.SetFloorIndicator(0)
+
+	return nil
+}
+
+func (c *Comedi) Floors() int {
+	return comediFloors
+}
+
+func (c *Comedi) SetMotorDirection(dir Direction) error {
+	switch dir {
+	case Stop:
+		WriteAnalog(MOTOR, 0)
+	case Up:
+		ClearBit(MOTORDIR)
+		WriteAnalog(MOTOR, c.motorSpeed)
+	case Down:
+		SetBit(MOTORDIR)
+		WriteAnalog(MOTOR, c.motorSpeed)
+
+	}
+	return nil
+}
+
+func (c *Comedi) SetButtonLamp(b Button, floor int, val int) error {
+	if val == 1 {
+		SetBit(lampMatrix[floor][int(b)])
+	} else {
+		ClearBit(lampMatrix[floor][int(b)])
+	}
+	return nil
+}
+
+func (c *Comedi) SetFloorIndicator(floor int) error {
+	if floor&0x02 != 0 {
+		SetBit(LIGHT_FLOOR_IND1)
+	} else {
+		ClearBit(LIGHT_FLOOR_IND1)
+	}
+	if floor&0x01 != 0 {
+		SetBit(LIGHT_FLOOR_IND2)
+	} else {
+		ClearBit(LIGHT_FLOOR_IND2)
+	}
+	return nil
+}
+
+func (c *Comedi) SetDoorOpenLamp(val int) error {
+	if val == 1 {
+		SetBit(LIGHT_DOOR_OPEN)
+	} else {
+		ClearBit(LIGHT_DOOR_OPEN)
+	}
+	return nil
+}
+
+func (c *Comedi) SetStopLamp(val int) error {
+	if val == 1 {
+		SetBit(LIGHT_STOP)
+	} else {
+		ClearBit(LIGHT_STOP)
+	}
+	return nil
+}
+
+func (c *Comedi) ReadButton(b Button, floor int) (int, error) {
+	return ReadBit(buttonMatrix[floor][int(b)]), nil
+}
+
+func (c *Comedi) ReadFloorSensor() (int, error) {
+	switch {
+	case ReadBit(SENSOR_FLOOR1) == 1:
+		return 0, nil
+	case ReadBit(SENSOR_FLOOR2) == 1:
+		return 1, nil
+	case ReadBit(SENSOR_FLOOR3) == 1:
+		return 2, nil
+	case ReadBit(SENSOR_FLOOR4) == 1:
+		return 3, nil
+	default:
+		return -1, nil
+	}
+}
+
+func (c *Comedi) ReadStopButton() (int, error) {
+	return ReadBit(STOP), nil
+}
+
+func (c *Comedi) ReadObstruction() (int, error) {
+	return ReadBit(OBSTRUCTION), nil
+}
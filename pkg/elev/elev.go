@@ -2,14 +2,19 @@ package elev
 
 import (
 	"errors"
-	"net"
-	"sync"
+	"fmt"
+	"os"
 	"strconv"
+	"time"
 )
 
-// Hardware constants
 const (
-	NumFloors = 4
+	// Number of floors if none is configured.
+	DefaultFloors = 4
+
+	// Largest number of floors. A backup of an elevator with this many
+	// floors still fits in one ring message.
+	MaxFloors = 48
 )
 
 type Direction int
@@ -28,222 +33,109 @@ const (
 	Command  Button = 2
 )
 
-var (
-	lampMatrix = [NumFloors][3]int{
-		{LIGHT_UP1, LIGHT_DOWN1, LIGHT_COMMAND1},
-		{LIGHT_UP2, LIGHT_DOWN2, LIGHT_COMMAND2},
-		{LIGHT_UP3, LIGHT_DOWN3, LIGHT_COMMAND3},
-		{LIGHT_UP4, LIGHT_DOWN4, LIGHT_COMMAND4},
-	}
-
-	buttonMatrix = [NumFloors][3]int{
-		{BUTTON_UP1, BUTTON_DOWN1, BUTTON_COMMAND1},
-		{BUTTON_UP2, BUTTON_DOWN2, BUTTON_COMMAND2},
-		{BUTTON_UP3, BUTTON_DOWN3, BUTTON_COMMAND3},
-		{BUTTON_UP4, BUTTON_DOWN4, BUTTON_COMMAND4},
-	}
-)
-
-var sim struct {
-	mu   sync.Mutex
-	conn *net.TCPConn
-	buf  [4]byte
+// Driver is the interface to the elevator hardware. There is one
+// Driver for each elevator car. An error means the hardware could not
+// be reached, and the elevator should be treated as out of order.
+type Driver interface {
+	Init() error
+	Floors() int
+
+	SetMotorDirection(dir Direction) error
+	SetButtonLamp(b Button, floor int, val int) error
+	SetFloorIndicator(floor int) error
+	SetDoorOpenLamp(val int) error
+	SetStopLamp(val int) error
+
+	ReadButton(b Button, floor int) (int, error)
+	ReadFloorSensor() (int, error) // -1 between floors
+	ReadStopButton() (int, error)
+	ReadObstruction() (int, error)
 }
 
 type Config struct {
+	Driver        string // comedi, simulator or mock
+	Floors        int
 	MotorSpeed    int
 	UseSimulator  bool
 	SimulatorPort int
 	SimulatorIP   string
+	Debounce      time.Duration
+	Record        string // file to record the inputs and outputs to
 }
 
 var config Config
 
 func LoadConfig(conf map[string]string) {
+	config.Driver = conf["elevator.driver"]
+	config.Floors, _ = strconv.Atoi(conf["elevator.floors"])
+	if config.Floors == 0 {
+		config.Floors = DefaultFloors
+	}
 	config.MotorSpeed, _ = strconv.Atoi(conf["elevator.motor_speed"])
 	config.SimulatorPort, _ = strconv.Atoi(conf["elevator.simulator_port"])
 	config.SimulatorIP = conf["elevator.simulator_ip"]
+	config.Debounce, _ = time.ParseDuration(conf["elevator.debounce"])
+	config.Record = conf["elevator.record"]
 	if conf["elevator.use_simulator"] == "true" {
 		config.UseSimulator = true
 	}
 }
 
-func Init() error {
-	if config.UseSimulator {
-		addr := &net.TCPAddr{
-			IP:   net.ParseIP(config.SimulatorIP),
-			Port: config.SimulatorPort,
-		}
-		c, err := net.DialTCP("tcp4", nil, addr)
-		if err != nil {
-			return err
-		}
-		sim.mu.Lock()
-		sim.conn = c
-		//sim.conn.Write(sim.buf[:])
-		sim.mu.Unlock()
-		return nil
-	}
-
-	ret := InitIO()
-	if ret == 0 {
-		return errors.New("Unable to initalize elevator hardware.")
-	}
-
-	for f := 0; f < NumFloors; f++ {
-		SetButtonLamp(CallUp, f, 0)
-		SetButtonLamp(CallDown, f, 0)
-		SetButtonLamp(Command, f, 0)
-	}
-
-	SetStopLamp(0)
-	SetDoorOpenLamp(0)
-	SetFloorIndicator(0)
-
-	return nil
+// NewDriver returns the driver chosen in the config. If no driver is
+// chosen, use_simulator decides between the simulator and comedi. If a
+// record file is set, the driver is wrapped in a Recorder.
+func NewDriver() (Driver, error) {
+	return NewCarDriver(0)
 }
 
-func SetMotorDirection(dir Direction) {
-	if config.UseSimulator {
-		switch dir {
-		case Down:
-			sim.conn.Write([]byte{1, 255, 0, 0})
-		case Stop:
-			sim.conn.Write([]byte{1, 0, 0, 0})
-		case Up:
-			sim.conn.Write([]byte{1, 1, 0, 0})
+// NewCarDriver returns the driver of car number car, counted from 0, in
+// a process that runs several cars. Each car talks to the simulator on
+// its own port, simulator_port + car, and records to its own file. There
+// is only one comedi card, so only car 0 can use it.
+func NewCarDriver(car int) (Driver, error) {
+	if config.Floors < 2 || config.Floors > MaxFloors {
+		return nil, fmt.Errorf("Number of floors must be between 2 and %d, not %d.",
+			MaxFloors, config.Floors)
+	}
+
+	driver := config.Driver
+	if driver == "" {
+		driver = "comedi"
+		if config.UseSimulator {
+			driver = "simulator"
 		}
-		return
-	}
-
-	switch dir {
-	case Stop:
-		WriteAnalog(MOTOR, 0)
-	case Up:
-		ClearBit(MOTORDIR)
-		WriteAnalog(MOTOR, config.MotorSpeed)
-	case Down:
-		SetBit(MOTORDIR)
-		WriteAnalog(MOTOR, config.MotorSpeed)
-
-	}
-}
-
-func SetButtonLamp(b Button, floor int, val int) {
-	if config.UseSimulator {
-		sim.conn.Write([]byte{2, byte(b), byte(floor), byte(val)})
-		return
 	}
 
-	if val == 1 {
-		SetBit(lampMatrix[floor][int(b)])
-	} else {
-		ClearBit(lampMatrix[floor][int(b)])
-	}
-}
-
-func SetFloorIndicator(floor int) {
-	if config.UseSimulator {
-		sim.conn.Write([]byte{3, byte(floor), 0, 0})
-		return
-	}
-
-	if floor&0x02 != 0 {
-		SetBit(LIGHT_FLOOR_IND1)
-	} else {
-		ClearBit(LIGHT_FLOOR_IND1)
-	}
-	if floor&0x01 != 0 {
-		SetBit(LIGHT_FLOOR_IND2)
-	} else {
-		ClearBit(LIGHT_FLOOR_IND2)
-	}
-}
-
-func SetDoorOpenLamp(val int) {
-	if config.UseSimulator {
-		sim.conn.Write([]byte{4, byte(val), 0, 0})
-		return
-	}
-
-	if val == 1 {
-		SetBit(LIGHT_DOOR_OPEN)
-	} else {
-		ClearBit(LIGHT_DOOR_OPEN)
-	}
-}
-
-func SetStopLamp(val int) {
-	if config.UseSimulator {
-		sim.conn.Write([]byte{5, byte(val), 0, 0})
-		return
-	}
-
-	if val == 1 {
-		SetBit(LIGHT_STOP)
-	} else {
-		ClearBit(LIGHT_STOP)
-	}
-}
-
-func ReadButton(b Button, floor int) int {
-	if config.UseSimulator {
-		sim.mu.Lock()
-		sim.conn.Write([]byte{6, byte(b), byte(floor), 0})
-		sim.conn.Read(sim.buf[:])
-		defer sim.mu.Unlock()
-		return int(sim.buf[1])
-	}
-
-	return ReadBit(buttonMatrix[floor][int(b)])
-}
-
-func ReadFloorSensor() int {
-	if config.UseSimulator {
-		sim.mu.Lock()
-		sim.conn.Write([]byte{7, 0, 0, 0})
-		sim.conn.Read(sim.buf[:])
-		defer sim.mu.Unlock()
-		if sim.buf[1] == 1 {
-			return int(sim.buf[2])
+	var drv Driver
+	switch driver {
+	case "comedi":
+		if car != 0 {
+			return nil, fmt.Errorf("Car %d can not use comedi, only car 0 can.", car)
 		}
-		return -1
-	}
-
-	switch {
-	case ReadBit(SENSOR_FLOOR1) == 1:
-		return 0
-	case ReadBit(SENSOR_FLOOR2) == 1:
-		return 1
-	case ReadBit(SENSOR_FLOOR3) == 1:
-		return 2
-	case ReadBit(SENSOR_FLOOR4) == 1:
-		return 3
+		var err error
+		drv, err = newComediDriver(config.MotorSpeed, config.Floors)
+		if err != nil {
+			return nil, err
+		}
+	case "simulator":
+		drv = NewSimulator(config.SimulatorIP, config.SimulatorPort+car, config.Floors)
+	case "mock":
+		drv = NewMock(config.Floors)
 	default:
-		return -1
-	}
-}
-
-func ReadStopButton() int {
-	if config.UseSimulator {
-		sim.mu.Lock()
-		sim.conn.Write([]byte{8, 0, 0, 0})
-		sim.conn.Read(sim.buf[:])
-		sim.mu.Unlock()
-		return int(sim.buf[1])
+		return nil, errors.New("Unknown elevator driver " + strconv.Quote(driver) + ".")
 	}
 
-	return ReadBit(STOP)
-}
-
-func ReadObstruction() int {
-	if config.UseSimulator {
-		sim.mu.Lock()
-		sim.conn.Write([]byte{9, 0, 0, 0})
-		sim.conn.Read(sim.buf[:])
-		sim.mu.Unlock()
-		return int(sim.buf[1])
+	// The recording is appended to, so an earlier run is kept.
+	if config.Record != "" {
+		name := config.Record
+		if car != 0 {
+			name += "." + strconv.Itoa(car)
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		drv = NewRecorder(drv, f)
 	}
-
-	return ReadBit(OBSTRUCTION)
+	return drv, nil
 }
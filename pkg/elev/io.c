@@ -1,3 +1,6 @@
+//go:build comedi
+// +build comedi
+
 #include <comedilib.h>
 
 #include "io.h"
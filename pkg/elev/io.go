@@ -1,3 +1,6 @@
+//go:build comedi
+// +build comedi
+
 package elev
 
 /*
@@ -0,0 +1,193 @@
+package elev
+
+import (
+	"sync"
+)
+
+// Mock is an in-memory driver for tests. The inputs are set with the
+// Press, SetFloor, SetStop and SetObstruction methods, and the outputs
+// written by the controller can be inspected. SetError makes every
+// call fail.
+type Mock struct {
+	mu  sync.Mutex
+	err error
+
+	// Inputs
+	buttons     [][3]int
+	floor       int
+	stop        int
+	obstruction int
+
+	// Outputs
+	motor     Direction
+	lamps     [][3]int
+	indicator int
+	doorLamp  int
+	stopLamp  int
+}
+
+// NewMock returns a mock elevator standing at the bottom floor.
+func NewMock(floors int) *Mock {
+	return &Mock{
+		buttons: make([][3]int, floors),
+		lamps:   make([][3]int, floors),
+	}
+}
+
+func (m *Mock) Init() error {
+	return nil
+}
+
+func (m *Mock) Floors() int {
+	return len(m.buttons)
+}
+
+func (m *Mock) SetMotorDirection(dir Direction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.motor = dir
+	return nil
+}
+
+func (m *Mock) SetButtonLamp(b Button, floor int, val int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.lamps[floor][b] = val
+	return nil
+}
+
+func (m *Mock) SetFloorIndicator(floor int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.indicator = floor
+	return nil
+}
+
+func (m *Mock) SetDoorOpenLamp(val int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.doorLamp = val
+	return nil
+}
+
+func (m *Mock) SetStopLamp(val int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.stopLamp = val
+	return nil
+}
+
+func (m *Mock) ReadButton(b Button, floor int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	return m.buttons[floor][b], nil
+}
+
+func (m *Mock) ReadFloorSensor() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return -1, m.err
+	}
+	return m.floor, nil
+}
+
+func (m *Mock) ReadStopButton() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	return m.stop, nil
+}
+
+func (m *Mock) ReadObstruction() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	return m.obstruction, nil
+}
+
+// SetError makes every driver call return err, or work again if err
+// is nil.
+func (m *Mock) SetError(err error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+// Press sets a button to pressed (1) or released (0).
+func (m *Mock) Press(b Button, floor int, val int) {
+	m.mu.Lock()
+	m.buttons[floor][b] = val
+	m.mu.Unlock()
+}
+
+// SetFloor sets the floor sensor. Use -1 for between floors.
+func (m *Mock) SetFloor(floor int) {
+	m.mu.Lock()
+	m.floor = floor
+	m.mu.Unlock()
+}
+
+func (m *Mock) SetStop(val int) {
+	m.mu.Lock()
+	m.stop = val
+	m.mu.Unlock()
+}
+
+func (m *Mock) SetObstruction(val int) {
+	m.mu.Lock()
+	m.obstruction = val
+	m.mu.Unlock()
+}
+
+func (m *Mock) Motor() Direction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.motor
+}
+
+func (m *Mock) Lamp(b Button, floor int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lamps[floor][b]
+}
+
+func (m *Mock) FloorIndicator() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.indicator
+}
+
+func (m *Mock) DoorOpenLamp() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.doorLamp
+}
+
+func (m *Mock) StopLamp() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopLamp
+}
@@ -0,0 +1,14 @@
+//go:build !comedi
+// +build !comedi
+
+package elev
+
+import (
+	"errors"
+)
+
+// Without the comedi build tag there is no cgo and no libcomedi, so
+// only the simulator and mock drivers are available.
+func newComediDriver(motorSpeed, floors int) (Driver, error) {
+	return nil, errors.New("Built without comedi support. Rebuild with -tags comedi.")
+}
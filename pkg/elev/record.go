@@ -0,0 +1,133 @@
+package elev
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recorder wraps a driver and writes a log of its inputs and outputs,
+// which can be played back with Replay. Each line holds the time since
+// Init in seconds, the name of the input or output and its arguments,
+// and the value:
+//
+//	# 2024-03-01T14:02:11+01:00
+//	floors 4
+//	0.000 floor = 1
+//	0.412 button 2 3 = 1
+//	0.436 motor 1
+//	0.436 lamp 2 3 1
+//	1.210 stop ! Not connected to elevator simulator.
+//
+// Reads are only logged when the value changes, since the inputs are
+// polled all the time. A failed read is logged with ! and the error.
+type Recorder struct {
+	drv Driver
+
+	mu     sync.Mutex
+	w      io.Writer
+	start  time.Time
+	inputs map[string]string // last logged value of each input
+}
+
+func NewRecorder(drv Driver, w io.Writer) *Recorder {
+	return &Recorder{
+		drv:    drv,
+		w:      w,
+		inputs: make(map[string]string),
+	}
+}
+
+func (r *Recorder) Init() error {
+	r.mu.Lock()
+	r.start = time.Now()
+	fmt.Fprintf(r.w, "# %s\nfloors %d\n", r.start.Format(time.RFC3339), r.drv.Floors())
+	r.mu.Unlock()
+	return r.drv.Init()
+}
+
+func (r *Recorder) Floors() int {
+	return r.drv.Floors()
+}
+
+// output logs a write to an output.
+func (r *Recorder) output(name string, args ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.w, "%.3f %s\n", time.Since(r.start).Seconds(), join(name, args))
+}
+
+// input logs a read of an input if the value changed.
+func (r *Recorder) input(val int, err error, name string, args ...int) {
+	key := join(name, args)
+	v := "= " + strconv.Itoa(val)
+	if err != nil {
+		v = "! " + err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.inputs[key]; ok && last == v {
+		return
+	}
+	r.inputs[key] = v
+	fmt.Fprintf(r.w, "%.3f %s %s\n", time.Since(r.start).Seconds(), key, v)
+}
+
+func join(name string, args []int) string {
+	for _, a := range args {
+		name += " " + strconv.Itoa(a)
+	}
+	return name
+}
+
+func (r *Recorder) SetMotorDirection(dir Direction) error {
+	r.output("motor", int(dir))
+	return r.drv.SetMotorDirection(dir)
+}
+
+func (r *Recorder) SetButtonLamp(b Button, floor int, val int) error {
+	r.output("lamp", int(b), floor, val)
+	return r.drv.SetButtonLamp(b, floor, val)
+}
+
+func (r *Recorder) SetFloorIndicator(floor int) error {
+	r.output("indicator", floor)
+	return r.drv.SetFloorIndicator(floor)
+}
+
+func (r *Recorder) SetDoorOpenLamp(val int) error {
+	r.output("door", val)
+	return r.drv.SetDoorOpenLamp(val)
+}
+
+func (r *Recorder) SetStopLamp(val int) error {
+	r.output("stoplamp", val)
+	return r.drv.SetStopLamp(val)
+}
+
+func (r *Recorder) ReadButton(b Button, floor int) (int, error) {
+	val, err := r.drv.ReadButton(b, floor)
+	r.input(val, err, "button", int(b), floor)
+	return val, err
+}
+
+func (r *Recorder) ReadFloorSensor() (int, error) {
+	val, err := r.drv.ReadFloorSensor()
+	r.input(val, err, "floor")
+	return val, err
+}
+
+func (r *Recorder) ReadStopButton() (int, error) {
+	val, err := r.drv.ReadStopButton()
+	r.input(val, err, "stop")
+	return val, err
+}
+
+func (r *Recorder) ReadObstruction() (int, error) {
+	val, err := r.drv.ReadObstruction()
+	r.input(val, err, "obstruction")
+	return val, err
+}
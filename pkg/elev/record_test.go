@@ -0,0 +1,64 @@
+package elev
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var log bytes.Buffer
+	drv := NewMock(DefaultFloors)
+	r := NewRecorder(drv, &log)
+	r.Init()
+
+	r.ReadFloorSensor()
+	drv.Press(Command, 2, 1)
+	r.ReadButton(Command, 2)
+	r.ReadButton(Command, 2)
+	r.SetButtonLamp(Command, 2, 1)
+	r.SetMotorDirection(Up)
+	r.SetMotorDirection(Up)
+	drv.SetError(errors.New("disconnected"))
+	r.ReadStopButton()
+
+	if n := strings.Count(log.String(), "button 2 2 = 1"); n != 1 {
+		t.Errorf("button read logged %d times, want once:\n%s", n, log.String())
+	}
+
+	rp, err := NewReplay(strings.NewReader(log.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.Floors() != DefaultFloors {
+		t.Errorf("floors = %d, want %d", rp.Floors(), DefaultFloors)
+	}
+	rp.Init()
+	select {
+	case <-rp.Done():
+	case <-time.After(rp.Length() + time.Second):
+		t.Fatal("replay not done")
+	}
+
+	if v, _ := rp.ReadFloorSensor(); v != 0 {
+		t.Errorf("floor = %d, want 0", v)
+	}
+	if v, _ := rp.ReadButton(Command, 2); v != 1 {
+		t.Errorf("cab button 2 = %d, want 1", v)
+	}
+	if _, err := rp.ReadStopButton(); err == nil || err.Error() != "disconnected" {
+		t.Errorf("stop button error = %v, want disconnected", err)
+	}
+
+	// The outputs are checked against the recording.
+	rp.SetButtonLamp(Command, 2, 1)
+	if err := rp.Check(); err == nil {
+		t.Error("missing motor output not reported")
+	}
+	rp.SetMotorDirection(Up)
+	if err := rp.Check(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,250 @@
+package elev
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replay is a driver that plays back a log written by Recorder. The
+// inputs take the recorded values at the recorded times after Init.
+// The outputs are collected, and Check compares them with the
+// recorded ones.
+//
+// The outputs are compared per lamp, indicator and motor, and repeated
+// writes of the same value are ignored, so a replay does not fail
+// because two goroutines wrote their outputs in a different order.
+type Replay struct {
+	floors int
+	length time.Duration
+
+	inputs map[string][]replayInput
+	want   map[string][]string
+
+	mu    sync.Mutex
+	start time.Time
+	got   map[string][]string
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+type replayInput struct {
+	at  time.Duration
+	val int
+	err error
+}
+
+// NewReplay reads a log written by Recorder. The log must hold a single
+// run, starting with the floors line.
+func NewReplay(r io.Reader) (*Replay, error) {
+	rp := &Replay{
+		inputs: make(map[string][]replayInput),
+		want:   make(map[string][]string),
+		got:    make(map[string][]string),
+		done:   make(chan struct{}),
+	}
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		if err := rp.parse(sc.Text()); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if rp.floors < 2 || rp.floors > MaxFloors {
+		return nil, errors.New("Recording has no valid floors line.")
+	}
+
+	for _, in := range rp.inputs {
+		sort.SliceStable(in, func(i, j int) bool { return in[i].at < in[j].at })
+	}
+	return rp, nil
+}
+
+func (rp *Replay) parse(line string) error {
+	f := strings.Fields(line)
+	if len(f) == 0 || f[0][0] == '#' {
+		return nil
+	}
+	if f[0] == "floors" && len(f) == 2 {
+		if rp.floors != 0 {
+			return errors.New("more than one run in recording")
+		}
+		n, err := strconv.Atoi(f[1])
+		rp.floors = n
+		return err
+	}
+	if len(f) < 3 {
+		return fmt.Errorf("bad entry %q", line)
+	}
+
+	sec, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return err
+	}
+	at := time.Duration(sec * float64(time.Second))
+	if at > rp.length {
+		rp.length = at
+	}
+
+	// Inputs have = or ! before the value.
+	for i := 2; i < len(f); i++ {
+		key := strings.Join(f[1:i], " ")
+		switch f[i] {
+		case "=":
+			if i != len(f)-2 {
+				return fmt.Errorf("bad input %q", line)
+			}
+			val, err := strconv.Atoi(f[i+1])
+			if err != nil {
+				return err
+			}
+			rp.inputs[key] = append(rp.inputs[key], replayInput{at: at, val: val})
+			return nil
+		case "!":
+			msg := strings.Join(f[i+1:], " ")
+			rp.inputs[key] = append(rp.inputs[key], replayInput{at: at, err: errors.New(msg)})
+			return nil
+		}
+	}
+
+	key := strings.Join(f[1:len(f)-1], " ")
+	rp.want[key] = appendChange(rp.want[key], f[len(f)-1])
+	return nil
+}
+
+// appendChange appends val to vals unless it is the same as the last.
+func appendChange(vals []string, val string) []string {
+	if len(vals) > 0 && vals[len(vals)-1] == val {
+		return vals
+	}
+	return append(vals, val)
+}
+
+// Length returns the time from the start of the recording to the last
+// entry.
+func (rp *Replay) Length() time.Duration {
+	return rp.length
+}
+
+// Done returns a channel that is closed when the replay has reached the
+// end of the recording, so every input has its last recorded value.
+func (rp *Replay) Done() <-chan struct{} {
+	return rp.done
+}
+
+// Check returns an error describing the outputs that differ from the
+// recording, or nil if they all match.
+func (rp *Replay) Check() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	keys := make(map[string]bool)
+	for k := range rp.want {
+		keys[k] = true
+	}
+	for k := range rp.got {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diffs []string
+	for _, k := range sorted {
+		want, got := rp.want[k], rp.got[k]
+		if strings.Join(want, " ") != strings.Join(got, " ") {
+			diffs = append(diffs, fmt.Sprintf("%s: got %v, want %v", k, got, want))
+		}
+	}
+	if diffs != nil {
+		return errors.New("Replay differs from recording:\n\t" + strings.Join(diffs, "\n\t"))
+	}
+	return nil
+}
+
+func (rp *Replay) Init() error {
+	rp.mu.Lock()
+	rp.start = time.Now()
+	rp.mu.Unlock()
+	time.AfterFunc(rp.length, func() {
+		rp.doneOnce.Do(func() { close(rp.done) })
+	})
+	return nil
+}
+
+func (rp *Replay) Floors() int {
+	return rp.floors
+}
+
+func (rp *Replay) output(name string, args ...int) error {
+	key := join(name, args[:len(args)-1])
+	val := strconv.Itoa(args[len(args)-1])
+
+	rp.mu.Lock()
+	rp.got[key] = appendChange(rp.got[key], val)
+	rp.mu.Unlock()
+	return nil
+}
+
+// input returns the recorded value of an input at the current time.
+// Inputs that have not been recorded yet read as def.
+func (rp *Replay) input(def int, name string, args ...int) (int, error) {
+	rp.mu.Lock()
+	now := time.Since(rp.start)
+	rp.mu.Unlock()
+
+	in := rp.inputs[join(name, args)]
+	i := sort.Search(len(in), func(i int) bool { return in[i].at > now })
+	if i == 0 {
+		return def, nil
+	}
+	return in[i-1].val, in[i-1].err
+}
+
+func (rp *Replay) SetMotorDirection(dir Direction) error {
+	return rp.output("motor", int(dir))
+}
+
+func (rp *Replay) SetButtonLamp(b Button, floor int, val int) error {
+	return rp.output("lamp", int(b), floor, val)
+}
+
+func (rp *Replay) SetFloorIndicator(floor int) error {
+	return rp.output("indicator", floor)
+}
+
+func (rp *Replay) SetDoorOpenLamp(val int) error {
+	return rp.output("door", val)
+}
+
+func (rp *Replay) SetStopLamp(val int) error {
+	return rp.output("stoplamp", val)
+}
+
+func (rp *Replay) ReadButton(b Button, floor int) (int, error) {
+	return rp.input(0, "button", int(b), floor)
+}
+
+func (rp *Replay) ReadFloorSensor() (int, error) {
+	return rp.input(-1, "floor")
+}
+
+func (rp *Replay) ReadStopButton() (int, error) {
+	return rp.input(0, "stop")
+}
+
+func (rp *Replay) ReadObstruction() (int, error) {
+	return rp.input(0, "obstruction")
+}
@@ -0,0 +1,282 @@
+package elev
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	scanInterval    = 10 * time.Millisecond
+	defaultDebounce = 30 * time.Millisecond
+
+	// Events are dropped if a subscriber falls this far behind.
+	subscriberBuffer = 64
+)
+
+type EventType int
+
+const (
+	ButtonPressed EventType = iota
+	FloorReached
+	FloorLeft
+	StopPressed
+	ObstructionChanged
+
+	// InputError is sent once when the driver starts failing. No other
+	// events are sent until it works again.
+	InputError
+)
+
+// Event is a debounced change of an input.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Button Button // ButtonPressed
+	Floor  int    // ButtonPressed, FloorReached and FloorLeft
+	On     bool   // ObstructionChanged
+	Err    error  // InputError
+}
+
+func (ev Event) String() string {
+	switch ev.Type {
+	case ButtonPressed:
+		return fmt.Sprintf("button %d pressed at floor %d", ev.Button, ev.Floor)
+	case FloorReached:
+		return fmt.Sprintf("reached floor %d", ev.Floor)
+	case FloorLeft:
+		return fmt.Sprintf("left floor %d", ev.Floor)
+	case StopPressed:
+		return "stop pressed"
+	case ObstructionChanged:
+		if ev.On {
+			return "obstruction on"
+		}
+		return "obstruction off"
+	case InputError:
+		return fmt.Sprintf("input error: %v", ev.Err)
+	}
+	return fmt.Sprintf("event(%d)", int(ev.Type))
+}
+
+// debouncer holds the stable value of an input. A new raw value is
+// accepted when it has been read for the debounce time.
+type debouncer struct {
+	stable  int
+	pending int
+	since   time.Time
+}
+
+func (d *debouncer) update(raw int, now time.Time, debounce time.Duration) bool {
+	if raw == d.stable {
+		d.pending = raw
+		return false
+	}
+	if raw != d.pending {
+		d.pending = raw
+		d.since = now
+	}
+	if now.Sub(d.since) >= debounce {
+		d.stable = raw
+		return true
+	}
+	return false
+}
+
+type subscriber struct {
+	ch    chan Event
+	types map[EventType]bool
+}
+
+// Scanner reads all inputs of a driver and sends events for the
+// debounced changes to its subscribers.
+type Scanner struct {
+	// Time an input must be stable before a change is accepted. Set
+	// before Start.
+	Debounce time.Duration
+
+	drv Driver
+
+	mu      sync.Mutex
+	subs    []subscriber
+	failing bool
+
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	buttons     [][3]debouncer
+	floor       debouncer
+	stop        debouncer
+	obstruction debouncer
+}
+
+// NewScanner returns a scanner for drv with the debounce time from the
+// config.
+func NewScanner(drv Driver) *Scanner {
+	s := &Scanner{
+		Debounce: config.Debounce,
+		drv:      drv,
+		buttons:  make([][3]debouncer, drv.Floors()),
+		quit:     make(chan struct{}),
+	}
+	if s.Debounce == 0 {
+		s.Debounce = defaultDebounce
+	}
+	return s
+}
+
+// Subscribe returns a channel with the events of the given types, or
+// all events if no types are given.
+func (s *Scanner) Subscribe(types ...EventType) <-chan Event {
+	sub := subscriber{ch: make(chan Event, subscriberBuffer)}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool)
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+	return sub.ch
+}
+
+// Start reads the initial state of the inputs, which does not cause any
+// events, and starts scanning.
+func (s *Scanner) Start() error {
+	f, err := s.drv.ReadFloorSensor()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.floor = debouncer{stable: f, pending: f}
+	s.mu.Unlock()
+
+	go s.run()
+	return nil
+}
+
+// Floor returns the debounced floor sensor, or -1 between floors.
+func (s *Scanner) Floor() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.floor.stable
+}
+
+// Obstruction returns true if the debounced obstruction switch is on.
+func (s *Scanner) Obstruction() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.obstruction.stable != 0
+}
+
+// Stop stops the scanning. It may be called more than once.
+func (s *Scanner) Stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
+
+func (s *Scanner) run() {
+	ticker := time.NewTicker(scanInterval)
+	defer ticker.Stop()
+	for {
+		s.scan(time.Now())
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scanner) scan(now time.Time) {
+	var events []Event
+	err := s.read(now, &events)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		if !s.failing {
+			s.failing = true
+			s.publish(Event{Type: InputError, Time: now, Err: err})
+		}
+		return
+	}
+	s.failing = false
+	for _, ev := range events {
+		s.publish(ev)
+	}
+}
+
+// read reads every input once and appends the accepted changes to
+// events. The debouncers are only touched by the scanning goroutine,
+// except the floor and the obstruction, which are guarded by s.mu.
+func (s *Scanner) read(now time.Time, events *[]Event) error {
+	top := len(s.buttons) - 1
+	for floor := 0; floor <= top; floor++ {
+		for b := CallUp; b <= Command; b++ {
+			if floor == 0 && b == CallDown || floor == top && b == CallUp {
+				continue
+			}
+			v, err := s.drv.ReadButton(b, floor)
+			if err != nil {
+				return err
+			}
+			if s.buttons[floor][b].update(v, now, s.Debounce) && v != 0 {
+				*events = append(*events, Event{Type: ButtonPressed, Time: now, Button: b, Floor: floor})
+			}
+		}
+	}
+
+	f, err := s.drv.ReadFloorSensor()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	prev := s.floor.stable
+	changed := s.floor.update(f, now, s.Debounce)
+	s.mu.Unlock()
+	if changed {
+		if prev != -1 {
+			*events = append(*events, Event{Type: FloorLeft, Time: now, Floor: prev})
+		}
+		if f != -1 {
+			*events = append(*events, Event{Type: FloorReached, Time: now, Floor: f})
+		}
+	}
+
+	v, err := s.drv.ReadStopButton()
+	if err != nil {
+		return err
+	}
+	if s.stop.update(v, now, s.Debounce) && v != 0 {
+		*events = append(*events, Event{Type: StopPressed, Time: now})
+	}
+
+	v, err = s.drv.ReadObstruction()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	changed = s.obstruction.update(v, now, s.Debounce)
+	s.mu.Unlock()
+	if changed {
+		*events = append(*events, Event{Type: ObstructionChanged, Time: now, On: v != 0})
+	}
+	return nil
+}
+
+// publish sends ev to the subscribers that want it, without blocking.
+// Must be called with s.mu held.
+func (s *Scanner) publish(ev Event) {
+	for _, sub := range s.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package elev
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScannerDebounce(t *testing.T) {
+	drv := NewMock(DefaultFloors)
+	s := NewScanner(drv)
+	s.Debounce = 30 * time.Millisecond
+	events := s.Subscribe(ButtonPressed, FloorLeft, FloorReached)
+	t0 := time.Now()
+
+	// A short glitch is ignored.
+	drv.Press(Command, 2, 1)
+	s.scan(t0)
+	drv.Press(Command, 2, 0)
+	s.scan(t0.Add(10 * time.Millisecond))
+	drv.Press(Command, 2, 1)
+	s.scan(t0.Add(20 * time.Millisecond))
+	s.scan(t0.Add(40 * time.Millisecond))
+	if len(events) != 0 {
+		t.Fatalf("got %v for a glitch", <-events)
+	}
+
+	s.scan(t0.Add(50 * time.Millisecond))
+	ev := <-events
+	if ev.Type != ButtonPressed || ev.Button != Command || ev.Floor != 2 {
+		t.Errorf("got %v, want cab button at floor 2", ev)
+	}
+
+	drv.SetFloor(-1)
+	s.scan(t0.Add(100 * time.Millisecond))
+	s.scan(t0.Add(200 * time.Millisecond))
+	if ev := <-events; ev.Type != FloorLeft || ev.Floor != 0 {
+		t.Errorf("got %v, want left floor 0", ev)
+	}
+	if s.Floor() != -1 {
+		t.Errorf("Floor() = %d, want -1", s.Floor())
+	}
+}
+
+func TestScannerError(t *testing.T) {
+	drv := NewMock(DefaultFloors)
+	s := NewScanner(drv)
+	events := s.Subscribe(InputError)
+
+	drv.SetError(errors.New("disconnected"))
+	s.scan(time.Now())
+	s.scan(time.Now())
+	if len(events) != 1 {
+		t.Errorf("got %d error events, want 1", len(events))
+	}
+}
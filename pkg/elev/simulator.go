@@ -0,0 +1,217 @@
+package elev
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed for one command and its reply.
+	simTimeout = 500 * time.Millisecond
+
+	// Time to wait before redialing after the connection is lost. The
+	// wait doubles after each failed attempt.
+	simMinBackoff = 100 * time.Millisecond
+	simMaxBackoff = 5 * time.Second
+)
+
+var errSimNotConnected = errors.New("Not connected to elevator simulator.")
+
+// Simulator talks to an elevator simulator over TCP. Every command is
+// four bytes, and the read commands are answered with four bytes.
+//
+// If the connection fails, the command returns an error and the
+// connection is redialed on a later command, after a backoff. The
+// motor, lamps and indicators are restored when the connection is back,
+// so a car that was moving goes on moving.
+type Simulator struct {
+	addr   *net.TCPAddr
+	floors int
+
+	mu       sync.Mutex
+	conn     *net.TCPConn
+	backoff  time.Duration
+	nextDial time.Time
+	lastErr  error
+
+	// Last command sent for the motor and each lamp and indicator.
+	outputs map[[3]byte][4]byte
+}
+
+func NewSimulator(ip string, port int, floors int) *Simulator {
+	return &Simulator{
+		addr: &net.TCPAddr{
+			IP:   net.ParseIP(ip),
+			Port: port,
+		},
+		floors:  floors,
+		outputs: make(map[[3]byte][4]byte),
+	}
+}
+
+func (s *Simulator) Floors() int {
+	return s.floors
+}
+
+func (s *Simulator) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dial()
+}
+
+// dial connects to the simulator. Must be called with s.mu held.
+func (s *Simulator) dial() error {
+	c, err := net.DialTCP("tcp4", nil, s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = c
+	s.backoff = 0
+	s.lastErr = nil
+	return nil
+}
+
+// reconnect redials the simulator if the backoff has passed, and sends
+// the saved outputs. Must be called with s.mu held.
+func (s *Simulator) reconnect() error {
+	if time.Now().Before(s.nextDial) {
+		if s.lastErr != nil {
+			return s.lastErr
+		}
+		return errSimNotConnected
+	}
+
+	if err := s.dial(); err != nil {
+		s.fail(err)
+		return err
+	}
+	for _, cmd := range s.outputs {
+		if _, err := s.exchange(cmd, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail closes the connection and schedules the next dial. Must be
+// called with s.mu held.
+func (s *Simulator) fail(err error) {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	switch {
+	case s.backoff == 0:
+		s.backoff = simMinBackoff
+	case s.backoff < simMaxBackoff:
+		s.backoff *= 2
+		if s.backoff > simMaxBackoff {
+			s.backoff = simMaxBackoff
+		}
+	}
+	s.nextDial = time.Now().Add(s.backoff)
+	s.lastErr = err
+}
+
+// exchange sends a command and reads the reply if there is one. Must
+// be called with s.mu held and s.conn set.
+func (s *Simulator) exchange(cmd [4]byte, reply bool) ([4]byte, error) {
+	var buf [4]byte
+
+	s.conn.SetDeadline(time.Now().Add(simTimeout))
+	if _, err := s.conn.Write(cmd[:]); err != nil {
+		s.fail(err)
+		return buf, err
+	}
+	if reply {
+		if _, err := io.ReadFull(s.conn, buf[:]); err != nil {
+			s.fail(err)
+			return buf, err
+		}
+		if buf[0] != cmd[0] {
+			err := errors.New("Unexpected reply from elevator simulator.")
+			s.fail(err)
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+func (s *Simulator) do(cmd [4]byte, reply bool) ([4]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.reconnect(); err != nil {
+			return [4]byte{}, err
+		}
+	}
+	return s.exchange(cmd, reply)
+}
+
+// set sends an output command and saves it so it can be restored
+// after a reconnect.
+func (s *Simulator) set(cmd [4]byte, key [3]byte) error {
+	s.mu.Lock()
+	s.outputs[key] = cmd
+	s.mu.Unlock()
+	_, err := s.do(cmd, false)
+	return err
+}
+
+func (s *Simulator) SetMotorDirection(dir Direction) error {
+	var d byte
+	switch dir {
+	case Down:
+		d = 255
+	case Up:
+		d = 1
+	}
+	return s.set([4]byte{1, d, 0, 0}, [3]byte{1})
+}
+
+func (s *Simulator) SetButtonLamp(b Button, floor int, val int) error {
+	return s.set([4]byte{2, byte(b), byte(floor), byte(val)},
+		[3]byte{2, byte(b), byte(floor)})
+}
+
+func (s *Simulator) SetFloorIndicator(floor int) error {
+	return s.set([4]byte{3, byte(floor), 0, 0}, [3]byte{3})
+}
+
+func (s *Simulator) SetDoorOpenLamp(val int) error {
+	return s.set([4]byte{4, byte(val), 0, 0}, [3]byte{4})
+}
+
+func (s *Simulator) SetStopLamp(val int) error {
+	return s.set([4]byte{5, byte(val), 0, 0}, [3]byte{5})
+}
+
+func (s *Simulator) ReadButton(b Button, floor int) (int, error) {
+	buf, err := s.do([4]byte{6, byte(b), byte(floor), 0}, true)
+	return int(buf[1]), err
+}
+
+func (s *Simulator) ReadFloorSensor() (int, error) {
+	buf, err := s.do([4]byte{7, 0, 0, 0}, true)
+	if err != nil {
+		return -1, err
+	}
+	if buf[1] == 1 {
+		return int(buf[2]), nil
+	}
+	return -1, nil
+}
+
+func (s *Simulator) ReadStopButton() (int, error) {
+	buf, err := s.do([4]byte{8, 0, 0, 0}, true)
+	return int(buf[1]), err
+}
+
+func (s *Simulator) ReadObstruction() (int, error) {
+	buf, err := s.do([4]byte{9, 0, 0, 0}, true)
+	return int(buf[1]), err
+}
@@ -0,0 +1,92 @@
+package elev
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// simCommand is a command received by the fake simulator, on the n-th
+// connection.
+type simCommand struct {
+	n   int
+	cmd [4]byte
+}
+
+// fakeSimulator accepts connections on l, answers the read commands and
+// reports every command on cmds. The server side of each connection is
+// sent on conns.
+func fakeSimulator(l net.Listener, cmds chan<- simCommand, conns chan<- net.Conn) {
+	for n := 0; ; n++ {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns <- c
+		go func(n int, c net.Conn) {
+			var cmd [4]byte
+			for {
+				if _, err := io.ReadFull(c, cmd[:]); err != nil {
+					return
+				}
+				if cmd[0] >= 6 {
+					c.Write([]byte{cmd[0], 0, 0, 0})
+				}
+				cmds <- simCommand{n, cmd}
+			}
+		}(n, c)
+	}
+}
+
+func TestSimulatorReconnect(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := make(chan simCommand, 64)
+	conns := make(chan net.Conn, 4)
+	go fakeSimulator(l, cmds, conns)
+
+	s := NewSimulator("127.0.0.1", l.Addr().(*net.TCPAddr).Port, DefaultFloors)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMotorDirection(Up); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFloorIndicator(2); err != nil {
+		t.Fatal(err)
+	}
+	<-cmds
+	<-cmds
+
+	// The connection drops while the car is moving.
+	(<-conns).Close()
+	if _, err := s.ReadStopButton(); err == nil {
+		t.Fatal("no error from a closed connection")
+	}
+
+	// Once it is back, the motor runs again along with the indicator.
+	time.Sleep(2 * simMinBackoff)
+	if _, err := s.ReadStopButton(); err != nil {
+		t.Fatal(err)
+	}
+	restored := make(map[[4]byte]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case c := <-cmds:
+			if c.n == 1 {
+				restored[c.cmd] = true
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the commands")
+		}
+	}
+	for _, cmd := range [][4]byte{{1, 1, 0, 0}, {3, 2, 0, 0}} {
+		if !restored[cmd] {
+			t.Errorf("command %v not restored", cmd)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package hallcall implements the table of hall calls that every
+// elevator on the ring keeps a replica of. The hall lamps are lit from
+// the table, so all the elevators show the same calls.
+package hallcall
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+// Table is one replica of the hall calls. Each call is a last writer
+// wins register: a change is stamped with the Lamport clock of the node
+// that made it, and a merge keeps the entry with the latest stamp, with
+// ties broken by the node. Merging is commutative, associative and
+// idempotent, so the replicas that have seen the same changes hold the
+// same calls, in whatever order and however many times the changes
+// arrived. The replicas are kept in step by sending the whole table
+// around the ring now and then, so a partition heals by itself.
+type Table struct {
+	mu      sync.Mutex
+	node    uint32
+	clock   uint32
+	entries map[msgdata.Request]msgdata.HallCallEntry
+}
+
+// NewTable returns an empty table for the node at addr.
+//
+// The clock starts at the wall clock in seconds rather than at zero.
+// It only moves on by one for each change, so a node that is restarted
+// has a later clock than the changes made before, and the calls made on
+// it are not lost to them before it has caught up.
+func NewTable(addr network.Addr) *Table {
+	return &Table{
+		node:    nodeID(addr),
+		clock:   uint32(time.Now().Unix()),
+		entries: make(map[msgdata.Request]msgdata.HallCallEntry),
+	}
+}
+
+// nodeID returns the last four bytes of addr, which tell the nodes of a
+// network apart.
+func nodeID(addr network.Addr) uint32 {
+	return uint32(addr[12])<<24 | uint32(addr[13])<<16 | uint32(addr[14])<<8 | uint32(addr[15])
+}
+
+// key returns the hall call of req, without the destination of a
+// keypad call.
+func key(req msgdata.Request) msgdata.Request {
+	return msgdata.Request{Floor: req.Floor, Direction: req.Direction}
+}
+
+// newer returns true if a is a later change than b.
+func newer(a, b msgdata.HallCallEntry) bool {
+	if a.Stamp != b.Stamp {
+		return a.Stamp > b.Stamp
+	}
+	if a.Node != b.Node {
+		return a.Node > b.Node
+	}
+	return a.Set && !b.Set
+}
+
+// Set sets the hall call of req. It returns false if the call was set
+// already.
+func (t *Table) Set(req msgdata.Request) bool {
+	return t.change(key(req), true)
+}
+
+// Clear clears the hall call of req. It returns false if the call was
+// not set.
+func (t *Table) Clear(req msgdata.Request) bool {
+	return t.change(key(req), false)
+}
+
+func (t *Table) change(req msgdata.Request, set bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries[req].Set == set {
+		return false
+	}
+	t.clock++
+	t.entries[req] = msgdata.HallCallEntry{
+		Req:   req,
+		Set:   set,
+		Stamp: t.clock,
+		Node:  t.node,
+	}
+	return true
+}
+
+// IsSet returns true if the hall call of req is set.
+func (t *Table) IsSet(req msgdata.Request) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.entries[key(req)].Set
+}
+
+// Calls returns the hall calls that are set, by floor and then
+// direction.
+func (t *Table) Calls() []msgdata.Request {
+	t.mu.Lock()
+	var reqs []msgdata.Request
+	for req, e := range t.entries {
+		if e.Set {
+			reqs = append(reqs, req)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].Floor != reqs[j].Floor {
+			return reqs[i].Floor < reqs[j].Floor
+		}
+		return reqs[i].Direction == elev.Down && reqs[j].Direction == elev.Up
+	})
+	return reqs
+}
+
+// Merge brings the table up to date with the entries of another
+// replica. It returns true if any call was set or cleared.
+func (t *Table) Merge(hd *msgdata.HallCallData) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := false
+	for _, e := range hd.Entries {
+		if e.Stamp > t.clock {
+			t.clock = e.Stamp
+		}
+		e.Req = key(e.Req)
+		old, ok := t.entries[e.Req]
+		if ok && !newer(e, old) {
+			continue
+		}
+		t.entries[e.Req] = e
+		if e.Set != old.Set {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Gossip returns the whole table, split into as many messages as it
+// takes.
+func (t *Table) Gossip() []*msgdata.HallCallData {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var msgs []*msgdata.HallCallData
+	hd := new(msgdata.HallCallData)
+	for _, e := range t.entries {
+		if len(hd.Entries) == msgdata.MaxHallCallEntries {
+			msgs = append(msgs, hd)
+			hd = new(msgdata.HallCallData)
+		}
+		hd.Entries = append(hd.Entries, e)
+	}
+	if len(hd.Entries) > 0 {
+		msgs = append(msgs, hd)
+	}
+	return msgs
+}
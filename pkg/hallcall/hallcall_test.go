@@ -0,0 +1,212 @@
+package hallcall
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/msgdata"
+	"elevator-project/pkg/network"
+)
+
+const (
+	gossipInterval = 50 * time.Millisecond
+	settleTimeout  = 15 * time.Second
+)
+
+var (
+	up2   = msgdata.Request{Floor: 2, Direction: elev.Up}
+	down3 = msgdata.Request{Floor: 3, Direction: elev.Down}
+	up1   = msgdata.Request{Floor: 1, Direction: elev.Up}
+)
+
+func TestMergeOrder(t *testing.T) {
+	var a, b, c network.Addr
+	a[15], b[15], c[15] = 1, 2, 3
+	ta, tb, tc := NewTable(a), NewTable(b), NewTable(c)
+
+	// Concurrent changes of the same call.
+	ta.Set(up2)
+	tb.Set(up2)
+	tb.Clear(up2)
+	tc.Set(down3)
+	ta.Merge(tc.Gossip()[0])
+	ta.Clear(down3)
+
+	// Every replica ends up with the same calls, in whatever order the
+	// tables arrive, and however many times.
+	gossip := [][]*msgdata.HallCallData{ta.Gossip(), tb.Gossip(), tc.Gossip()}
+	var want []msgdata.Request
+	for i, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0, 1}} {
+		var x network.Addr
+		x[15] = byte(10 + i)
+		tx := NewTable(x)
+		for _, j := range order {
+			for _, hd := range gossip[j] {
+				tx.Merge(hd)
+			}
+		}
+		got := tx.Calls()
+		if i == 0 {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("order %v: calls = %v, want %v", order, got, want)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("calls = %v, want none", want)
+	}
+}
+
+// replica runs a table over a node on the loopback network, the way an
+// elevator does: the table is sent around the ring now and then, and
+// merged by every node it passes.
+type replica struct {
+	tr    network.Transport
+	node  *network.Node
+	table *Table
+}
+
+func startReplica(hub *network.Loopback) *replica {
+	r := &replica{tr: hub.NewTransport()}
+	r.node = network.NewNodeWithTransport(r.tr)
+	r.node.Start()
+	r.table = NewTable(r.node.Addr())
+
+	go func() {
+		for {
+			msg := r.node.ReceiveMessage()
+			if msg.Type == msgdata.HALLCALLS {
+				var hd msgdata.HallCallData
+				if err := hd.UnmarshalBinary(msg.Data); err == nil {
+					r.table.Merge(&hd)
+				}
+			}
+			r.node.ForwardMessage(msg)
+		}
+	}()
+	go func() {
+		for {
+			r.node.ReceiveMyMessage()
+		}
+	}()
+	go func() {
+		for {
+			r.node.GetDeadNode()
+		}
+	}()
+	go func() {
+		for range time.Tick(gossipInterval) {
+			// Like the elevators, only send while on a ring. A node
+			// that is cut off takes its own messages timing out as
+			// a sign to start over, and would never join again.
+			if !r.node.IsConnected() {
+				continue
+			}
+			for _, hd := range r.table.Gossip() {
+				buf, _ := hd.MarshalBinary()
+				r.node.SendMessage(network.NewMessage(msgdata.HALLCALLS, buf))
+			}
+		}
+	}()
+	return r
+}
+
+// eventually polls cond until it is true, and fails the test if it is
+// not true within settleTimeout.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(gossipInterval)
+	}
+}
+
+// ring waits until the replicas form one ring.
+func ring(t *testing.T, rs ...*replica) {
+	eventually(t, "the ring", func() bool {
+		for _, r := range rs {
+			if !r.node.IsConnected() || len(r.node.Members()) != len(rs) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// agree waits until the replicas hold the calls in want.
+func agree(t *testing.T, want []msgdata.Request, rs ...*replica) {
+	t.Helper()
+	eventually(t, "the replicas to agree", func() bool {
+		for _, r := range rs {
+			if !reflect.DeepEqual(r.table.Calls(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestPartition(t *testing.T) {
+	hub := network.NewLoopback()
+	// Nodes that start at the same time can form disjoint rings, so
+	// the third one joins a ring that is already up.
+	a, b := startReplica(hub), startReplica(hub)
+	ring(t, a, b)
+	c := startReplica(hub)
+	for _, r := range []*replica{a, b, c} {
+		defer r.node.Stop()
+	}
+	ring(t, a, b, c)
+
+	a.table.Set(up2)
+	agree(t, []msgdata.Request{up2}, a, b, c)
+
+	// Cut a off. Both sides go on changing the calls, and only see
+	// their own changes.
+	hub.Partition([]network.Transport{a.tr}, []network.Transport{b.tr, c.tr})
+	b.table.Clear(up2)
+	a.table.Set(down3)
+	c.table.Set(up1)
+	agree(t, []msgdata.Request{up1}, b, c)
+	eventually(t, "a to be cut off", func() bool { return !a.node.IsConnected() })
+	if got, want := a.table.Calls(), []msgdata.Request{up2, down3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls of a in the partition = %v, want %v", got, want)
+	}
+
+	// After the partition heals, every replica has every change.
+	hub.Heal()
+	agree(t, []msgdata.Request{up1, down3}, a, b, c)
+}
+
+func TestConflictInPartition(t *testing.T) {
+	hub := network.NewLoopback()
+	a, b := startReplica(hub), startReplica(hub)
+	defer a.node.Stop()
+	defer b.node.Stop()
+	ring(t, a, b)
+
+	a.table.Set(up2)
+	agree(t, []msgdata.Request{up2}, a, b)
+
+	// The call is served on one side while it is pressed again on the
+	// other. The replicas settle on one of the two, whichever it is.
+	hub.Partition([]network.Transport{a.tr}, []network.Transport{b.tr})
+	a.table.Clear(up2)
+	a.table.Set(up2)
+	a.table.Clear(up2)
+	b.table.Clear(up2)
+	b.table.Set(up2)
+
+	hub.Heal()
+	eventually(t, "the replicas to agree", func() bool {
+		return reflect.DeepEqual(a.table.Calls(), b.table.Calls())
+	})
+	if a.table.Calls() != nil {
+		t.Errorf("calls = %v, want the later clear of a", a.table.Calls())
+	}
+}
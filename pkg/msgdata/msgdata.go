@@ -0,0 +1,533 @@
+// Package msgdata implements the wire format of the messages the
+// elevators send to each other over the ring network.
+package msgdata
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/network"
+)
+
+// Message types used by the elevators.
+const (
+	COST      network.MsgType = 0x10
+	ASSIGN    network.MsgType = 0x11
+	BACKUP    network.MsgType = 0x12
+	SYNC      network.MsgType = 0x13
+	DISPATCH  network.MsgType = 0x14
+	HALLCALLS network.MsgType = 0x15
+	PARK      network.MsgType = 0x16
+	MODE      network.MsgType = 0x17
+)
+
+// CostData is passed around the ring and updated by every elevator
+// that can serve the request at a lower cost. ID is chosen by the
+// elevator that started the auction, and tells its auctions apart.
+type CostData struct {
+	ID       uint32
+	Elevator network.Addr
+	Req      Request
+	Cost     float64
+}
+
+// AssignData is sent to the elevator that won a request, with the ID
+// of the auction.
+type AssignData struct {
+	ID       uint32
+	Elevator network.Addr
+	Req      Request
+	Taken    bool
+}
+
+// DispatchData is sent around the ring when a call from a floor keypad
+// has been given to an elevator, so the halls can show the passenger
+// which car to take.
+type DispatchData struct {
+	Elevator network.Addr
+	Req      Request
+}
+
+// ParkData is sent around the ring by an idle elevator to claim the
+// floor it parks at, so no two elevators park at the same floor. From
+// is the floor the elevator is at. A Floor of -1 gives up the claim.
+type ParkData struct {
+	Elevator network.Addr
+	Floor    int
+	From     int
+}
+
+// ModeData is sent around the ring by the elevator that picks the
+// traffic mode, so every elevator dispatches the same way. Mode is one
+// of the traffic modes of the elevators.
+type ModeData struct {
+	Elevator network.Addr
+	Mode     int
+}
+
+// HallCallData holds entries of the replicated table of hall calls,
+// see package hallcall. A table that does not fit in one message is
+// sent in several.
+type HallCallData struct {
+	Entries []HallCallEntry
+}
+
+// HallCallEntry is the state of one hall call: whether it is set, and
+// the Lamport time and the node of the last change. Req never has a
+// destination.
+type HallCallEntry struct {
+	Req   Request
+	Set   bool
+	Stamp uint32
+	Node  uint32
+}
+
+// MaxHallCallEntries is the most entries a HallCallData can hold.
+const MaxHallCallEntries = (network.MaxDataLength - 1) / hallCallEntrySize
+
+const hallCallEntrySize = 10
+
+// BackupData holds the state of an elevator. Requests and Dest have
+// one element for each floor of the elevator, and Travel one for each
+// floor but the top one.
+type BackupData struct {
+	Elevator network.Addr
+	Created  time.Time
+
+	Floor     int
+	Direction elev.Direction
+	Requests  [][2]bool
+	Dest      []bool
+
+	// Times measured on the elevator, or zero if not measured. They are
+	// rounded to TimeUnit, and can be at most 255 units.
+	DoorTime  time.Duration   // one door cycle
+	StartTime time.Duration   // extra time to start from a stop
+	Travel    []time.Duration // from each floor to the next
+}
+
+// TimeUnit is the resolution of the times in a BackupData.
+const TimeUnit = 50 * time.Millisecond
+
+// NewBackupData returns an empty backup for an elevator with the given
+// number of floors.
+func NewBackupData(floors int) *BackupData {
+	return &BackupData{
+		Requests: make([][2]bool, floors),
+		Dest:     make([]bool, floors),
+		Travel:   make([]time.Duration, floors-1),
+	}
+}
+
+// Floors returns the number of floors of the elevator.
+func (d *BackupData) Floors() int {
+	return len(d.Dest)
+}
+
+// BackupSize returns the length of a marshaled BackupData with the
+// given number of floors.
+func BackupSize(floors int) int {
+	return 37 + 4*floors
+}
+
+// MaxBackupSize is the length of a marshaled BackupData for an elevator
+// with elev.MaxFloors floors.
+const MaxBackupSize = 37 + 4*elev.MaxFloors
+
+func packTime(d time.Duration) uint8 {
+	units := (d + TimeUnit/2) / TimeUnit
+	if units > 255 {
+		units = 255
+	}
+	return uint8(units)
+}
+
+func unpackTime(u uint8) time.Duration {
+	return time.Duration(u) * TimeUnit
+}
+
+type SyncData struct {
+	Latest BackupData
+}
+
+// TypeName returns the name of an elevator or network message type.
+func TypeName(t network.MsgType) string {
+	switch t {
+	case COST:
+		return "COST"
+	case ASSIGN:
+		return "ASSIGN"
+	case BACKUP:
+		return "BACKUP"
+	case SYNC:
+		return "SYNC"
+	case DISPATCH:
+		return "DISPATCH"
+	case HALLCALLS:
+		return "HALLCALLS"
+	case PARK:
+		return "PARK"
+	case MODE:
+		return "MODE"
+	}
+	return t.String()
+}
+
+// Decode unmarshals the data of an elevator message. The returned
+// value is one of the *Data types.
+func Decode(t network.MsgType, p []byte) (fmt.Stringer, error) {
+	var data interface {
+		fmt.Stringer
+		encoding.BinaryUnmarshaler
+	}
+	switch t {
+	case COST:
+		data = new(CostData)
+	case ASSIGN:
+		data = new(AssignData)
+	case BACKUP:
+		data = new(BackupData)
+	case SYNC:
+		data = new(SyncData)
+	case DISPATCH:
+		data = new(DispatchData)
+	case HALLCALLS:
+		data = new(HallCallData)
+	case PARK:
+		data = new(ParkData)
+	case MODE:
+		data = new(ModeData)
+	default:
+		return nil, fmt.Errorf("Unknown message type %v", t)
+	}
+	err := data.UnmarshalBinary(p)
+	return data, err
+}
+
+// reqString formats a request for the String methods.
+func reqString(req Request) string {
+	s := fmt.Sprintf("req.floor: %v, req.dir: %v", req.Floor, req.Direction)
+	if dest, ok := req.Dest(); ok {
+		s += fmt.Sprintf(", req.dest: %v", dest)
+	}
+	return s
+}
+
+func (d CostData) String() string {
+	return fmt.Sprintf("(id: %v, cost: %.1f, addr: %v, %s)",
+		d.ID, d.Cost, d.Elevator, reqString(d.Req))
+}
+
+// The destination of the request and the auction ID come last in COST
+// and ASSIGN, so the messages of older elevators, which have neither,
+// can still be read.
+
+func (d *CostData) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 40)
+	copy(p[:], d.Elevator[:])
+	binary.BigEndian.PutUint32(p[16:], uint32(d.Req.Floor))
+	binary.BigEndian.PutUint32(p[20:], uint32(d.Req.Direction+1))
+	binary.BigEndian.PutUint64(p[24:], math.Float64bits(d.Cost))
+	binary.BigEndian.PutUint32(p[32:], uint32(d.Req.dest))
+	binary.BigEndian.PutUint32(p[36:], d.ID)
+	return p, nil
+}
+
+func (d *CostData) UnmarshalBinary(p []byte) error {
+	if len(p) != 32 && len(p) != 36 && len(p) != 40 {
+		return errors.New("Cannot unmarshal CostData")
+	}
+	copy(d.Elevator[:], p[:])
+	d.Req.Floor = int(binary.BigEndian.Uint32(p[16:]))
+	d.Req.Direction = elev.Direction(int(binary.BigEndian.Uint32(p[20:])) - 1)
+	d.Cost = math.Float64frombits(binary.BigEndian.Uint64(p[24:]))
+	d.Req.dest, d.ID = 0, 0
+	if len(p) >= 36 {
+		d.Req.dest = int(binary.BigEndian.Uint32(p[32:]))
+	}
+	if len(p) >= 40 {
+		d.ID = binary.BigEndian.Uint32(p[36:])
+	}
+	return nil
+}
+
+func (d AssignData) String() string {
+	return fmt.Sprintf("(id: %v, taken: %v, addr: %v, %s)",
+		d.ID, d.Taken, d.Elevator, reqString(d.Req))
+}
+
+func (d *AssignData) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 36)
+	copy(p[:], d.Elevator[:])
+	binary.BigEndian.PutUint32(p[16:], uint32(d.Req.Floor))
+	binary.BigEndian.PutUint32(p[20:], uint32(d.Req.Direction+1))
+	if d.Taken {
+		binary.BigEndian.PutUint32(p[24:], 1)
+	} else {
+		binary.BigEndian.PutUint32(p[24:], 0)
+	}
+	binary.BigEndian.PutUint32(p[28:], uint32(d.Req.dest))
+	binary.BigEndian.PutUint32(p[32:], d.ID)
+	return p, nil
+}
+
+func (d *AssignData) UnmarshalBinary(p []byte) error {
+	if len(p) != 28 && len(p) != 32 && len(p) != 36 {
+		return errors.New("Cannot unmarshal AssignData")
+	}
+	copy(d.Elevator[:], p[:])
+	d.Req.Floor = int(binary.BigEndian.Uint32(p[16:]))
+	d.Req.Direction = elev.Direction(int(binary.BigEndian.Uint32(p[20:])) - 1)
+	if binary.BigEndian.Uint32(p[24:]) == 1 {
+		d.Taken = true
+	}
+	d.Req.dest, d.ID = 0, 0
+	if len(p) >= 32 {
+		d.Req.dest = int(binary.BigEndian.Uint32(p[28:]))
+	}
+	if len(p) >= 36 {
+		d.ID = binary.BigEndian.Uint32(p[32:])
+	}
+	return nil
+}
+
+func (d DispatchData) String() string {
+	return fmt.Sprintf("(addr: %v, %s)", d.Elevator, reqString(d.Req))
+}
+
+func (d *DispatchData) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 28)
+	copy(p[:], d.Elevator[:])
+	binary.BigEndian.PutUint32(p[16:], uint32(d.Req.Floor))
+	binary.BigEndian.PutUint32(p[20:], uint32(d.Req.Direction+1))
+	binary.BigEndian.PutUint32(p[24:], uint32(d.Req.dest))
+	return p, nil
+}
+
+func (d *DispatchData) UnmarshalBinary(p []byte) error {
+	if len(p) != 28 {
+		return errors.New("Cannot unmarshal DispatchData")
+	}
+	copy(d.Elevator[:], p[:])
+	d.Req.Floor = int(binary.BigEndian.Uint32(p[16:]))
+	d.Req.Direction = elev.Direction(int(binary.BigEndian.Uint32(p[20:])) - 1)
+	d.Req.dest = int(binary.BigEndian.Uint32(p[24:]))
+	return nil
+}
+
+func (d ParkData) String() string {
+	return fmt.Sprintf("(addr: %v, floor: %v, from: %v)", d.Elevator, d.Floor, d.From)
+}
+
+func (d *ParkData) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 24)
+	copy(p[:], d.Elevator[:])
+	binary.BigEndian.PutUint32(p[16:], uint32(d.Floor+1))
+	binary.BigEndian.PutUint32(p[20:], uint32(d.From))
+	return p, nil
+}
+
+func (d *ParkData) UnmarshalBinary(p []byte) error {
+	if len(p) != 24 {
+		return errors.New("Cannot unmarshal ParkData")
+	}
+	copy(d.Elevator[:], p[:])
+	d.Floor = int(binary.BigEndian.Uint32(p[16:])) - 1
+	d.From = int(binary.BigEndian.Uint32(p[20:]))
+	return nil
+}
+
+func (d ModeData) String() string {
+	return fmt.Sprintf("(addr: %v, mode: %v)", d.Elevator, d.Mode)
+}
+
+func (d *ModeData) MarshalBinary() ([]byte, error) {
+	p := make([]byte, 20)
+	copy(p[:], d.Elevator[:])
+	binary.BigEndian.PutUint32(p[16:], uint32(d.Mode))
+	return p, nil
+}
+
+func (d *ModeData) UnmarshalBinary(p []byte) error {
+	if len(p) != 20 {
+		return errors.New("Cannot unmarshal ModeData")
+	}
+	copy(d.Elevator[:], p[:])
+	d.Mode = int(binary.BigEndian.Uint32(p[16:]))
+	return nil
+}
+
+func (d HallCallData) String() string {
+	var b strings.Builder
+	b.WriteString("(")
+	for i, e := range d.Entries {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		state := "clear"
+		if e.Set {
+			state = "set"
+		}
+		fmt.Fprintf(&b, "%v %s @%v/%x", e.Req, state, e.Stamp, e.Node)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+func (d *HallCallData) MarshalBinary() ([]byte, error) {
+	if len(d.Entries) > MaxHallCallEntries {
+		return nil, errors.New("Cannot marshal HallCallData with too many entries")
+	}
+	buf := make([]byte, 1+hallCallEntrySize*len(d.Entries))
+	buf[0] = uint8(len(d.Entries))
+	p := buf[1:]
+	for _, e := range d.Entries {
+		p[0] = uint8(e.Req.Floor)
+		if e.Req.Direction == elev.Up {
+			p[1] |= 1
+		}
+		if e.Set {
+			p[1] |= 2
+		}
+		binary.BigEndian.PutUint32(p[2:], e.Stamp)
+		binary.BigEndian.PutUint32(p[6:], e.Node)
+		p = p[hallCallEntrySize:]
+	}
+	return buf, nil
+}
+
+func (d *HallCallData) UnmarshalBinary(p []byte) error {
+	if len(p) < 1 || len(p) != 1+hallCallEntrySize*int(p[0]) {
+		return errors.New("Cannot unmarshal HallCallData")
+	}
+	d.Entries = make([]HallCallEntry, p[0])
+	p = p[1:]
+	for i := range d.Entries {
+		e := &d.Entries[i]
+		e.Req.Floor = int(p[0])
+		e.Req.Direction = elev.Down
+		if p[1]&1 != 0 {
+			e.Req.Direction = elev.Up
+		}
+		e.Set = p[1]&2 != 0
+		e.Stamp = binary.BigEndian.Uint32(p[2:])
+		e.Node = binary.BigEndian.Uint32(p[6:])
+		p = p[hallCallEntrySize:]
+	}
+	return nil
+}
+
+func (d BackupData) String() string {
+	return fmt.Sprintf("(addr: %v, reqs: %v, dest: %v)",
+		d.Elevator, d.Requests, d.Dest)
+}
+
+func (d *BackupData) MarshalBinary() ([]byte, error) {
+	floors := d.Floors()
+	if len(d.Requests) != floors {
+		return nil, errors.New("Cannot marshal BackupData with inconsistent floors")
+	}
+	buf := make([]byte, BackupSize(floors))
+	p := buf
+
+	copy(p, d.Elevator[:])
+	p = p[16:]
+
+	timebuf, _ := d.Created.MarshalBinary()
+	copy(p[:15], timebuf)
+	p = p[16:]
+
+	p[0] = uint8(d.Floor)
+	switch d.Direction {
+	case elev.Down:
+		p[1] = 255
+	case elev.Up:
+		p[1] = 1
+	case elev.Stop:
+		p[1] = 0
+	}
+	p[2] = uint8(floors)
+	p[3] = packTime(d.DoorTime)
+	p[4] = packTime(d.StartTime)
+	p = p[5:]
+
+	for f := 0; f < floors; f++ {
+		if d.Requests[f][0] {
+			p[0] = 1
+		}
+		if d.Requests[f][1] {
+			p[1] = 1
+		}
+		if d.Dest[f] {
+			p[2] = 1
+		}
+		if f < len(d.Travel) {
+			p[3] = packTime(d.Travel[f])
+		}
+		p = p[4:]
+	}
+
+	return buf, nil
+}
+
+func (d *BackupData) UnmarshalBinary(p []byte) error {
+	if len(p) < BackupSize(0) || len(p) != BackupSize(int(p[34])) {
+		return errors.New("Cannot unmarshal BackupData")
+	}
+
+	copy(d.Elevator[:], p)
+	p = p[16:]
+
+	d.Created.UnmarshalBinary(p[:15])
+	p = p[16:]
+
+	d.Floor = int(p[0])
+	switch p[1] {
+	case 255:
+		d.Direction = elev.Down
+	case 0:
+		d.Direction = elev.Stop
+	case 1:
+		d.Direction = elev.Up
+	}
+	floors := int(p[2])
+	d.DoorTime = unpackTime(p[3])
+	d.StartTime = unpackTime(p[4])
+	p = p[5:]
+
+	d.Requests = make([][2]bool, floors)
+	d.Dest = make([]bool, floors)
+	d.Travel = nil
+	if floors > 0 {
+		d.Travel = make([]time.Duration, floors-1)
+	}
+	for f := 0; f < floors; f++ {
+		d.Requests[f][0] = (p[0] == 1)
+		d.Requests[f][1] = (p[1] == 1)
+		d.Dest[f] = (p[2] == 1)
+		if f < floors-1 {
+			d.Travel[f] = unpackTime(p[3])
+		}
+		p = p[4:]
+	}
+
+	return nil
+}
+
+func (d *SyncData) MarshalBinary() ([]byte, error) {
+	return d.Latest.MarshalBinary()
+}
+
+func (d *SyncData) UnmarshalBinary(p []byte) error {
+	return d.Latest.UnmarshalBinary(p)
+}
+
+func (d SyncData) String() string {
+	return fmt.Sprintf("(latest: %v)", d.Latest)
+}
@@ -0,0 +1,123 @@
+package msgdata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"elevator-project/pkg/elev"
+	"elevator-project/pkg/network"
+)
+
+func TestBackupDataFloors(t *testing.T) {
+	for _, floors := range []int{2, 4, 9, elev.MaxFloors} {
+		bd := NewBackupData(floors)
+		bd.Created = time.Unix(1500000000, 0).UTC()
+		bd.Floor = floors - 1
+		bd.Direction = elev.Down
+		bd.Requests[floors-1][0] = true
+		bd.Dest[0] = true
+		bd.DoorTime = 4 * time.Second
+		bd.Travel[floors-2] = 1750 * time.Millisecond
+
+		p, err := bd.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) != BackupSize(floors) || len(p) > MaxBackupSize {
+			t.Errorf("%d floors: marshaled %d bytes", floors, len(p))
+		}
+
+		var got BackupData
+		if err := got.UnmarshalBinary(p); err != nil {
+			t.Fatalf("%d floors: %v", floors, err)
+		}
+		if !reflect.DeepEqual(&got, bd) {
+			t.Errorf("%d floors: got %+v, want %+v", floors, got, *bd)
+		}
+
+		if err := got.UnmarshalBinary(p[:len(p)-1]); err == nil {
+			t.Errorf("%d floors: short backup accepted", floors)
+		}
+	}
+}
+
+func TestRequestIsValid(t *testing.T) {
+	tests := []struct {
+		req  Request
+		want bool
+	}{
+		{Request{Floor: 0, Direction: elev.Up}, true},
+		{Request{Floor: 0, Direction: elev.Down}, false},
+		{Request{Floor: 5, Direction: elev.Down}, true},
+		{Request{Floor: 5, Direction: elev.Up}, false},
+		{Request{Floor: 6, Direction: elev.Down}, false},
+		{Request{Floor: -1, Direction: elev.Up}, false},
+		{NewDestRequest(1, 4), true},
+		{NewDestRequest(4, 0), true},
+		{NewDestRequest(2, 2), false},
+		{NewDestRequest(2, 6), false},
+	}
+	for _, tt := range tests {
+		if got := tt.req.IsValid(6); got != tt.want {
+			t.Errorf("%v.IsValid(6) = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestCostDataDest(t *testing.T) {
+	cd := CostData{ID: 42, Req: NewDestRequest(3, 1), Cost: 12.5}
+	cd.Elevator[15] = 7
+
+	p, err := cd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got CostData
+	if err := got.UnmarshalBinary(p); err != nil {
+		t.Fatal(err)
+	}
+	if got != cd {
+		t.Errorf("got %v, want %v", got, cd)
+	}
+
+	// A COST from an older elevator has no destination.
+	if err := got.UnmarshalBinary(p[:32]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Req.Dest(); ok || got.ID != 0 || got.Req.Floor != 3 || got.Req.Direction != elev.Down {
+		t.Errorf("old COST read as %v", got)
+	}
+}
+
+func TestHallCallDataFull(t *testing.T) {
+	var hd HallCallData
+	for i := 0; i < MaxHallCallEntries; i++ {
+		hd.Entries = append(hd.Entries, HallCallEntry{
+			Req:   Request{Floor: i / 2, Direction: elev.Direction(i%2*2 - 1)},
+			Set:   i%3 == 0,
+			Stamp: uint32(1000 + i),
+			Node:  0x7f4d0001,
+		})
+	}
+
+	p, err := hd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) > network.MaxDataLength {
+		t.Fatalf("%d bytes, want at most %d", len(p), network.MaxDataLength)
+	}
+	var got HallCallData
+	if err := got.UnmarshalBinary(p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, hd) {
+		t.Errorf("got %v, want %v", got, hd)
+	}
+
+	hd.Entries = append(hd.Entries, HallCallEntry{})
+	if _, err := hd.MarshalBinary(); err == nil {
+		t.Error("marshaled too many entries")
+	}
+}
@@ -0,0 +1,60 @@
+package msgdata
+
+import (
+	"fmt"
+
+	"elevator-project/pkg/elev"
+)
+
+// Request is a call from one of the hall panels. In destination
+// dispatch the call is entered on a floor keypad, and also holds the
+// floor the passenger is going to.
+type Request struct {
+	Floor     int
+	Direction elev.Direction
+
+	dest int // destination floor + 1, or 0 for an up or down call
+}
+
+// NewDestRequest returns a call from a floor keypad at floor to dest.
+func NewDestRequest(floor, dest int) Request {
+	req := Request{Floor: floor, Direction: elev.Up, dest: dest + 1}
+	if dest < floor {
+		req.Direction = elev.Down
+	}
+	return req
+}
+
+// Dest returns the destination floor of a call from a floor keypad. It
+// returns false for a call from an up or down button.
+func (req Request) Dest() (int, bool) {
+	return req.dest - 1, req.dest != 0
+}
+
+func (req Request) String() string {
+	dir := "up"
+	if req.Direction == elev.Down {
+		dir = "down"
+	}
+	if dest, ok := req.Dest(); ok {
+		return fmt.Sprintf("floor %d %s to %d", req.Floor, dir, dest)
+	}
+	return fmt.Sprintf("floor %d %s", req.Floor, dir)
+}
+
+// IsValid returns true if the request can be made in a building with
+// the given number of floors.
+func (req Request) IsValid(floors int) bool {
+	if req.Floor < 0 || req.Floor >= floors ||
+		(req.Floor == 0 && req.Direction == elev.Down) ||
+		(req.Floor == floors-1 && req.Direction == elev.Up) {
+		return false
+	}
+	if dest, ok := req.Dest(); ok {
+		if dest < 0 || dest >= floors || dest == req.Floor ||
+			(dest > req.Floor) != (req.Direction == elev.Up) {
+			return false
+		}
+	}
+	return true
+}
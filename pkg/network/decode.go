@@ -0,0 +1,102 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The functions in this file decode datagrams seen on the network
+// without a Node, and are meant for debugging tools.
+
+// Links holds the neighbour addresses carried by HELLO, UPDATE and
+// LINKS messages. In an UPDATE a zero Addr means that the link is
+// unchanged, and in a LINKS that the node is not connected.
+type Links struct {
+	Right   Addr
+	Left    Addr
+	Left2nd Addr
+}
+
+// ParseMessage decodes the payload of a UDP datagram sent between
+// nodes.
+func ParseMessage(p []byte) (*Message, error) {
+	if len(p) < 12 || len(p) > maxPayloadLength {
+		return nil, errors.New("Invalid message length.")
+	}
+	msg := new(Message)
+	unpackMsg(p, msg)
+	return msg, nil
+}
+
+// Links returns the links carried by a HELLO, UPDATE or LINKS message.
+func (msg *Message) Links() (Links, bool) {
+	var l Links
+	if len(msg.Data) < 48 {
+		return l, false
+	}
+	switch msg.Type {
+	case HELLO:
+		var hd helloData
+		unpackData(msg.Data, &hd)
+		l = Links{Right: hd.newRight, Left: hd.newLeft, Left2nd: hd.newLeft2nd}
+	case UPDATE, LINKS:
+		var ud updateData
+		unpackData(msg.Data, &ud)
+		l = Links{Right: ud.right, Left: ud.left, Left2nd: ud.left2nd}
+	default:
+		return l, false
+	}
+	return l, true
+}
+
+// Kicked returns the dead node and the node that kicked it from a
+// KICK message.
+func (msg *Message) Kicked() (dead, sender Addr, ok bool) {
+	if msg.Type != KICK || len(msg.Data) < 32 {
+		return
+	}
+	var kd kickData
+	unpackData(msg.Data, &kd)
+	return kd.deadNode, kd.senderNode, true
+}
+
+// Acked returns the ID of the DIRECT message acknowledged by an ACK.
+func (msg *Message) Acked() (uint32, bool) {
+	if msg.Type != ACK || len(msg.Data) < 4 {
+		return 0, false
+	}
+	var ack ackData
+	unpackData(msg.Data, &ack)
+	return ack.id, true
+}
+
+// Unwrap returns the user-defined message carried by a DIRECT message
+// from the node at from.
+func (msg *Message) Unwrap(from Addr) (*Message, bool) {
+	if msg.Type != DIRECT || len(msg.Data) < 4 {
+		return nil, false
+	}
+	dmsg := &Message{
+		ID:   msg.ID,
+		Type: MsgType(binary.BigEndian.Uint32(msg.Data)),
+		peer: from,
+	}
+	nc := copy(dmsg.buf[:], msg.Data[4:])
+	dmsg.Data = dmsg.buf[:nc]
+	return dmsg, true
+}
+
+// Meta returns the metadata carried by a BROADCAST, HELLO, UPDATE or
+// META message, and the node it describes. For all but META that is
+// the sender, and origin is zero.
+func (msg *Message) Meta() (origin Addr, m Meta, ok bool) {
+	off, ok := metaOffset(msg.Type)
+	if !ok || len(msg.Data) <= off {
+		return origin, m, false
+	}
+	if msg.Type == META {
+		copy(origin[:], msg.Data)
+	}
+	ok = unpackMeta(msg.Data[off:], &m)
+	return origin, m, ok
+}
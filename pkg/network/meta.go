@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	metaTime       = 2 * time.Second
+	metaExpireTime = 3 * metaTime
+	maxMetaName    = 31
+	maxMetaVersion = 15
+	maxMetaLength  = 1 + maxMetaName + 1 + maxMetaVersion + 2 + 4
+)
+
+// Meta is a small record describing a node. It is advertised in
+// BROADCAST, HELLO and UPDATE messages when a node joins, and gossiped
+// around the ring in META messages so that every node knows about
+// every other node. The meaning of the fields is up to the user.
+type Meta struct {
+	Name    string // at most 31 bytes
+	Floors  int
+	Version string // at most 15 bytes
+	Caps    uint32 // bitmask of capabilities
+}
+
+type member struct {
+	meta     Meta
+	lastSeen time.Time
+}
+
+// memberList is shared between the maintainNetwork goroutine and the
+// user.
+type memberList struct {
+	mu      sync.Mutex
+	meta    Meta
+	members map[Addr]*member
+}
+
+// SetMeta sets the metadata advertised by this node.
+func (n *Node) SetMeta(m Meta) {
+	n.members.mu.Lock()
+	n.members.meta = m
+	n.members.mu.Unlock()
+}
+
+// Meta returns the metadata of this node.
+func (n *Node) Meta() Meta {
+	return n.members.ownMeta()
+}
+
+// Members returns the metadata of all nodes known to be in the ring,
+// including this node.
+func (n *Node) Members() map[Addr]Meta {
+	n.members.mu.Lock()
+	defer n.members.mu.Unlock()
+
+	ret := make(map[Addr]Meta)
+	for addr, m := range n.members.members {
+		ret[addr] = m.meta
+	}
+	if !n.thisNode.IsZero() {
+		ret[n.thisNode] = n.members.meta
+	}
+	return ret
+}
+
+// Member returns the metadata of a single node.
+func (n *Node) Member(addr Addr) (Meta, bool) {
+	n.members.mu.Lock()
+	defer n.members.mu.Unlock()
+
+	if addr == n.thisNode {
+		return n.members.meta, true
+	}
+	m, ok := n.members.members[addr]
+	if !ok {
+		return Meta{}, false
+	}
+	return m.meta, true
+}
+
+func (l *memberList) ownMeta() Meta {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.meta
+}
+
+func (l *memberList) update(addr Addr, m Meta) {
+	l.mu.Lock()
+	l.members[addr] = &member{meta: m, lastSeen: time.Now()}
+	l.mu.Unlock()
+}
+
+func (l *memberList) remove(addr Addr) {
+	l.mu.Lock()
+	delete(l.members, addr)
+	l.mu.Unlock()
+}
+
+func (l *memberList) clear() {
+	l.mu.Lock()
+	l.members = make(map[Addr]*member)
+	l.mu.Unlock()
+}
+
+// expire removes members that have not been heard from in a while.
+func (l *memberList) expire() {
+	l.mu.Lock()
+	for addr, m := range l.members {
+		if time.Since(m.lastSeen) > metaExpireTime {
+			delete(l.members, addr)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// gossipMeta sends this node's metadata around the ring.
+func (n *Node) gossipMeta() {
+	var buf [16 + maxMetaLength]byte
+	copy(buf[:], n.thisNode[:])
+	meta := n.members.ownMeta()
+	np := packMeta(buf[16:], &meta)
+	n.forwardMsg(NewMessage(META, buf[:16+np]))
+}
+
+// metaOffset returns where the sender's metadata starts in the data
+// of a message type that carries it.
+func metaOffset(mtype MsgType) (int, bool) {
+	switch mtype {
+	case BROADCAST:
+		return 0, true
+	case HELLO, UPDATE:
+		return 48, true
+	case META:
+		return 16, true
+	}
+	return 0, false
+}
+
+func packMeta(p []byte, m *Meta) int {
+	name := m.Name
+	if len(name) > maxMetaName {
+		name = name[:maxMetaName]
+	}
+	version := m.Version
+	if len(version) > maxMetaVersion {
+		version = version[:maxMetaVersion]
+	}
+
+	n := 0
+	p[n] = byte(len(name))
+	n += 1 + copy(p[n+1:], name)
+	p[n] = byte(len(version))
+	n += 1 + copy(p[n+1:], version)
+	binary.BigEndian.PutUint16(p[n:], uint16(m.Floors))
+	binary.BigEndian.PutUint32(p[n+2:], m.Caps)
+	return n + 6
+}
+
+func unpackMeta(p []byte, m *Meta) bool {
+	if len(p) < 1 || len(p) < 1+int(p[0])+1 {
+		return false
+	}
+	m.Name = string(p[1 : 1+p[0]])
+	p = p[1+p[0]:]
+
+	if len(p) < 1+int(p[0])+6 {
+		return false
+	}
+	m.Version = string(p[1 : 1+p[0]])
+	p = p[1+p[0]:]
+
+	m.Floors = int(binary.BigEndian.Uint16(p))
+	m.Caps = binary.BigEndian.Uint32(p[2:])
+	return true
+}
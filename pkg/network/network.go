@@ -12,6 +12,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,14 +31,20 @@ const (
 	msgResendInterval  = 200 * time.Millisecond
 	kickResendInterval = 20 * time.Millisecond
 	lonelyDelay        = 100 * time.Millisecond
+
+	// The timers are checked at least this often. They used to be
+	// checked in a busy loop, which starves other goroutines when
+	// several nodes run in one process.
+	pollInterval = 5 * time.Millisecond
 )
 
 const (
-	bufferSize     = 32
-	MaxDataLength  = 244
-	maxResendCount = 5
-	maxReadCount   = 100
-	maxResenders   = 100
+	bufferSize          = 32
+	MaxDataLength       = 244
+	MaxDirectDataLength = MaxDataLength - 4
+	maxResendCount      = 5
+	maxReadCount        = 100
+	maxResenders        = 100
 )
 
 type MsgType uint32
@@ -52,6 +59,11 @@ const (
 	PING      MsgType = 0x4 // Check that node is alive.
 	ALIVE     MsgType = 0x5 // Reply to PING.
 	KICK      MsgType = 0x6 // Inform network that a node has been kicked.
+	DIRECT    MsgType = 0x7 // User-defined message sent straight to a node.
+	ACK       MsgType = 0x8 // Reply to DIRECT.
+	QUERY     MsgType = 0x9 // Request for the links of a node.
+	LINKS     MsgType = 0xA // Reply to QUERY.
+	META      MsgType = 0xB // Gossip the metadata of a node.
 )
 
 // The Message type is what is packed into the UDP datagram and sent
@@ -64,6 +76,11 @@ type Message struct {
 	buf       [MaxDataLength]byte
 
 	Data []byte // points into buf
+
+	// peer is zero for messages sent around the ring. For messages
+	// sent with SendTo it is the receiving node on the sender side and
+	// the sending node on the receiver side.
+	peer Addr
 }
 
 // NewMessage allocates and initializes a Message copying from the data
@@ -78,6 +95,18 @@ func NewMessage(mtype MsgType, data []byte) *Message {
 	return msg
 }
 
+// IsDirect returns true if the message was sent point-to-point with
+// SendTo instead of around the ring.
+func (msg *Message) IsDirect() bool {
+	return !msg.peer.IsZero()
+}
+
+// Peer returns the other end of a direct message, or the zero Addr
+// for ring messages.
+func (msg *Message) Peer() Addr {
+	return msg.peer
+}
+
 type helloData struct {
 	newRight   Addr
 	newLeft    Addr
@@ -95,6 +124,10 @@ type kickData struct {
 	senderNode Addr
 }
 
+type ackData struct {
+	id uint32
+}
+
 type resender struct {
 	msg            *Message
 	resendInterval time.Duration
@@ -113,8 +146,11 @@ const (
 )
 
 type Node struct {
-	state nodeState
-	stopc chan struct{}
+	// state is only used by the goroutine running maintainNetwork.
+	// Other goroutines read the copy in sharedState.
+	state       nodeState
+	sharedState int32
+	stopc       chan struct{}
 
 	// Only thisNode and anyNode are guaranteed to be nonnil at all times.
 	thisNode    Addr
@@ -123,7 +159,7 @@ type Node struct {
 	rightNode   Addr
 	anyNode     Addr
 
-	udp *UDPService
+	transport Transport
 
 	// Channels are for user-defined messages. They are buffered and
 	// when they are full new messages will be dropped.
@@ -134,6 +170,15 @@ type Node struct {
 
 	deadNodes chan Addr
 
+	// Direct messages that were never acknowledged by the receiver.
+	undelivered chan *Message
+
+	// IDs of the latest direct messages delivered to the user. A
+	// DIRECT is resent if the ACK is lost, and the duplicate must be
+	// acknowledged without being delivered twice.
+	recentIDs  [maxResenders]uint32
+	recentNext int
+
 	// Timers for keeping track of the two next nodes on the left.
 	aliveTimer     Timer
 	kickTimer      Timer
@@ -141,11 +186,16 @@ type Node struct {
 	left2ndIsAlive bool
 
 	broadcastTimer Timer
+	metaTimer      Timer
+
+	members memberList
 
 	// Note: The map datatype in Go is not thread-safe. In this
 	// case access is controlled by the for/select loop in maintainNetwork.
 	resenders        map[uint32]*resender
 	resenderTimedOut chan uint32
+
+	stats *nodeStats
 }
 
 func NewNode() *Node {
@@ -159,33 +209,39 @@ func NewNode() *Node {
 	n.toForward = make(chan *Message, bufferSize)
 
 	n.deadNodes = make(chan Addr, bufferSize)
+	n.undelivered = make(chan *Message, bufferSize)
 
 	n.stopc = make(chan struct{})
 
+	n.members.members = make(map[Addr]*member)
+
+	n.stats = newNodeStats()
 	n.updateState(ready)
 	return n
 }
 
+// NewNodeWithTransport returns a node that sends its datagrams with t
+// instead of UDP.
+func NewNodeWithTransport(t Transport) *Node {
+	n := NewNode()
+	n.transport = t
+	return n
+}
+
 func (n *Node) Start() error {
 	if n.state == ready {
 		var err error
-		n.thisNode, err = NetworkAddr()
-		if err != nil {
-			return err
-		}
-
-		n.anyNode, err = BroadcastAddr()
-		if err != nil {
-			return err
-		}
-
-		n.udp, err = NewUDPService()
-		if err != nil {
-			return err
+		if n.transport == nil {
+			n.transport, err = NewUDPService()
+			if err != nil {
+				return err
+			}
 		}
+		n.thisNode = n.transport.Addr()
+		n.anyNode = n.transport.BroadcastAddr()
 
-		go n.maintainNetwork()
 		n.updateState(disconnected)
+		go n.maintainNetwork()
 
 		infolog.Printf("running on %v.\n", n.thisNode)
 	}
@@ -193,11 +249,16 @@ func (n *Node) Start() error {
 }
 
 func (n *Node) IsRunning() bool {
-	return n.state != stopped
+	return n.loadState() != stopped
 }
 
 func (n *Node) IsConnected() bool {
-	return n.state == connected || n.state == detached2ndLeft
+	s := n.loadState()
+	return s == connected || s == detached2ndLeft
+}
+
+func (n *Node) loadState() nodeState {
+	return nodeState(atomic.LoadInt32(&n.sharedState))
 }
 
 func (n *Node) Stop() {
@@ -213,7 +274,7 @@ func (n *Node) ReceiveMessage() *Message {
 }
 
 func (n *Node) ForwardMessage(msg *Message) {
-	if msg.Type < 16 {
+	if msg.Type < 16 || msg.IsDirect() {
 		return
 	}
 	n.toForward <- msg
@@ -226,6 +287,28 @@ func (n *Node) SendMessage(msg *Message) {
 	n.toSend <- msg
 }
 
+// SendTo sends a user-defined message straight to the node at addr
+// instead of around the ring. The message is resent until the
+// receiver acknowledges it, and is then returned by ReceiveMyMessage.
+// If it is never acknowledged it is returned by GetUndelivered.
+//
+// Direct messages can hold at most MaxDirectDataLength bytes of data.
+// A message that can not be sent, because it is too long, is not of a
+// user-defined type or has no receiver, is returned by GetUndelivered
+// at once.
+func (n *Node) SendTo(addr Addr, msg *Message) {
+	msg.peer = addr
+	if msg.Type < 16 || len(msg.Data) > MaxDirectDataLength || addr.IsZero() {
+		select {
+		case n.undelivered <- msg:
+		default:
+			n.stats.add(&n.stats.drops)
+		}
+		return
+	}
+	n.toSend <- msg
+}
+
 func (n *Node) Addr() Addr {
 	return n.thisNode
 }
@@ -234,7 +317,14 @@ func (n *Node) GetDeadNode() Addr {
 	return <-n.deadNodes
 }
 
+func (n *Node) GetUndelivered() *Message {
+	return <-n.undelivered
+}
+
 func (n *Node) maintainNetwork() {
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
 	for {
 		if n.state == connected || n.state == detached2ndLeft {
 
@@ -250,6 +340,12 @@ func (n *Node) maintainNetwork() {
 				n.kickTimer.Reset(kickTime)
 			}
 
+			if n.metaTimer.HasTimedOut() {
+				n.members.expire()
+				n.gossipMeta()
+				n.metaTimer.Reset(metaTime)
+			}
+
 			if n.kickTimer.HasTimedOut() {
 				n.kickTimer.Stop()
 				if n.leftIsAlive {
@@ -276,29 +372,53 @@ func (n *Node) maintainNetwork() {
 		}
 
 		select {
-		case umsg := <-n.udp.receivec:
+		case umsg := <-n.transport.Incoming():
 			n.processUDPMessage(umsg)
 		case msg := <-n.toForward:
 			n.forwardMsg(msg)
 		case msg := <-n.toSend:
+			if msg.IsDirect() {
+				n.sendDirect(msg)
+			}
 			n.addResender(msg, msgResendInterval)
 		case ID := <-n.resenderTimedOut:
 			if re, ok := n.resenders[ID]; ok {
 				if re.triesLeft > 0 {
-					n.forwardMsg(re.msg)
+					// Ring messages are sent for the first
+					// time when the resender first times out.
+					if re.msg.IsDirect() || re.triesLeft < maxResendCount {
+						n.stats.add(&n.stats.retries)
+					}
+					if re.msg.IsDirect() {
+						n.sendDirect(re.msg)
+					} else {
+						n.forwardMsg(re.msg)
+					}
 					re.triesLeft--
+				} else if re.msg.IsDirect() {
+					// The receiver is gone, but that does
+					// not say anything about the ring.
+					n.stats.add(&n.stats.timeouts)
+					n.removeResender(re)
+					select {
+					case n.undelivered <- re.msg:
+					default:
+						n.stats.add(&n.stats.drops)
+					}
 				} else {
+					n.stats.add(&n.stats.timeouts)
 					n.removeResender(re)
 					n.updateState(disconnected)
 				}
 			}
 		case <-n.stopc:
-			n.state = stopped
+			n.updateState(stopped)
 			for _, re := range n.resenders {
 				n.removeResender(re)
 			}
 			return
-		default: // don't block
+		case <-poll.C:
+			// Check the timers again.
 		}
 	}
 }
@@ -329,6 +449,8 @@ func (n *Node) restoreNetwork() error {
 			n.deadNodes <- n.left2ndNode
 		}
 		n.deadNodes <- n.leftNode
+		n.members.remove(n.left2ndNode)
+		n.members.remove(n.leftNode)
 		n.updateState(disconnected)
 		return errors.New("Not able to restore connectivity.")
 	} else if !n.leftIsAlive && n.left2ndIsAlive {
@@ -350,6 +472,8 @@ func (n *Node) restoreNetwork() error {
 		n.sendData(n.leftNode, GET, nil)
 
 		n.deadNodes <- deadNode
+		n.members.remove(deadNode)
+		n.stats.add(&n.stats.kicks)
 
 		// Create and send a kick message.
 		var buf [32]byte
@@ -371,8 +495,10 @@ func (n *Node) restoreNetwork() error {
 func (n *Node) processUDPMessage(umsg *UDPMessage) {
 	msg := new(Message)
 	unpackMsg(umsg.payload, msg)
+	n.stats.countReceived(msg.Type)
 
 	if msg.ReadCount > maxReadCount {
+		n.stats.add(&n.stats.drops)
 		return
 	}
 	msg.ReadCount++
@@ -473,6 +599,7 @@ func (n *Node) processUDPMessage(umsg *UDPMessage) {
 		}
 
 	case ALIVE:
+		n.stats.alive(umsg.from)
 		if n.state == connected {
 			if umsg.from == n.leftNode {
 				n.leftIsAlive = true
@@ -501,13 +628,71 @@ func (n *Node) processUDPMessage(umsg *UDPMessage) {
 			// case n.deadNodes <- kick.deadNode:
 			// default:
 			// }
+			n.members.remove(kick.deadNode)
 
 			if re, ok := n.resenders[msg.ID]; ok {
 				n.removeResender(re)
 			} else {
+				n.stats.add(&n.stats.kicksSeen)
 				n.forwardMsg(msg)
 			}
 		}
+
+	case DIRECT:
+		dmsg, ok := msg.Unwrap(umsg.from)
+		if ok && n.IsConnected() {
+			n.sendData(umsg.from, ACK, &ackData{id: msg.ID})
+			if n.isRecent(msg.ID) {
+				break
+			}
+
+			if dmsg.Type >= 16 {
+				select {
+				case n.fromUserToOther <- dmsg:
+				default:
+					n.stats.add(&n.stats.drops)
+				}
+			}
+		}
+
+	case META:
+		if n.IsConnected() && len(msg.Data) > 16 {
+			var origin Addr
+			var meta Meta
+			copy(origin[:], msg.Data)
+			if origin == n.thisNode {
+				// Back where it started.
+				break
+			}
+			if unpackMeta(msg.Data[16:], &meta) {
+				n.members.update(origin, meta)
+			}
+			n.forwardMsg(msg)
+		}
+
+	case QUERY:
+		// Debugging tools may query from any port.
+		n.sendDataPort(umsg.from, umsg.port, LINKS, &updateData{
+			right:   n.rightNode,
+			left:    n.leftNode,
+			left2nd: n.left2ndNode,
+		})
+
+	case ACK:
+		if len(msg.Data) < 4 {
+			break
+		}
+		var ack ackData
+		unpackData(msg.Data, &ack)
+
+		if re, ok := n.resenders[ack.id]; ok && re.msg.IsDirect() {
+			n.removeResender(re)
+			select {
+			case n.fromUserToUser <- re.msg:
+			default:
+				n.stats.add(&n.stats.drops)
+			}
+		}
 	}
 
 	// User-defined message type
@@ -524,9 +709,23 @@ func (n *Node) processUDPMessage(umsg *UDPMessage) {
 			select {
 			case c <- msg:
 			default:
+				n.stats.add(&n.stats.drops)
 			}
 		}
 	}
+
+	// Messages sent when joining carry the metadata of the sender. It
+	// is only recorded once the message has made the sender one of the
+	// links of this node, since a node that is broadcasting, or that
+	// answers without joining, is not in the ring.
+	if off, ok := metaOffset(msg.Type); ok && msg.Type != META &&
+		umsg.from != n.thisNode && len(msg.Data) > off &&
+		n.IsConnected() && n.isLink(umsg.from) {
+		var meta Meta
+		if unpackMeta(msg.Data[off:], &meta) {
+			n.members.update(umsg.from, meta)
+		}
+	}
 }
 
 func (n *Node) addResender(msg *Message, resendInterval time.Duration) {
@@ -557,6 +756,24 @@ func (n *Node) removeResender(re *resender) {
 	delete(n.resenders, re.msg.ID)
 }
 
+// isLink returns true if addr is one of the neighbours of this node.
+func (n *Node) isLink(addr Addr) bool {
+	return addr == n.leftNode || addr == n.rightNode || addr == n.left2ndNode
+}
+
+// isRecent returns true if a direct message with this ID has already
+// been delivered, and remembers the ID otherwise.
+func (n *Node) isRecent(ID uint32) bool {
+	for _, id := range n.recentIDs {
+		if id == ID {
+			return true
+		}
+	}
+	n.recentIDs[n.recentNext] = ID
+	n.recentNext = (n.recentNext + 1) % len(n.recentIDs)
+	return false
+}
+
 func unpackMsg(p []byte, msg *Message) {
 	msg.ID = binary.BigEndian.Uint32(p[:])
 	msg.Type = MsgType(binary.BigEndian.Uint32(p[4:]))
@@ -579,6 +796,9 @@ func packData(p []byte, data interface{}) int {
 	case *kickData:
 		n += copy(p[:], d.deadNode[:])
 		n += copy(p[16:], d.senderNode[:])
+	case *ackData:
+		binary.BigEndian.PutUint32(p[:], d.id)
+		n += 4
 	}
 	return n
 }
@@ -596,11 +816,19 @@ func unpackData(p []byte, data interface{}) {
 	case *kickData:
 		copy(d.deadNode[:], p[:])
 		copy(d.senderNode[:], p[16:])
+	case *ackData:
+		d.id = binary.BigEndian.Uint32(p[:])
 	}
 }
 
 func (n *Node) sendData(to Addr, mtype MsgType, data interface{}) {
-	umsg := &UDPMessage{to: to, from: n.thisNode}
+	n.sendDataPort(to, 0, mtype, data)
+}
+
+// sendDataPort is like sendData, but sends to a port other than UDPPort
+// if port is nonzero.
+func (n *Node) sendDataPort(to Addr, port int, mtype MsgType, data interface{}) {
+	umsg := &UDPMessage{to: to, from: n.thisNode, port: port}
 	binary.BigEndian.PutUint32(umsg.buf[:], rand.Uint32())
 	binary.BigEndian.PutUint32(umsg.buf[4:], uint32(mtype))
 	umsg.payload = umsg.buf[:12]
@@ -610,7 +838,17 @@ func (n *Node) sendData(to Addr, mtype MsgType, data interface{}) {
 		umsg.payload = umsg.buf[:12+np]
 	}
 
-	n.udp.Send(umsg)
+	if off, ok := metaOffset(mtype); ok {
+		meta := n.members.ownMeta()
+		np := packMeta(umsg.buf[12+off:], &meta)
+		umsg.payload = umsg.buf[:12+off+np]
+	}
+
+	if mtype == PING {
+		n.stats.pinged(to)
+	}
+	n.stats.countSent(mtype)
+	n.transport.Send(umsg)
 }
 
 func (n *Node) forwardMsg(msg *Message) {
@@ -622,10 +860,28 @@ func (n *Node) forwardMsg(msg *Message) {
 	nc := copy(umsg.buf[12:], msg.Data)
 
 	umsg.payload = umsg.buf[:nc+12]
-	n.udp.Send(umsg)
+	n.stats.countSent(msg.Type)
+	n.transport.Send(umsg)
+}
+
+// sendDirect sends a user-defined message straight to msg.peer wrapped
+// in a DIRECT message. The user message type is put in front of the data.
+func (n *Node) sendDirect(msg *Message) {
+	umsg := &UDPMessage{to: msg.peer, from: n.thisNode}
+
+	binary.BigEndian.PutUint32(umsg.buf[:], msg.ID)
+	binary.BigEndian.PutUint32(umsg.buf[4:], uint32(DIRECT))
+	binary.BigEndian.PutUint32(umsg.buf[12:], uint32(msg.Type))
+	nc := copy(umsg.buf[16:], msg.Data)
+
+	umsg.payload = umsg.buf[:nc+16]
+	n.stats.countSent(DIRECT)
+	n.transport.Send(umsg)
 }
 
 func (n *Node) updateState(s nodeState) {
+	n.stats.changeState(s)
+
 	switch s {
 	case connected:
 		// sanity check
@@ -640,6 +896,10 @@ func (n *Node) updateState(s nodeState) {
 		n.aliveTimer.Reset(aliveTime)
 		n.kickTimer.Stop()
 		n.broadcastTimer.Stop()
+		if n.metaTimer.stopped {
+			// Gossip metadata right after joining.
+			n.metaTimer.Reset(0)
+		}
 	case disconnected:
 		// Setting these to zero should not be necessary, but
 		// useful for debugging because we can detect if a
@@ -654,10 +914,13 @@ func (n *Node) updateState(s nodeState) {
 		n.broadcastTimer.Reset(broadcastTime)
 		n.aliveTimer.Stop()
 		n.kickTimer.Stop()
+		n.metaTimer.Stop()
+		n.members.clear()
 	case detached2ndLeft:
 		n.left2ndNode.SetZero()
 		n.state = detached2ndLeft
 	default:
 		n.state = s
 	}
+	atomic.StoreInt32(&n.sharedState, int32(n.state))
 }
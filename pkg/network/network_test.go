@@ -0,0 +1,201 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testType MsgType = 16
+
+// lossyTransport drops the datagrams drop returns true for.
+type lossyTransport struct {
+	Transport
+	mu   sync.Mutex
+	drop func(mtype MsgType) bool
+}
+
+func (t *lossyTransport) Send(umsg *UDPMessage) {
+	var msg Message
+	unpackMsg(umsg.payload, &msg)
+	t.mu.Lock()
+	drop := t.drop != nil && t.drop(msg.Type)
+	t.mu.Unlock()
+	if !drop {
+		t.Transport.Send(umsg)
+	}
+}
+
+// startRing starts a node on each transport, and waits until they are
+// all connected.
+func startRing(t *testing.T, trs ...Transport) []*Node {
+	var nodes []*Node
+	for i, tr := range trs {
+		n := NewNodeWithTransport(tr)
+		n.SetMeta(Meta{Name: fmt.Sprint("node", i)})
+		n.Start()
+		t.Cleanup(n.Stop)
+		nodes = append(nodes, n)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		connected := true
+		for _, n := range nodes {
+			connected = connected && n.IsConnected()
+		}
+		if connected {
+			return nodes
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the ring")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// receive waits for a message on c.
+func receive(t *testing.T, c func() *Message, what string) *Message {
+	t.Helper()
+	done := make(chan *Message, 1)
+	go func() { done <- c() }()
+	select {
+	case msg := <-done:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return nil
+}
+
+func TestSendTo(t *testing.T) {
+	hub := NewLoopback()
+	lossy := &lossyTransport{Transport: hub.NewTransport()}
+	nodes := startRing(t, hub.NewTransport(), lossy)
+	a, b := nodes[0], nodes[1]
+
+	// The message is delivered to b, and returned to a when b
+	// acknowledges it.
+	msg := NewMessage(testType, []byte("first"))
+	a.SendTo(b.Addr(), msg)
+	got := receive(t, b.ReceiveMessage, "the message")
+	if !got.IsDirect() || got.Peer() != a.Addr() || !bytes.Equal(got.Data, msg.Data) {
+		t.Errorf("received %+v from %v", got, got.Peer())
+	}
+	if ack := receive(t, a.ReceiveMyMessage, "the ACK"); ack.ID != msg.ID {
+		t.Errorf("ACK of %v, want %v", ack.ID, msg.ID)
+	}
+
+	// The first ACK is lost, so the message is resent. The duplicate
+	// is acknowledged, but not delivered again.
+	first := true
+	lossy.mu.Lock()
+	lossy.drop = func(mtype MsgType) bool {
+		drop := first && mtype == ACK
+		if drop {
+			first = false
+		}
+		return drop
+	}
+	lossy.mu.Unlock()
+	msg = NewMessage(testType, []byte("resent"))
+	a.SendTo(b.Addr(), msg)
+	if got := receive(t, b.ReceiveMessage, "the message"); got.ID != msg.ID {
+		t.Fatalf("received %v, want %v", got.ID, msg.ID)
+	}
+	if ack := receive(t, a.ReceiveMyMessage, "the ACK of the resend"); ack.ID != msg.ID {
+		t.Errorf("ACK of %v, want %v", ack.ID, msg.ID)
+	}
+	next := NewMessage(testType, []byte("next"))
+	a.SendTo(b.Addr(), next)
+	if got := receive(t, b.ReceiveMessage, "the next message"); got.ID != next.ID {
+		t.Errorf("received %v twice", got.ID)
+	}
+	if st := a.Stats(); st.Retries == 0 {
+		t.Error("no retries counted")
+	}
+}
+
+func TestSendToUndelivered(t *testing.T) {
+	hub := NewLoopback()
+	nodes := startRing(t, hub.NewTransport(), hub.NewTransport())
+	a := nodes[0]
+
+	// Messages that can not be sent are returned at once.
+	var zero Addr
+	for _, msg := range []*Message{
+		NewMessage(PING, nil),
+		NewMessage(testType, make([]byte, MaxDirectDataLength+1)),
+	} {
+		a.SendTo(nodes[1].Addr(), msg)
+		if got := receive(t, a.GetUndelivered, "a rejected message"); got != msg {
+			t.Errorf("undelivered %v, want %v", got.ID, msg.ID)
+		}
+	}
+	msg := NewMessage(testType, nil)
+	a.SendTo(zero, msg)
+	if got := receive(t, a.GetUndelivered, "a message without receiver"); got != msg {
+		t.Errorf("undelivered %v, want %v", got.ID, msg.ID)
+	}
+
+	// A message to a node that is not there is returned after the
+	// resends.
+	msg = NewMessage(testType, []byte("lost"))
+	gone := loopbackAddr(0xfffe)
+	a.SendTo(gone, msg)
+	done := make(chan *Message, 1)
+	go func() { done <- a.GetUndelivered() }()
+	select {
+	case got := <-done:
+		if got != msg || got.Peer() != gone {
+			t.Errorf("undelivered %v to %v, want %v", got.ID, got.Peer(), msg.ID)
+		}
+	case <-time.After(2 * (maxResendCount + 1) * msgResendInterval):
+		t.Fatal("message to a missing node not returned")
+	}
+}
+
+func TestMembers(t *testing.T) {
+	hub := NewLoopback()
+	nodes := startRing(t, hub.NewTransport(), hub.NewTransport())
+	a, b := nodes[0], nodes[1]
+	for deadline := time.Now().Add(time.Second); len(a.Members()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("members of a = %v, want a and b", a.Members())
+		}
+		time.Sleep(pollInterval)
+	}
+	if m, ok := a.Member(b.Addr()); !ok || m.Name != "node1" {
+		t.Errorf("meta of b = %+v, %v", m, ok)
+	}
+
+	// A node that broadcasts, but never joins, is not a member.
+	tr := hub.NewTransport()
+	out := NewNodeWithTransport(tr)
+	out.thisNode = tr.Addr()
+	out.SetMeta(Meta{Name: "outsider"})
+	out.sendData(tr.BroadcastAddr(), BROADCAST, nil)
+
+	// The nodes handle one message at a time, so they are done with
+	// the BROADCAST when they answer a QUERY sent after it.
+	for _, n := range nodes {
+		out.sendData(n.Addr(), QUERY, nil)
+	}
+	for links := 0; links < len(nodes); {
+		select {
+		case umsg := <-tr.Incoming():
+			var msg Message
+			unpackMsg(umsg.payload, &msg)
+			if msg.Type == LINKS {
+				links++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for LINKS")
+		}
+	}
+	for _, n := range nodes {
+		if _, ok := n.Member(tr.Addr()); ok {
+			t.Errorf("outsider is a member of %v", n.Addr())
+		}
+	}
+}
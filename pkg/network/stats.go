@@ -0,0 +1,238 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets in the ping round-trip time histograms.
+// RTTs above the last bound are counted in an extra overflow bucket.
+var RTTBuckets = []time.Duration{
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+}
+
+// Histogram counts round-trip times. Counts[i] is the number of RTTs
+// in (RTTBuckets[i-1], RTTBuckets[i]], and the last element is the
+// number of RTTs above the last bucket.
+type Histogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func (h *Histogram) add(rtt time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(RTTBuckets)+1)
+	}
+	i := 0
+	for ; i < len(RTTBuckets) && rtt > RTTBuckets[i]; i++ {
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += rtt
+}
+
+// Stats is a snapshot of the counters of a Node.
+type Stats struct {
+	// Ping round-trip times for each neighbour that has been pinged.
+	RTT map[Addr]Histogram
+
+	// Number of datagrams sent and received of each message type.
+	// Direct messages are counted as DIRECT.
+	Sent     map[MsgType]uint64
+	Received map[MsgType]uint64
+
+	// Number of messages resent, and number of messages given up
+	// on after maxResendCount resends.
+	Retries  uint64
+	Timeouts uint64
+
+	// Number of nodes kicked by this node, and number of KICK
+	// messages received from other nodes.
+	Kicks     uint64
+	KicksSeen uint64
+
+	// Time spent in each node state, by name.
+	StateTime map[string]time.Duration
+
+	// Number of messages dropped because a buffer was full or the
+	// message had been read too many times.
+	Drops uint64
+}
+
+// nodeStats is updated by the maintainNetwork goroutine and read by
+// Node.Stats.
+type nodeStats struct {
+	mu sync.Mutex
+
+	rtt      map[Addr]*Histogram
+	pingSent map[Addr]time.Time
+
+	sent     map[MsgType]uint64
+	received map[MsgType]uint64
+
+	retries  uint64
+	timeouts uint64
+
+	kicks     uint64
+	kicksSeen uint64
+
+	state      nodeState
+	stateSince time.Time
+	stateTime  map[nodeState]time.Duration
+
+	drops uint64
+}
+
+func newNodeStats() *nodeStats {
+	return &nodeStats{
+		rtt:        make(map[Addr]*Histogram),
+		pingSent:   make(map[Addr]time.Time),
+		sent:       make(map[MsgType]uint64),
+		received:   make(map[MsgType]uint64),
+		stateTime:  make(map[nodeState]time.Duration),
+		stateSince: time.Now(),
+	}
+}
+
+// Stats returns a snapshot of the node's counters.
+func (n *Node) Stats() Stats {
+	s := n.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		RTT:       make(map[Addr]Histogram),
+		Sent:      make(map[MsgType]uint64),
+		Received:  make(map[MsgType]uint64),
+		Retries:   s.retries,
+		Timeouts:  s.timeouts,
+		Kicks:     s.kicks,
+		KicksSeen: s.kicksSeen,
+		StateTime: make(map[string]time.Duration),
+		Drops:     s.drops,
+	}
+	for addr, h := range s.rtt {
+		c := *h
+		c.Counts = append([]uint64(nil), h.Counts...)
+		st.RTT[addr] = c
+	}
+	for t, v := range s.sent {
+		st.Sent[t] = v
+	}
+	for t, v := range s.received {
+		st.Received[t] = v
+	}
+	for state, d := range s.stateTime {
+		st.StateTime[state.String()] = d
+	}
+	st.StateTime[s.state.String()] += time.Since(s.stateSince)
+
+	return st
+}
+
+func (s *nodeStats) countSent(mtype MsgType) {
+	s.mu.Lock()
+	s.sent[mtype]++
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) countReceived(mtype MsgType) {
+	s.mu.Lock()
+	s.received[mtype]++
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) pinged(addr Addr) {
+	s.mu.Lock()
+	s.pingSent[addr] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) alive(addr Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent, ok := s.pingSent[addr]
+	if !ok {
+		return
+	}
+	delete(s.pingSent, addr)
+
+	h, ok := s.rtt[addr]
+	if !ok {
+		h = new(Histogram)
+		s.rtt[addr] = h
+	}
+	h.add(time.Since(sent))
+}
+
+func (s *nodeStats) changeState(state nodeState) {
+	s.mu.Lock()
+	now := time.Now()
+	s.stateTime[s.state] += now.Sub(s.stateSince)
+	s.state = state
+	s.stateSince = now
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) add(counter *uint64) {
+	s.mu.Lock()
+	*counter++
+	s.mu.Unlock()
+}
+
+func (s nodeState) String() string {
+	switch s {
+	case connected:
+		return "connected"
+	case disconnected:
+		return "disconnected"
+	case stopped:
+		return "stopped"
+	case detached2ndLeft:
+		return "detached2ndLeft"
+	case ready:
+		return "ready"
+	}
+	return fmt.Sprintf("nodeState(%d)", int(s))
+}
+
+func (t MsgType) String() string {
+	switch t {
+	case BROADCAST:
+		return "BROADCAST"
+	case HELLO:
+		return "HELLO"
+	case UPDATE:
+		return "UPDATE"
+	case GET:
+		return "GET"
+	case PING:
+		return "PING"
+	case ALIVE:
+		return "ALIVE"
+	case KICK:
+		return "KICK"
+	case DIRECT:
+		return "DIRECT"
+	case ACK:
+		return "ACK"
+	case QUERY:
+		return "QUERY"
+	case LINKS:
+		return "LINKS"
+	case META:
+		return "META"
+	}
+	return fmt.Sprintf("0x%x", uint32(t))
+}
@@ -1,31 +1,34 @@
 package network
 
 import (
+	"math/rand"
 	"testing"
 	"time"
-	"math/rand"
 )
 
-func TestSafeTimer(test *testing.T) {
+func TestTimer(test *testing.T) {
 	const timeout = 1 * time.Millisecond
-	t := NewSafeTimer(timeout)
+	var t Timer
 	for i := 0; i < 100; i++ {
-		// t2 in [0.5,1.5)*timeout
-		t2 := timeout + time.Duration(rand.Intn(100)-50)*timeout/100
-		start := time.Now()
-		select {
-		case <-time.After(t2):
-		case <-t.C:
-			t.Seen()
+		t.Reset(timeout)
+		if t.HasTimedOut() {
+			test.Fatal("timed out right after reset")
+		}
+		// t2 in [1.5,2.5)*timeout
+		t2 := 2*timeout + time.Duration(rand.Intn(100)-50)*timeout/100
+		time.Sleep(t2)
+		if !t.HasTimedOut() {
+			test.Fatalf("not timed out after %v", t2)
 		}
-		elapsed := time.Since(start)
-		
-		if elapsed < timeout/4 {
-			test.Errorf("short sleep: %v", elapsed)
+		if t.Reset(timeout) {
+			test.Error("Reset returned true for an expired timer")
+		}
+		if !t.Stop() {
+			test.Error("Stop returned false before the timeout")
+		}
+		time.Sleep(t2)
+		if t.HasTimedOut() {
+			test.Fatal("stopped timer has timed out")
 		}
-		time.Sleep(10 * timeout)  // make sure that t has expired
-		t.SafeReset(timeout)
 	}
 }
-
-	
@@ -0,0 +1,146 @@
+package network
+
+import (
+	"sync"
+)
+
+// Transport carries the datagrams of a node. The UDPService sends them
+// over the network, and a Loopback between the nodes of one process.
+type Transport interface {
+	// Addr returns the address of the node.
+	Addr() Addr
+
+	// BroadcastAddr returns an address that reaches every node.
+	BroadcastAddr() Addr
+
+	Send(umsg *UDPMessage)
+	Incoming() <-chan *UDPMessage
+}
+
+// Loopback is a network inside one process. Each transport created by
+// NewTransport gets its own address, so several nodes can form a ring
+// without any sockets. Like UDP, datagrams are dropped if the receiver
+// falls behind.
+//
+// The network can be split with Partition, to see how the nodes behave
+// when some of them can not reach the others.
+type Loopback struct {
+	mu    sync.Mutex
+	ports map[Addr]*loopbackPort
+	next  int
+	group map[Addr]int // nil if the network is whole
+}
+
+type loopbackPort struct {
+	hub      *Loopback
+	addr     Addr
+	incoming chan *UDPMessage
+}
+
+// Loopback addresses are 127.77.x.y, and the broadcast address is
+// 127.77.255.255.
+var (
+	loopbackNet       = [4]byte{127, 77, 0, 0}
+	loopbackBroadcast = loopbackAddr(0xffff)
+)
+
+func loopbackAddr(i int) Addr {
+	var a Addr
+	a[10], a[11] = 0xff, 0xff
+	a[12], a[13] = loopbackNet[0], loopbackNet[1]
+	a[14], a[15] = byte(i>>8), byte(i)
+	return a
+}
+
+func NewLoopback() *Loopback {
+	return &Loopback{ports: make(map[Addr]*loopbackPort)}
+}
+
+// NewTransport returns a transport with a new address on the loopback
+// network.
+func (l *Loopback) NewTransport() Transport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.next++
+	p := &loopbackPort{
+		hub:      l,
+		addr:     loopbackAddr(l.next),
+		incoming: make(chan *UDPMessage, bufferSize),
+	}
+	l.ports[p.addr] = p
+	return p
+}
+
+// Partition splits the network into the given groups of transports.
+// Datagrams only get through between transports in the same group, and
+// a transport that is in no group is cut off from all the others.
+func (l *Loopback) Partition(groups ...[]Transport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.group = make(map[Addr]int)
+	for i, g := range groups {
+		for _, t := range g {
+			l.group[t.Addr()] = i + 1
+		}
+	}
+}
+
+// Heal joins the partitions again.
+func (l *Loopback) Heal() {
+	l.mu.Lock()
+	l.group = nil
+	l.mu.Unlock()
+}
+
+// reachable returns true if a datagram can get from one address to the
+// other.
+func (l *Loopback) reachable(from, to Addr) bool {
+	if l.group == nil {
+		return true
+	}
+	g := l.group[from]
+	return g != 0 && g == l.group[to]
+}
+
+func (p *loopbackPort) Addr() Addr {
+	return p.addr
+}
+
+func (p *loopbackPort) BroadcastAddr() Addr {
+	return loopbackBroadcast
+}
+
+func (p *loopbackPort) Incoming() <-chan *UDPMessage {
+	return p.incoming
+}
+
+// Send delivers a copy of the datagram to the receiver, or to every
+// other port for the broadcast address. Ports in another partition do
+// not get it.
+func (p *loopbackPort) Send(umsg *UDPMessage) {
+	p.hub.mu.Lock()
+	defer p.hub.mu.Unlock()
+
+	if umsg.to == loopbackBroadcast {
+		for addr, to := range p.hub.ports {
+			if addr != p.addr && p.hub.reachable(p.addr, addr) {
+				to.deliver(p.addr, umsg.payload)
+			}
+		}
+	} else if to, ok := p.hub.ports[umsg.to]; ok && p.hub.reachable(p.addr, umsg.to) {
+		to.deliver(p.addr, umsg.payload)
+	}
+}
+
+func (p *loopbackPort) deliver(from Addr, payload []byte) {
+	umsg := &UDPMessage{from: from, to: p.addr}
+	n := copy(umsg.buf[:], payload)
+	umsg.payload = umsg.buf[:n]
+
+	select {
+	case p.incoming <- umsg:
+	default:
+	}
+}
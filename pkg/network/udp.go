@@ -1,4 +1,3 @@
-
 package network
 
 import (
@@ -13,6 +12,7 @@ const (
 type UDPMessage struct {
 	from Addr
 	to   Addr
+	port int // UDPPort if zero
 	buf  [maxPayloadLength]byte
 
 	payload []byte
@@ -23,10 +23,20 @@ type UDPService struct {
 	receivec chan *UDPMessage
 	sendc    chan *UDPMessage
 
-	addr Addr
+	addr      Addr
+	broadcast Addr
 }
 
 func NewUDPService() (*UDPService, error) {
+	thisAddr, err := NetworkAddr()
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := BroadcastAddr()
+	if err != nil {
+		return nil, err
+	}
+
 	addr := net.UDPAddr{
 		IP:   net.IPv4zero,
 		Port: UDPPort,
@@ -40,9 +50,10 @@ func NewUDPService() (*UDPService, error) {
 		conn:     conn,
 		receivec: make(chan *UDPMessage, 1),
 		sendc:    make(chan *UDPMessage, 1),
-	}
 
-	s.addr, _ = NetworkAddr()
+		addr:      thisAddr,
+		broadcast: broadcast,
+	}
 
 	go s.receiveLoop()
 	go s.sendLoop()
@@ -50,6 +61,18 @@ func NewUDPService() (*UDPService, error) {
 	return s, nil
 }
 
+func (s *UDPService) Addr() Addr {
+	return s.addr
+}
+
+func (s *UDPService) BroadcastAddr() Addr {
+	return s.broadcast
+}
+
+func (s *UDPService) Incoming() <-chan *UDPMessage {
+	return s.receivec
+}
+
 func (s *UDPService) Send(umsg *UDPMessage) {
 	s.sendc <- umsg
 }
@@ -68,6 +91,7 @@ func (s *UDPService) receiveLoop() {
 			continue
 		}
 		copy(umsg.from[:], raddr.IP.To16())
+		umsg.port = raddr.Port
 		umsg.payload = umsg.buf[:n]
 		s.receivec <- umsg
 	}
@@ -80,6 +104,9 @@ func (s *UDPService) sendLoop() {
 			IP:   net.IP(umsg.to[:]),
 			Port: UDPPort,
 		}
+		if umsg.port != 0 {
+			addr.Port = umsg.port
+		}
 		s.conn.WriteToUDP(umsg.payload, &addr)
 	}
 }
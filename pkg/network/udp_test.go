@@ -1,25 +1,18 @@
 package network
 
 import (
-	"fmt"
-	"os"
-	"testing"
 	"net"
+	"testing"
 )
 
-func TestMain(m *testing.M) {
-	node := new(Node)
-	err := node.Start()
+func TestAddrs(t *testing.T) {
+	addr, err := NetworkAddr()
 	if err != nil {
-		fmt.Println(err)
+		t.Skip("no network interface configured:", err)
 	}
-
-	fmt.Println(net.IP(NetworkAddr()))
-	fmt.Println(net.IP(BroadcastAddr()))
-	
-	//fmt.Println(node.IsConnected())
-	
-	select{}
-
-	os.Exit(0)
+	broadcast, err := BroadcastAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(net.IP(addr[:]), net.IP(broadcast[:]))
 }